@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	"backend/internal/token"
 	"backend/logging"
 	"github.com/gin-gonic/gin"
 )
@@ -73,12 +74,13 @@ func access(c *gin.Context) {
 		return
 	}
 
-	_, err := validateJWTToken(tokenString)
+	claims, err := validateJWTToken(tokenString)
 	if err != nil {
 		logging.Errorf("Invalid token: %v", err)
 		c.Status(http.StatusUnauthorized)
 		return
 	}
+	c.Header(token.UserHeader, claims.Subject)
 	c.Status(http.StatusOK)
 }
 
@@ -1,54 +1,24 @@
 package auth
 
 import (
-	"errors"
-	"fmt"
 	"log"
-	"os"
-	"time"
 
-	"github.com/golang-jwt/jwt"
+	"backend/internal/token"
 )
 
-const expirationTime = 1 * time.Hour
-
-var jwtSecret []byte
+var tokens *token.Signer
 
 func init() {
-	jwtSecret = []byte(os.Getenv("JWT_SECRET"))
-	if len(jwtSecret) == 0 {
-		log.Fatal("JWT_SECRET environment variable is not set")
+	var err error
+	if tokens, err = token.FromEnv(); err != nil {
+		log.Fatal(err)
 	}
 }
 
 func generateJWT(sub, issuer string) (string, error) {
-	claims := jwt.StandardClaims{
-		ExpiresAt: time.Now().Add(expirationTime).Unix(),
-		Subject:   sub,
-		Issuer:    issuer,
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return tokens.Sign(sub, issuer)
 }
 
-func validateJWTToken(tokenString string) (*jwt.StandardClaims, error) {
-	keyFunc := func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return jwtSecret, nil
-	}
-
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.StandardClaims{}, keyFunc)
-
-	if err != nil {
-		return nil, err
-	}
-
-	if claims, ok := token.Claims.(*jwt.StandardClaims); ok && token.Valid {
-		return claims, nil
-	}
-
-	return nil, errors.New("invalid token")
+func validateJWTToken(tokenString string) (*token.Claims, error) {
+	return tokens.Validate(tokenString)
 }
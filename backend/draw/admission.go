@@ -0,0 +1,117 @@
+package draw
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"backend/internal/protocol"
+	"backend/logging"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	defaultMaxLag          = 5 * time.Second
+	defaultMaxLagEntries   = 5_000
+	defaultLagPollInterval = time.Second
+	minRetryAfter          = time.Second
+	maxRetryAfter          = 30 * time.Second
+)
+
+// Admission rejects placements while the grid service is too far behind the
+// update stream, so a spike backs off at the edge instead of growing the stream.
+type Admission struct {
+	reader       redis.UniversalClient
+	lag          atomic.Pointer[protocol.ConsumerLag]
+	maxLag       time.Duration
+	maxEntries   int64
+	pollInterval time.Duration
+}
+
+func NewAdmission(reader redis.UniversalClient, maxLag time.Duration, maxEntries int64) *Admission {
+	return &Admission{
+		reader:       reader,
+		maxLag:       maxLag,
+		maxEntries:   maxEntries,
+		pollInterval: defaultLagPollInterval,
+	}
+}
+
+func (a *Admission) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.poll(ctx)
+		}
+	}
+}
+
+func (a *Admission) poll(ctx context.Context) {
+	raw, err := a.reader.Get(ctx, protocol.ConsumerLagKey).Result()
+	if errors.Is(err, redis.Nil) {
+		// the grid service hasn't measured recently; don't block placements on it
+		a.lag.Store(nil)
+
+		return
+	}
+	if err != nil {
+		logging.Errorf("failed to read consumer lag: %v", err)
+
+		return
+	}
+
+	lag, err := protocol.DecodeConsumerLag(raw)
+	if err != nil {
+		logging.Errorf("%v", err)
+
+		return
+	}
+	a.lag.Store(&lag)
+}
+
+// retryAfter reports whether a placement must be refused and, if so, how long
+// the client should wait, scaled by how far past the limit the grid is.
+func (a *Admission) retryAfter() (time.Duration, bool) {
+	lag := a.lag.Load()
+	if lag == nil {
+		return 0, false
+	}
+
+	lagExceeded := lag.Behind > a.maxLag
+	entriesExceeded := lag.Entries > a.maxEntries
+	if !lagExceeded && !entriesExceeded {
+		return 0, false
+	}
+
+	wait := minRetryAfter
+	if lagExceeded {
+		wait = max(wait, lag.Behind-a.maxLag)
+	}
+
+	return min(wait, maxRetryAfter), true
+}
+
+func (a *Admission) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		wait, overloaded := a.retryAfter()
+		if !overloaded {
+			c.Next()
+
+			return
+		}
+
+		placementsRejected.WithLabelValues(reasonOverloaded).Inc()
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "canvas is busy, try again later"})
+	}
+}
@@ -0,0 +1,71 @@
+package draw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"backend/internal/protocol"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmissionRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		lag        *protocol.ConsumerLag
+		overloaded bool
+		wait       time.Duration
+	}{
+		{name: "no measurement", lag: nil},
+		{name: "within limits", lag: &protocol.ConsumerLag{Entries: 10, Behind: time.Second}},
+		{
+			name:       "lag exceeded",
+			lag:        &protocol.ConsumerLag{Entries: 10, Behind: 8 * time.Second},
+			overloaded: true,
+			wait:       3 * time.Second,
+		},
+		{
+			name:       "entries exceeded",
+			lag:        &protocol.ConsumerLag{Entries: 6_000},
+			overloaded: true,
+			wait:       minRetryAfter,
+		},
+		{
+			name:       "wait is capped",
+			lag:        &protocol.ConsumerLag{Behind: 10 * time.Minute},
+			overloaded: true,
+			wait:       maxRetryAfter,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAdmission(nil, defaultMaxLag, defaultMaxLagEntries)
+			a.lag.Store(tt.lag)
+
+			wait, overloaded := a.retryAfter()
+			assert.Equal(t, tt.overloaded, overloaded)
+			assert.Equal(t, tt.wait, wait)
+		})
+	}
+}
+
+func TestAdmissionMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	a := NewAdmission(nil, defaultMaxLag, defaultMaxLagEntries)
+	a.lag.Store(&protocol.ConsumerLag{Behind: 7500 * time.Millisecond})
+
+	r := gin.New()
+	r.POST("/api/draw", a.Middleware(), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/api/draw", nil)
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "3", w.Header().Get("Retry-After"))
+}
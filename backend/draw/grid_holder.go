@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"backend/internal/protocol"
+	"backend/logging"
 	"github.com/go-redis/redis/v8"
 )
 
@@ -22,18 +23,48 @@ func NewGridHolder(stream string, writer redis.UniversalClient) *CellBroadcast {
 	return holder
 }
 
-func reqToCell(r *Req) protocol.Cell {
-	return protocol.Cell{X: r.X, Y: r.Y, Color: r.Color, Time: time.Now().UnixMilli()}
+func reqToCell(r *Req, now int64) protocol.Cell {
+	return protocol.Cell{X: r.X, Y: r.Y, Color: r.Color, Time: now}
 }
 
-func (gh *CellBroadcast) updateCell(req *Req) error {
-	cell := reqToCell(req)
-	bytes := cell.Encode()
+func (gh *CellBroadcast) updateCell(req *Req, placer string) error {
+	now := time.Now().UnixMilli()
+	cell := reqToCell(req, now)
 
-	return gh.writer.XAdd(context.Background(), &redis.XAddArgs{
-		Stream: gh.stream,
-		Values: map[string]interface{}{
-			"values": string(bytes[:]),
-		},
-	}).Err()
+	return gh.publish(map[string]interface{}{
+		protocol.CellField: string(cell.Encode()),
+	}, placer, now)
+}
+
+// updateCells writes all cells as a single stream entry so the grid applies
+// them together.
+func (gh *CellBroadcast) updateCells(reqs []Req, placer string) error {
+	now := time.Now().UnixMilli()
+	cells := make([]protocol.Cell, len(reqs))
+	for i := range reqs {
+		cells[i] = reqToCell(&reqs[i], now)
+	}
+
+	return gh.publish(map[string]interface{}{
+		protocol.BatchField: string(protocol.EncodeBatch(cells)),
+	}, placer, now)
+}
+
+// publish appends a stream entry and, in the same round trip, marks placer
+// as active for the ws presence count. Only a failed append is an error.
+func (gh *CellBroadcast) publish(values map[string]interface{}, placer string, now int64) error {
+	ctx := context.Background()
+
+	var added *redis.StringCmd
+	var active *redis.IntCmd
+	_, _ = gh.writer.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		added = pipe.XAdd(ctx, &redis.XAddArgs{Stream: gh.stream, Values: values})
+		active = pipe.ZAdd(ctx, protocol.PlacersKey, &redis.Z{Score: float64(now), Member: placer})
+		return nil
+	})
+	if err := active.Err(); err != nil {
+		logging.Errorf("failed to record active placer: %v", err)
+	}
+
+	return added.Err()
 }
@@ -3,24 +3,73 @@ package draw
 import (
 	"net/http"
 
+	"backend/internal/config"
+	"backend/internal/token"
 	"backend/logging"
 	"github.com/gin-gonic/gin"
 )
 
+// trustAuthHeader is set when draw only receives requests through the
+// ingress forward-auth, which overwrites the user header. Without it the
+// header comes straight from the client and is ignored.
+var trustAuthHeader = config.Bool("DRAW_TRUST_AUTH_HEADER", false)
+
+// placer identifies who placed for the active placer count: the user the
+// ingress forward-auth vouched for, or the client address without it.
+func placer(c *gin.Context) string {
+	if user := c.GetHeader(token.UserHeader); trustAuthHeader && user != "" {
+		return user
+	}
+
+	return "ip:" + c.ClientIP()
+}
+
 func modifyCell(c *gin.Context, state *CellBroadcast) {
 	var drawReq Req
-	if err := c.ShouldBindJSON(&drawReq); err != nil {
+	err := c.ShouldBindJSON(&drawReq)
+	if err == nil {
+		err = drawReq.validate()
+	}
+	if err != nil {
+		placementsRejected.WithLabelValues(reasonInvalidRequest).Inc()
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 
 		return
 	}
 
-	if err := state.updateCell(&drawReq); err != nil {
+	if err := state.updateCell(&drawReq, placer(c)); err != nil {
+		placementsRejected.WithLabelValues(reasonPublishFailed).Inc()
 		logging.Errorf("failed to update a cell %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "something went wrong"})
 
 		return
 	}
 
+	placementsAccepted.Inc()
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func modifyCells(c *gin.Context, state *CellBroadcast) {
+	var batchReq BatchReq
+	err := c.ShouldBindJSON(&batchReq)
+	if err == nil {
+		err = batchReq.validate()
+	}
+	if err != nil {
+		placementsRejected.WithLabelValues(reasonInvalidRequest).Inc()
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+
+		return
+	}
+
+	if err := state.updateCells(batchReq.Cells, placer(c)); err != nil {
+		placementsRejected.WithLabelValues(reasonPublishFailed).Add(float64(len(batchReq.Cells)))
+		logging.Errorf("failed to update %d cells %v", len(batchReq.Cells), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "something went wrong"})
+
+		return
+	}
+
+	placementsAccepted.Add(float64(len(batchReq.Cells)))
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
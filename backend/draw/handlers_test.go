@@ -0,0 +1,57 @@
+package draw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"backend/internal/token"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrawRejectsCellsOutsideTheCanvas(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.POST("/api/draw", func(c *gin.Context) { modifyCell(c, nil) })
+	r.POST("/api/draw/batch", func(c *gin.Context) { modifyCells(c, nil) })
+
+	tests := []struct {
+		name string
+		path string
+		body string
+	}{
+		{name: "x past the edge", path: "/api/draw", body: `{"x":100,"y":0,"color":1}`},
+		{name: "y past the edge", path: "/api/draw", body: `{"x":0,"y":100,"color":1}`},
+		{name: "unknown color", path: "/api/draw", body: `{"x":0,"y":0,"color":16}`},
+		{name: "one bad cell in a batch", path: "/api/draw/batch", body: `{"cells":[{"x":1,"y":1,"color":1},{"x":0,"y":0,"color":200}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+}
+
+func TestPlacerTrustsAuthHeaderOnlyBehindForwardAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(trust bool) { trustAuthHeader = trust }(trustAuthHeader)
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request, _ = http.NewRequest(http.MethodPost, "/api/draw", nil)
+	c.Request.RemoteAddr = "192.0.2.1:1234"
+	c.Request.Header.Set(token.UserHeader, "someone")
+
+	trustAuthHeader = false
+	assert.Equal(t, "ip:192.0.2.1", placer(c), "a client can't claim to be someone")
+
+	trustAuthHeader = true
+	assert.Equal(t, "someone", placer(c))
+}
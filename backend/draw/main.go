@@ -1,6 +1,11 @@
 package draw
 
 import (
+	"errors"
+	"fmt"
+
+	"backend/internal/config"
+	"backend/internal/protocol"
 	"backend/web"
 	"github.com/gin-gonic/gin"
 )
@@ -11,16 +16,53 @@ type Req struct {
 	Color uint8  `json:"color"`
 }
 
+type BatchReq struct {
+	Cells []Req `json:"cells" binding:"required,min=1,max=64"`
+}
+
+var ErrOutsideCanvas = errors.New("cell is outside the canvas")
+
+// validate rejects cells the grid would refuse, before they reach the stream.
+func (r *Req) validate() error {
+	if r.X >= protocol.CanvasSize || r.Y >= protocol.CanvasSize || r.Color > protocol.MaxColor {
+		return fmt.Errorf("%w: cell %d,%d color %d", ErrOutsideCanvas, r.X, r.Y, r.Color)
+	}
+
+	return nil
+}
+
+func (b *BatchReq) validate() error {
+	for i := range b.Cells {
+		if err := b.Cells[i].validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func Run() {
 	redis := web.DefaultRedis()
 
-	gridHolder := NewGridHolder("grid_updates", redis)
+	gridHolder := NewGridHolder(protocol.UpdatesStream, redis)
+	admission := NewAdmission(
+		redis,
+		config.Duration("DRAW_MAX_LAG", defaultMaxLag),
+		int64(config.Int("DRAW_MAX_LAG_ENTRIES", defaultMaxLagEntries)),
+	)
 
 	ginEngine := web.WithGinEngine(func(r *gin.Engine) {
-		r.POST("/api/draw", func(c *gin.Context) {
+		r.POST("/api/draw", admission.Middleware(), func(c *gin.Context) {
 			modifyCell(c, gridHolder)
 		})
+		r.POST("/api/draw/batch", admission.Middleware(), func(c *gin.Context) {
+			modifyCells(c, gridHolder)
+		})
 	})
 
-	web.NewServer(web.WithRedis(redis), ginEngine).Run()
+	web.NewServer(
+		web.WithRedis(redis),
+		ginEngine,
+		web.WithBackgroundWorker(admission.Run),
+	).Run()
 }
@@ -0,0 +1,24 @@
+package draw
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	reasonInvalidRequest = "invalid_request"
+	reasonPublishFailed  = "publish_failed"
+	reasonOverloaded     = "overloaded"
+)
+
+var (
+	placementsAccepted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "draw_placements_accepted_total",
+		Help: "Pixel placements accepted and written to the update stream.",
+	})
+
+	placementsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "draw_placements_rejected_total",
+		Help: "Pixel placements rejected, by reason.",
+	}, []string{"reason"})
+)
@@ -0,0 +1,75 @@
+package grid
+
+import (
+	"context"
+	"fmt"
+
+	"backend/internal/protocol"
+	"github.com/go-redis/redis/v8"
+)
+
+// applyScript applies the cells of one stream message in a single atomic step:
+// for each cell it sets the canvas nibble, takes the next sequence number,
+// stores the sequenced update in its bucket and publishes it. Doing it in one
+// script keeps the canvas and its sequence number consistent for readers and
+// publishes updates in sequence order. The processed marker makes a redelivered
+// message a no-op, in which case the script returns 0.
+//
+// KEYS: processed marker, canvas, sequence, updates bucket
+// ARGV: broadcast channel, bucket score, marker TTL in ms, then
+// offset, color, encoded cell for every cell.
+var applyScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+
+local seq = 0
+for i = 4, #ARGV, 3 do
+	redis.call('BITFIELD', KEYS[2], 'SET', 'u4', ARGV[i], ARGV[i + 1])
+	seq = redis.call('INCR', KEYS[3])
+
+	local prefix = {}
+	local n = seq
+	for b = 8, 1, -1 do
+		prefix[b] = n % 256
+		n = math.floor(n / 256)
+	end
+	local update = string.char(unpack(prefix)) .. ARGV[i + 2]
+
+	redis.call('ZADD', KEYS[4], ARGV[2], update)
+	redis.call('PUBLISH', ARGV[1], update)
+end
+
+redis.call('SET', KEYS[1], 1, 'PX', ARGV[3])
+return seq
+`)
+
+// applyCells runs applyScript for one message and returns the sequence number
+// of its last cell, or 0 if the message had already been applied.
+func (s *Service) applyCells(ctx context.Context, msgID string, epoch, timestamp int64, cells []protocol.Cell) (uint64, error) {
+	keys := []string{
+		processedKey(msgID),
+		s.config.GridKey,
+		protocol.SeqKey(s.config.GridKey),
+		protocol.UpdatesKey(s.config.GridKey, epoch),
+	}
+
+	args := make([]interface{}, 0, 3+3*len(cells))
+	args = append(args, BroadcastChannel, timestamp, MessageIDTTL.Milliseconds())
+	for i := range cells {
+		// stored and broadcast in the current wire version, so downstream
+		// readers never see legacy payloads
+		args = append(args, calculateOffset(cells[i].Y, cells[i].X, s.config.GridSize), cells[i].Color, string(cells[i].Encode()))
+	}
+
+	seq, err := applyScript.Run(ctx, s.redisClient, keys, args...).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("apply script: %w", err)
+	}
+
+	return uint64(seq), nil
+}
+
+func processedKey(msgID string) string {
+	return "processed:" + msgID
+}
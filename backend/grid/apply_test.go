@@ -0,0 +1,43 @@
+package grid
+
+import (
+	"context"
+	"testing"
+
+	"backend/internal/protocol"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+type scriptRedis struct {
+	RedisClient
+	keys   []string
+	args   []interface{}
+	result int64
+}
+
+func (m *scriptRedis) EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *redis.Cmd {
+	m.keys, m.args = keys, args
+
+	return redis.NewCmdResult(m.result, nil)
+}
+
+func TestApplyCells(t *testing.T) {
+	rc := &scriptRedis{result: 42}
+	s := &Service{redisClient: rc, config: Config{GridKey: "grid", GridSize: Size}}
+	cells := []protocol.Cell{
+		{X: 0, Y: 0, Color: 3, Time: 1760788800000},
+		{X: 1, Y: 1, Color: 15, Time: 1760788800000},
+	}
+
+	seq, err := s.applyCells(context.Background(), "1760788800000-0", 29346480, 1760788800000, cells)
+
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(42), seq)
+	assert.Equal(t, []string{"processed:1760788800000-0", "grid", "grid:seq", "grid:updates:29346480"}, rc.keys)
+	assert.Equal(t, []interface{}{
+		BroadcastChannel, int64(1760788800000), MessageIDTTL.Milliseconds(),
+		int64(0), uint8(3), string(cells[0].Encode()),
+		int64(404), uint8(15), string(cells[1].Encode()),
+	}, rc.args)
+}
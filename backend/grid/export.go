@@ -0,0 +1,90 @@
+package grid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"backend/internal/protocol"
+	"backend/logging"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+const MaxExportRange = time.Hour
+
+var ErrInvalidExportRange = errors.New("invalid export range")
+
+// exportUpdates collects every stored update placed in [from, to], in
+// placement order.
+func (s *Service) exportUpdates(ctx context.Context, from, to int64) ([]protocol.Cell, error) {
+	if to < from || time.Duration(to-from)*time.Millisecond > MaxExportRange {
+		return nil, fmt.Errorf("%w: %d..%d", ErrInvalidExportRange, from, to)
+	}
+
+	cells := make([]protocol.Cell, 0)
+	for _, epoch := range s.config.Epochs.Span(from, to) {
+		stored, err := s.redisClient.ZRangeByScore(ctx, protocol.UpdatesKey(s.config.GridKey, epoch), &redis.ZRangeBy{
+			Min: strconv.FormatInt(from, 10),
+			Max: strconv.FormatInt(to, 10),
+		}).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return nil, fmt.Errorf("read bucket %d: %w", epoch, err)
+		}
+
+		for _, value := range stored {
+			cell, err := protocol.Decode([]byte(value))
+			if err != nil {
+				logging.Warnf("skipping undecodable update in bucket %d: %v", epoch, err)
+				continue
+			}
+			cells = append(cells, *cell)
+		}
+	}
+
+	return cells, nil
+}
+
+// handleExport serves ?from=&to= (unix ms, to defaults to now, from to one
+// bucket before it) as a protocol batch.
+func (s *Service) handleExport(c *gin.Context) {
+	to := time.Now().UnixMilli()
+	if raw := c.Query("to"); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to"})
+
+			return
+		}
+		to = parsed
+	}
+
+	from := to - s.config.Epochs.Length().Milliseconds()
+	if raw := c.Query("from"); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from"})
+
+			return
+		}
+		from = parsed
+	}
+
+	cells, err := s.exportUpdates(c.Request.Context(), from, to)
+	if errors.Is(err, ErrInvalidExportRange) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+
+		return
+	}
+	if err != nil {
+		logging.Errorf("export failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "something went wrong"})
+
+		return
+	}
+
+	c.Data(http.StatusOK, "application/octet-stream", protocol.EncodeBatch(cells))
+}
@@ -0,0 +1,130 @@
+package grid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"backend/internal/protocol"
+	"backend/logging"
+)
+
+var ErrConsumerLagging = errors.New("consumer group is lagging")
+
+// measureLag reads the consumer group state straight from XINFO GROUPS: the
+// typed go-redis helper rejects the extra fields Redis 7 adds to the reply.
+func (s *Service) measureLag(ctx context.Context) (protocol.ConsumerLag, error) {
+	reply, err := s.redisClient.Do(ctx, "XINFO", "GROUPS", StreamName).Slice()
+	if err != nil {
+		return protocol.ConsumerLag{}, fmt.Errorf("xinfo groups: %w", err)
+	}
+
+	lag := protocol.ConsumerLag{Entries: protocol.UnknownEntries}
+	lastDelivered := ""
+	found := false
+	for _, group := range reply {
+		fields, ok := group.([]interface{})
+		if !ok {
+			continue
+		}
+		info := make(map[string]interface{}, len(fields)/2)
+		for i := 0; i+1 < len(fields); i += 2 {
+			if key, ok := fields[i].(string); ok {
+				info[key] = fields[i+1]
+			}
+		}
+		if info["name"] != ConsumerGroup {
+			continue
+		}
+
+		found = true
+		if pending, ok := info["pending"].(int64); ok {
+			lag.Pending = pending
+		}
+		if entries, ok := info["lag"].(int64); ok {
+			lag.Entries = entries
+		}
+		lastDelivered, _ = info["last-delivered-id"].(string)
+	}
+
+	if !found {
+		return protocol.ConsumerLag{}, fmt.Errorf("consumer group %s not found", ConsumerGroup)
+	}
+
+	newest, err := s.redisClient.XRevRangeN(ctx, StreamName, "+", "-", 1).Result()
+	if err != nil {
+		return protocol.ConsumerLag{}, fmt.Errorf("xrevrange: %w", err)
+	}
+	if len(newest) == 0 || lastDelivered == "0-0" {
+		// a group that hasn't been delivered anything yet, as after a
+		// deploy, has no time to be behind by
+		return lag, nil
+	}
+
+	newestMs, err := parseMessageTimestamp(newest[0].ID)
+	if err != nil {
+		return protocol.ConsumerLag{}, fmt.Errorf("newest id: %w", err)
+	}
+	deliveredMs, err := parseMessageTimestamp(lastDelivered)
+	if err != nil {
+		return protocol.ConsumerLag{}, fmt.Errorf("last delivered id: %w", err)
+	}
+	if newestMs > deliveredMs {
+		lag.Behind = time.Duration(newestMs-deliveredMs) * time.Millisecond
+	}
+
+	return lag, nil
+}
+
+func (s *Service) monitorLag(ctx context.Context) {
+	ticker := time.NewTicker(s.config.LagInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.refreshLag(ctx)
+		}
+	}
+}
+
+func (s *Service) refreshLag(ctx context.Context) {
+	lag, err := s.measureLag(ctx)
+	if err != nil {
+		logging.Errorf("failed to measure consumer lag: %v", err)
+		s.lag.Store(nil)
+
+		return
+	}
+
+	s.lag.Store(&lag)
+	consumerLagEntries.Set(float64(lag.Entries))
+	consumerPending.Set(float64(lag.Pending))
+	consumerLagSeconds.Set(lag.Behind.Seconds())
+
+	// published with a TTL so readers fall back to "unknown" once we stop measuring
+	if err = s.redisClient.Set(ctx, protocol.ConsumerLagKey, lag.Encode(), LagTTL).Err(); err != nil {
+		logging.Errorf("failed to publish consumer lag: %v", err)
+	}
+}
+
+// CheckLag is a readiness check that fails while the consumer group is further
+// behind the stream than the configured limits.
+func (s *Service) CheckLag(_ context.Context) error {
+	lag := s.lag.Load()
+	if lag == nil {
+		return nil
+	}
+
+	if lag.Behind > s.config.MaxReadyLag {
+		return fmt.Errorf("%w: %s behind", ErrConsumerLagging, lag.Behind)
+	}
+	if lag.Entries > s.config.MaxReadyEntries {
+		return fmt.Errorf("%w: %d entries behind", ErrConsumerLagging, lag.Entries)
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package grid
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+type lagRedis struct {
+	RedisClient
+	groups []interface{}
+	newest []redis.XMessage
+}
+
+func (m *lagRedis) Do(ctx context.Context, args ...interface{}) *redis.Cmd {
+	return redis.NewCmdResult(m.groups, nil)
+}
+
+func (m *lagRedis) XRevRangeN(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd {
+	return redis.NewXMessageSliceCmdResult(m.newest, nil)
+}
+
+func TestMeasureLag(t *testing.T) {
+	rc := &lagRedis{
+		groups: []interface{}{
+			[]interface{}{"name", "other-group", "pending", int64(99), "last-delivered-id", "0-0"},
+			[]interface{}{
+				"name", ConsumerGroup,
+				"consumers", int64(2),
+				"pending", int64(7),
+				"last-delivered-id", "1700000000000-0",
+				"entries-read", int64(100),
+				"lag", int64(42),
+			},
+		},
+		newest: []redis.XMessage{{ID: "1700000004500-3"}},
+	}
+	s := &Service{redisClient: rc, config: Config{MaxReadyLag: 3 * time.Second, MaxReadyEntries: 1000}}
+
+	lag, err := s.measureLag(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), lag.Entries)
+	assert.Equal(t, int64(7), lag.Pending)
+	assert.Equal(t, 4500*time.Millisecond, lag.Behind)
+
+	assert.NoError(t, s.CheckLag(context.Background()), "no measurement yet")
+	s.lag.Store(&lag)
+	assert.ErrorIs(t, s.CheckLag(context.Background()), ErrConsumerLagging)
+}
+
+func TestMeasureLagMissingGroup(t *testing.T) {
+	s := &Service{redisClient: &lagRedis{groups: []interface{}{}}}
+
+	_, err := s.measureLag(context.Background())
+	assert.Error(t, err)
+}
+
+func TestMeasureLagNewGroup(t *testing.T) {
+	rc := &lagRedis{
+		groups: []interface{}{
+			[]interface{}{"name", ConsumerGroup, "pending", int64(0), "last-delivered-id", "0-0", "lag", int64(3)},
+		},
+		newest: []redis.XMessage{{ID: "1700000004500-3"}},
+	}
+	s := &Service{redisClient: rc}
+
+	lag, err := s.measureLag(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), lag.Entries)
+	assert.Zero(t, lag.Behind, "not behind since the epoch")
+}
@@ -17,9 +17,12 @@ func Run() {
 	server := web.NewServer(
 		web.WithContext(ctx),
 		web.WithRedis(redis),
-		web.WithGinEngine(func(r *gin.Engine) {}),
+		web.WithGinEngine(func(r *gin.Engine) {
+			r.GET("/api/grid/export", s.handleExport)
+		}),
 		web.WithBackgroundWorker(s.Start),
 	)
+	server.RegisterHealthCheck(s.CheckLag)
 
 	server.Run()
 }
@@ -0,0 +1,54 @@
+package grid
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	messagesProcessed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "grid_messages_processed_total",
+		Help: "Stream messages applied to the grid and acknowledged.",
+	})
+
+	messagesDuplicate = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "grid_messages_duplicate_total",
+		Help: "Stream messages skipped because they were already processed.",
+	})
+
+	messagesRetried = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "grid_messages_retried_total",
+		Help: "Stream message processing attempts that were retried.",
+	})
+
+	messagesFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "grid_messages_failed_total",
+		Help: "Stream messages that failed after all retries.",
+	})
+
+	messagesInvalid = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "grid_messages_invalid_total",
+		Help: "Stream messages acknowledged without applying them because they were malformed.",
+	})
+
+	applyDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "grid_apply_duration_seconds",
+		Help:    "Time to apply a single update to the grid state.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 12),
+	})
+
+	consumerLagEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "grid_consumer_lag_entries",
+		Help: "Stream entries not yet delivered to the consumer group, -1 if unknown.",
+	})
+
+	consumerPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "grid_consumer_pending",
+		Help: "Stream entries delivered to the consumer group but not acknowledged.",
+	})
+
+	consumerLagSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "grid_consumer_lag_seconds",
+		Help: "Age gap between the newest stream entry and the last delivered one.",
+	})
+)
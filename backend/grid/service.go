@@ -7,19 +7,20 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"backend/internal/config"
 	"backend/internal/protocol"
 	"backend/logging"
 	"github.com/go-redis/redis/v8"
 )
 
 const (
-	StreamName         = "grid_updates"
+	StreamName         = protocol.UpdatesStream
 	BroadcastChannel   = "grid_updates_brd"
 	ConsumerGroup      = "grid-sync-consumer-group"
 	LatestEpochKey     = "latest_epoch"
-	UpdatesKeyPrefix   = "updates"
 	KeyEnvVar          = "REDIS_GRID_KEY"
 	PodNameEnvVar      = "POD_NAME"
 	MaxRetries         = 3
@@ -27,13 +28,17 @@ const (
 	ProcessingTimeout  = 5 * time.Second
 	MessageIDTTL       = 24 * time.Hour
 	BatchSize          = 50
-	Size               = 100
+	Size               = protocol.CanvasSize
 	MaxProcessingConns = 10
+	MaxColor           = protocol.MaxColor
+	LagInterval        = time.Second
+	LagTTL             = 10 * time.Second
+	MaxReadyLag        = 30 * time.Second
+	MaxReadyEntries    = 10_000
 )
 
 var (
 	ErrInvalidMessageFormat = errors.New("invalid message format")
-	ErrMessageTooShort      = errors.New("message too short")
 )
 
 type RedisClient interface {
@@ -41,12 +46,14 @@ type RedisClient interface {
 	XReadGroup(ctx context.Context, a *redis.XReadGroupArgs) *redis.XStreamSliceCmd
 	XAck(ctx context.Context, stream, group string, ids ...string) *redis.IntCmd
 	XGroupCreateMkStream(ctx context.Context, stream, group, start string) *redis.StatusCmd
-	Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd
 	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
-	ZAdd(ctx context.Context, key string, members ...*redis.Z) *redis.IntCmd
-	Exists(ctx context.Context, keys ...string) *redis.IntCmd
-	SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd
-	BitField(ctx context.Context, key string, args ...interface{}) *redis.IntSliceCmd
+	ZRangeByScore(ctx context.Context, key string, opt *redis.ZRangeBy) *redis.StringSliceCmd
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd
+	EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *redis.Cmd
+	ScriptExists(ctx context.Context, hashes ...string) *redis.BoolSliceCmd
+	ScriptLoad(ctx context.Context, script string) *redis.StringCmd
+	XRevRangeN(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd
+	Do(ctx context.Context, args ...interface{}) *redis.Cmd
 }
 
 type Service struct {
@@ -54,27 +61,37 @@ type Service struct {
 	config      Config
 	ctx         context.Context
 	msgChan     chan redis.XMessage
+	lag         atomic.Pointer[protocol.ConsumerLag]
+	latestEpoch atomic.Int64
 }
 
 type Config struct {
-	GridKey   string
-	PodName   string
-	GridSize  uint16
-	BatchSize int
+	GridKey         string
+	PodName         string
+	GridSize        uint16
+	BatchSize       int
+	LagInterval     time.Duration
+	MaxReadyLag     time.Duration
+	MaxReadyEntries int64
+	Epochs          protocol.Epochs
 }
 
 func NewGridService(rc RedisClient) *Service {
-	config := Config{
-		GridKey:   os.Getenv(KeyEnvVar),
-		PodName:   os.Getenv(PodNameEnvVar),
-		GridSize:  Size,
-		BatchSize: BatchSize,
+	cfg := Config{
+		GridKey:         os.Getenv(KeyEnvVar),
+		PodName:         os.Getenv(PodNameEnvVar),
+		GridSize:        Size,
+		BatchSize:       BatchSize,
+		LagInterval:     config.Duration("GRID_LAG_INTERVAL", LagInterval),
+		MaxReadyLag:     config.Duration("GRID_MAX_READY_LAG", MaxReadyLag),
+		MaxReadyEntries: int64(config.Int("GRID_MAX_READY_ENTRIES", MaxReadyEntries)),
+		Epochs:          protocol.NewEpochs(config.Duration(protocol.BucketLengthEnvVar, protocol.DefaultBucketLength)),
 	}
 
 	service := &Service{
 		ctx:         context.Background(),
 		redisClient: rc,
-		config:      config,
+		config:      cfg,
 		msgChan:     make(chan redis.XMessage, 1000),
 	}
 
@@ -100,6 +117,7 @@ func (s *Service) Start(ctx context.Context) {
 	}
 
 	go s.consumeStream()
+	go s.monitorLag(ctx)
 
 	<-ctx.Done()
 	logging.Infof("shutting down grid service")
@@ -155,6 +173,7 @@ func (s *Service) readStreamBatch() {
 func (s *Service) processMessages() {
 	for msg := range s.msgChan {
 		if err := s.processMessageWithRetry(msg); err != nil {
+			messagesFailed.Inc()
 			logging.Errorf("failed to process message %s after retries: %v", msg.ID, err)
 		}
 	}
@@ -166,8 +185,12 @@ func (s *Service) processMessageWithRetry(msg redis.XMessage) error {
 		if err == nil {
 			return nil
 		}
+		if errors.Is(err, ErrInvalidMessageFormat) {
+			return s.dropMessage(msg, err)
+		}
 
 		if attempt < MaxRetries {
+			messagesRetried.Inc()
 			logging.Warnf("retrying  %d message %s processing. err: %v", attempt, msg.ID, err)
 			time.Sleep(BaseRetryDelay * time.Duration(attempt))
 		}
@@ -176,63 +199,105 @@ func (s *Service) processMessageWithRetry(msg redis.XMessage) error {
 	return fmt.Errorf("max retries exceeded for message %s", msg.ID)
 }
 
-func (s *Service) processMessage(msg redis.XMessage) error {
-	processedKey := "processed:" + msg.ID
-	exists, err := s.redisClient.Exists(s.ctx, processedKey).Result()
+// dropMessage acknowledges a message that can never be applied, so it is
+// neither retried nor left pending.
+func (s *Service) dropMessage(msg redis.XMessage, reason error) error {
+	messagesInvalid.Inc()
+	logging.Errorf("dropping invalid message %s: %v", msg.ID, reason)
+
+	return s.ackMessage(msg.ID)
+}
 
+func (s *Service) processMessage(msg redis.XMessage) error {
+	start := time.Now()
+	seq, err := s.handleMessage(msg)
 	if err != nil {
-		return fmt.Errorf("deduplication check failed: %w", err)
+		return fmt.Errorf("message handling failed: %w", err)
 	}
 
-	if exists > 0 {
+	if seq == 0 {
 		logging.Debugf("skipping duplicate message %s", msg.ID)
-
-		return s.ackMessage(msg.ID)
+		messagesDuplicate.Inc()
+	} else {
+		applyDuration.Observe(time.Since(start).Seconds())
 	}
 
-	if err = s.handleMessage(msg); err != nil {
-		return fmt.Errorf("message handling failed: %w", err)
+	if err = s.ackMessage(msg.ID); err != nil {
+		return err
 	}
-
-	if err = s.redisClient.SetNX(s.ctx, processedKey, 1, MessageIDTTL).Err(); err != nil {
-		return fmt.Errorf("failed to mark message as processed: %w", err)
+	if seq != 0 {
+		messagesProcessed.Inc()
 	}
 
-	return s.ackMessage(msg.ID)
+	return nil
 }
 
-func (s *Service) handleMessage(msg redis.XMessage) error {
-	messageValue, ok := msg.Values["values"].(string)
-	if !ok {
-		return fmt.Errorf("%w: missing values field", ErrInvalidMessageFormat)
+// handleMessage applies a stream message and returns the sequence number of
+// its last cell, or 0 if it was a duplicate.
+func (s *Service) handleMessage(msg redis.XMessage) (uint64, error) {
+	timestamp, err := parseMessageTimestamp(msg.ID)
+	if err != nil {
+		return 0, fmt.Errorf("timestamp parsing failed: %w", err)
 	}
 
-	if len(messageValue) < 8 {
-		return fmt.Errorf("%w: expected at least 8 bytes", ErrMessageTooShort)
+	cells, err := decodeMessage(msg, timestamp)
+	if err != nil {
+		return 0, err
 	}
 
-	timestamp, err := parseMessageTimestamp(msg.ID)
-	if err != nil {
-		return fmt.Errorf("timestamp parsing failed: %w", err)
+	for i := range cells {
+		if err = s.validateCell(&cells[i]); err != nil {
+			return 0, err
+		}
 	}
 
-	updateTime := time.Now().UnixMilli()
-	updateEpoch := updateTime / 60_000
+	// bucket by placement time so late deliveries stay with their neighbours
+	updateEpoch := s.config.Epochs.Of(timestamp)
 
-	if err = s.storeUpdate(updateEpoch, messageValue, timestamp); err != nil {
-		return fmt.Errorf("store update failed: %w", err)
+	seq, err := s.applyCells(s.ctx, msg.ID, updateEpoch, timestamp, cells)
+	if err != nil {
+		return 0, err
 	}
 
 	if err = s.updateLatestEpoch(updateEpoch); err != nil {
-		return fmt.Errorf("epoch update failed: %w", err)
+		return 0, fmt.Errorf("epoch update failed: %w", err)
+	}
+
+	return seq, nil
+}
+
+// decodeMessage reads either a single cell or a batch from a stream entry.
+// Legacy cells get their wrapped timestamp restored from the entry ID.
+func decodeMessage(msg redis.XMessage, timestamp int64) ([]protocol.Cell, error) {
+	if batch, ok := msg.Values[protocol.BatchField].(string); ok {
+		cells, err := protocol.DecodeBatch([]byte(batch))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidMessageFormat, err)
+		}
+
+		return cells, nil
+	}
+
+	messageValue, ok := msg.Values[protocol.CellField].(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing values field", ErrInvalidMessageFormat)
+	}
+
+	cell, err := protocol.Decode([]byte(messageValue))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMessageFormat, err)
 	}
 
-	if err = s.updateGridStatus(messageValue); err != nil {
-		return fmt.Errorf("grid status update failed: %w", err)
+	if version, _ := protocol.Version([]byte(messageValue)); version == protocol.VersionLegacy {
+		cell.Time = protocol.UnwrapLegacyTime(cell.Time, timestamp)
 	}
 
-	if err = s.broadcastUpdate(messageValue); err != nil {
-		return fmt.Errorf("broadcast failed: %w", err)
+	return []protocol.Cell{*cell}, nil
+}
+
+func (s *Service) validateCell(cell *protocol.Cell) error {
+	if cell.X >= s.config.GridSize || cell.Y >= s.config.GridSize || cell.Color > MaxColor {
+		return fmt.Errorf("%w: cell %d,%d color %d outside the canvas", ErrInvalidMessageFormat, cell.X, cell.Y, cell.Color)
 	}
 
 	return nil
@@ -244,25 +309,20 @@ func parseMessageTimestamp(id string) (int64, error) {
 	return strconv.ParseInt(timestampStr, 10, 64)
 }
 
-func (s *Service) storeUpdate(epoch int64, value string, timestamp int64) error {
-	key := fmt.Sprintf("%s:%s:%d", s.config.GridKey, UpdatesKeyPrefix, epoch)
-
-	return s.redisClient.ZAdd(s.ctx, key, &redis.Z{
-		Score:  float64(timestamp),
-		Member: value,
-	}).Err()
-}
-
+// updateLatestEpoch only moves the marker forward; a late message belongs to
+// an older bucket and must not rewind it.
 func (s *Service) updateLatestEpoch(epoch int64) error {
-	return s.redisClient.Set(s.ctx, LatestEpochKey, epoch, 0).Err()
-}
-
-func (s *Service) updateGridStatus(value string) error {
-	cell := protocol.Decode([8]byte([]byte(value)))
-	offset := calculateOffset(cell.Y, cell.X, s.config.GridSize)
-	_, err := s.redisClient.BitField(s.ctx, s.config.GridKey, "SET", "u4", offset, cell.Color).Result()
+	for {
+		latest := s.latestEpoch.Load()
+		if epoch <= latest {
+			return nil
+		}
+		if s.latestEpoch.CompareAndSwap(latest, epoch) {
+			break
+		}
+	}
 
-	return err
+	return s.redisClient.Set(s.ctx, LatestEpochKey, epoch, 0).Err()
 }
 
 func calculateOffset(y, x, gridSize uint16) int64 {
@@ -275,10 +335,6 @@ func calculateOffset(y, x, gridSize uint16) int64 {
 	return int64(byteIndex*8 + 4)
 }
 
-func (s *Service) broadcastUpdate(value string) error {
-	return s.redisClient.Publish(s.ctx, BroadcastChannel, value).Err()
-}
-
 func (s *Service) ackMessage(msgID string) error {
 	return s.redisClient.XAck(s.ctx, StreamName, ConsumerGroup, msgID).Err()
 }
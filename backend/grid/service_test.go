@@ -0,0 +1,83 @@
+package grid
+
+import (
+	"context"
+	"testing"
+
+	"backend/internal/protocol"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	const placed = int64(1760788800000) // 2025-10-18, long past the legacy wrap
+
+	single := protocol.Cell{X: 10, Y: 20, Color: 3, Time: placed}
+	legacy := single.EncodeLegacy()
+	batch := []protocol.Cell{single, {X: 11, Y: 20, Color: 3, Time: placed}}
+
+	tests := []struct {
+		name     string
+		values   map[string]interface{}
+		expected []protocol.Cell
+		wantErr  bool
+	}{
+		{
+			name:     "Current version cell",
+			values:   map[string]interface{}{protocol.CellField: string(single.Encode())},
+			expected: []protocol.Cell{single},
+		},
+		{
+			name:     "Legacy cell gets its time unwrapped",
+			values:   map[string]interface{}{protocol.CellField: string(legacy[:])},
+			expected: []protocol.Cell{single},
+		},
+		{
+			name:     "Batch",
+			values:   map[string]interface{}{protocol.BatchField: string(protocol.EncodeBatch(batch))},
+			expected: batch,
+		},
+		{name: "Missing field", values: map[string]interface{}{}, wantErr: true},
+		{name: "Malformed cell", values: map[string]interface{}{protocol.CellField: "abc"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cells, err := decodeMessage(redis.XMessage{ID: "1760788800000-0", Values: tt.values}, placed)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidMessageFormat)
+
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, cells)
+		})
+	}
+}
+
+func TestValidateCell(t *testing.T) {
+	s := &Service{config: Config{GridSize: Size}}
+
+	assert.NoError(t, s.validateCell(&protocol.Cell{X: Size - 1, Y: Size - 1, Color: MaxColor}))
+	assert.ErrorIs(t, s.validateCell(&protocol.Cell{X: Size}), ErrInvalidMessageFormat)
+	assert.ErrorIs(t, s.validateCell(&protocol.Cell{Color: MaxColor + 1}), ErrInvalidMessageFormat)
+}
+
+type ackRedis struct {
+	RedisClient
+	acked []string
+}
+
+func (m *ackRedis) XAck(ctx context.Context, stream, group string, ids ...string) *redis.IntCmd {
+	m.acked = append(m.acked, ids...)
+	return redis.NewIntResult(int64(len(ids)), nil)
+}
+
+func TestInvalidMessagesAreAckedWithoutRetry(t *testing.T) {
+	rc := &ackRedis{}
+	s := &Service{ctx: context.Background(), redisClient: rc, config: Config{GridSize: Size}}
+
+	msg := redis.XMessage{ID: "1700000000000-0", Values: map[string]interface{}{"other": "x"}}
+	assert.NoError(t, s.processMessageWithRetry(msg))
+	assert.Equal(t, []string{msg.ID}, rc.acked)
+}
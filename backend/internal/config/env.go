@@ -0,0 +1,67 @@
+// Package config reads service settings from the environment, falling back to
+// defaults when a variable is unset or malformed.
+package config
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"backend/logging"
+)
+
+func String(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok && v != "" {
+		return v
+	}
+
+	return def
+}
+
+func Int(name string, def int) int {
+	v, ok := os.LookupEnv(name)
+	if !ok || v == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		logging.Warnf("invalid %s=%q, using default %d", name, v, def)
+
+		return def
+	}
+
+	return n
+}
+
+func Duration(name string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(name)
+	if !ok || v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		logging.Warnf("invalid %s=%q, using default %s", name, v, def)
+
+		return def
+	}
+
+	return d
+}
+
+func Bool(name string, def bool) bool {
+	v, ok := os.LookupEnv(name)
+	if !ok || v == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		logging.Warnf("invalid %s=%q, using default %t", name, v, def)
+
+		return def
+	}
+
+	return b
+}
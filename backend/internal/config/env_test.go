@@ -0,0 +1,44 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInt(t *testing.T) {
+	t.Setenv("CFG_INT", "42")
+	assert.Equal(t, 42, Int("CFG_INT", 1))
+
+	t.Setenv("CFG_INT", "nope")
+	assert.Equal(t, 1, Int("CFG_INT", 1))
+
+	assert.Equal(t, 7, Int("CFG_INT_UNSET", 7))
+}
+
+func TestDuration(t *testing.T) {
+	t.Setenv("CFG_DURATION", "1500ms")
+	assert.Equal(t, 1500*time.Millisecond, Duration("CFG_DURATION", time.Second))
+
+	t.Setenv("CFG_DURATION", "10")
+	assert.Equal(t, time.Second, Duration("CFG_DURATION", time.Second))
+}
+
+func TestString(t *testing.T) {
+	t.Setenv("CFG_STRING", "")
+	assert.Equal(t, "def", String("CFG_STRING", "def"))
+
+	t.Setenv("CFG_STRING", "set")
+	assert.Equal(t, "set", String("CFG_STRING", "def"))
+}
+
+func TestBool(t *testing.T) {
+	t.Setenv("CFG_BOOL", "false")
+	assert.False(t, Bool("CFG_BOOL", true))
+
+	t.Setenv("CFG_BOOL", "maybe")
+	assert.True(t, Bool("CFG_BOOL", true))
+
+	assert.True(t, Bool("CFG_BOOL_UNSET", true))
+}
@@ -0,0 +1,181 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	BatchVersion1 uint8 = 1
+
+	// MaxBatchCells bounds how many cells DecodeBatch will expand, so a small
+	// run-length encoded payload cannot allocate unbounded memory.
+	MaxBatchCells = 1 << 20
+
+	batchFlagRunLength uint8 = 1 << 0
+	batchHeaderSize          = 2
+)
+
+var ErrMalformedBatch = errors.New("malformed batch")
+
+// BatchEncoder packs many cells into one payload. Each cell is stored as
+// zigzag varint deltas of its coordinates and time against the previous cell,
+// so a burst of nearby placements costs a few bytes per cell instead of
+// Version1Size. With RunLength set, horizontally adjacent cells sharing a
+// color and time collapse into a single record.
+//
+// Layout: [version][flags][uvarint count][varint base time offset] then per
+// record [uvarint run length, if flagged][varint dx][varint dy][color][varint dt].
+type BatchEncoder struct {
+	RunLength bool
+}
+
+// EncodeBatch encodes cells in order with run-length encoding enabled.
+func EncodeBatch(cells []Cell) []byte {
+	return BatchEncoder{RunLength: true}.Encode(cells)
+}
+
+func (e BatchEncoder) Encode(cells []Cell) []byte {
+	var flags uint8
+	if e.RunLength {
+		flags |= batchFlagRunLength
+	}
+
+	buf := make([]byte, 0, batchHeaderSize+2*binary.MaxVarintLen64+len(cells)*5)
+	buf = append(buf, BatchVersion1, flags)
+	buf = binary.AppendUvarint(buf, uint64(len(cells)))
+
+	var base int64
+	if len(cells) > 0 {
+		base = cells[0].Time
+	}
+	buf = binary.AppendVarint(buf, base-referenceTime)
+
+	prev := Cell{Time: base}
+	for i := 0; i < len(cells); {
+		cell := cells[i]
+		run := 1
+		if e.RunLength {
+			for i+run < len(cells) && continuesRun(cells[i+run-1], cells[i+run]) {
+				run++
+			}
+			buf = binary.AppendUvarint(buf, uint64(run))
+		}
+
+		buf = binary.AppendVarint(buf, int64(cell.X)-int64(prev.X))
+		buf = binary.AppendVarint(buf, int64(cell.Y)-int64(prev.Y))
+		buf = append(buf, cell.Color)
+		buf = binary.AppendVarint(buf, cell.Time-prev.Time)
+
+		prev = cells[i+run-1]
+		i += run
+	}
+
+	return buf
+}
+
+func continuesRun(prev, next Cell) bool {
+	return next.Y == prev.Y && next.X == prev.X+1 && next.Color == prev.Color && next.Time == prev.Time
+}
+
+// DecodeBatch reverses BatchEncoder.Encode.
+func DecodeBatch(data []byte) ([]Cell, error) {
+	if len(data) < batchHeaderSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMalformedBatch, len(data))
+	}
+	if data[0] != BatchVersion1 {
+		return nil, fmt.Errorf("%w: batch version %d", ErrUnknownVersion, data[0])
+	}
+	runLength := data[1]&batchFlagRunLength != 0
+	r := batchReader{data: data[batchHeaderSize:]}
+
+	count := r.uvarint()
+	base := r.varint()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if count > MaxBatchCells {
+		return nil, fmt.Errorf("%w: %d cells exceeds limit", ErrMalformedBatch, count)
+	}
+
+	cells := make([]Cell, 0, min(count, uint64(len(r.data))))
+	prev := Cell{Time: referenceTime + base}
+	for uint64(len(cells)) < count {
+		run := uint64(1)
+		if runLength {
+			run = r.uvarint()
+		}
+		x := int64(prev.X) + r.varint()
+		y := int64(prev.Y) + r.varint()
+		color := r.byte()
+		t := prev.Time + r.varint()
+		if r.err != nil {
+			return nil, r.err
+		}
+		if run == 0 || run > count-uint64(len(cells)) || x < 0 || y < 0 || x+int64(run)-1 > 0xFFFF || y > 0xFFFF {
+			return nil, fmt.Errorf("%w: record out of range", ErrMalformedBatch)
+		}
+
+		for i := int64(0); i < int64(run); i++ {
+			cells = append(cells, Cell{X: uint16(x + i), Y: uint16(y), Color: color, Time: t})
+		}
+		prev = cells[len(cells)-1]
+	}
+
+	if len(r.data) != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrMalformedBatch, len(r.data))
+	}
+
+	return cells, nil
+}
+
+type batchReader struct {
+	data []byte
+	err  error
+}
+
+func (r *batchReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = fmt.Errorf("%w: bad uvarint", ErrMalformedBatch)
+
+		return 0
+	}
+	r.data = r.data[n:]
+
+	return v
+}
+
+func (r *batchReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = fmt.Errorf("%w: bad varint", ErrMalformedBatch)
+
+		return 0
+	}
+	r.data = r.data[n:]
+
+	return v
+}
+
+func (r *batchReader) byte() uint8 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) == 0 {
+		r.err = fmt.Errorf("%w: truncated", ErrMalformedBatch)
+
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+
+	return b
+}
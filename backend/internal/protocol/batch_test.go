@@ -0,0 +1,200 @@
+package protocol
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestBatchRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	base := int64(referenceTime + 86400000)
+	tests := []struct {
+		name  string
+		cells []Cell
+	}{
+		{name: "Empty", cells: []Cell{}},
+		{name: "Single", cells: []Cell{{X: 12345, Y: 9321, Color: 7, Time: base}}},
+		{
+			name: "Scattered",
+			cells: []Cell{
+				{X: 10, Y: 10, Color: 1, Time: base},
+				{X: 0, Y: 65535, Color: 255, Time: base + 5},
+				{X: 65535, Y: 0, Color: 0, Time: base - 1000},
+			},
+		},
+		{
+			name: "Adjacent run",
+			cells: []Cell{
+				{X: 3, Y: 4, Color: 2, Time: base},
+				{X: 4, Y: 4, Color: 2, Time: base},
+				{X: 5, Y: 4, Color: 2, Time: base},
+				{X: 6, Y: 4, Color: 3, Time: base},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, enc := range []BatchEncoder{{RunLength: true}, {RunLength: false}} {
+			t.Run(tt.name, func(t *testing.T) {
+				t.Parallel()
+
+				decoded, err := DecodeBatch(enc.Encode(tt.cells))
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !reflect.DeepEqual(tt.cells, decoded) {
+					t.Errorf("want %v, got %v", tt.cells, decoded)
+				}
+			})
+		}
+	}
+}
+
+func TestBatchRunLengthCollapsesRows(t *testing.T) {
+	t.Parallel()
+
+	row := make([]Cell, 100)
+	for i := range row {
+		row[i] = Cell{X: uint16(i), Y: 7, Color: 4, Time: referenceTime + 1000}
+	}
+
+	plain := BatchEncoder{}.Encode(row)
+	compact := EncodeBatch(row)
+
+	if len(compact) >= 16 {
+		t.Errorf("expected a 100-cell row to collapse into one record, got %d bytes", len(compact))
+	}
+	if len(compact) >= len(plain) {
+		t.Errorf("run-length encoding should be smaller: %d >= %d", len(compact), len(plain))
+	}
+}
+
+func TestDecodeBatchErrors(t *testing.T) {
+	t.Parallel()
+
+	valid := EncodeBatch([]Cell{{X: 1, Y: 1, Color: 1, Time: referenceTime}})
+	tests := []struct {
+		name  string
+		input []byte
+		err   error
+	}{
+		{name: "Empty", input: nil, err: ErrMalformedBatch},
+		{name: "Unknown version", input: []byte{0x09, 0x00, 0x00, 0x00}, err: ErrUnknownVersion},
+		{name: "Truncated", input: valid[:len(valid)-2], err: ErrMalformedBatch},
+		{name: "Trailing bytes", input: append(append([]byte{}, valid...), 0x00), err: ErrMalformedBatch},
+		{name: "Run past count", input: []byte{BatchVersion1, batchFlagRunLength, 0x01, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00}, err: ErrMalformedBatch},
+		{name: "Too many cells", input: []byte{BatchVersion1, 0x00, 0x80, 0x80, 0x80, 0x80, 0x01, 0x00}, err: ErrMalformedBatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := DecodeBatch(tt.input); !errors.Is(err, tt.err) {
+				t.Errorf("want %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func FuzzDecodeBatch(f *testing.F) {
+	f.Add(EncodeBatch([]Cell{{X: 3, Y: 4, Color: 2, Time: referenceTime}, {X: 4, Y: 4, Color: 2, Time: referenceTime}}))
+	f.Add(BatchEncoder{}.Encode([]Cell{{X: 65535, Y: 1, Color: 9, Time: referenceTime + 1}}))
+	f.Add([]byte{BatchVersion1, 0x00})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cells, err := DecodeBatch(data)
+		if err != nil {
+			return
+		}
+
+		again, err := DecodeBatch(EncodeBatch(cells))
+		if err != nil {
+			t.Fatalf("re-encoding a decoded batch failed: %v", err)
+		}
+		if !reflect.DeepEqual(cells, again) {
+			t.Errorf("want %v, got %v", cells, again)
+		}
+	})
+}
+
+// burst simulates a minute of placements: mostly scattered, a few drawn lines.
+func burst(n int) []Cell {
+	rng := rand.New(rand.NewSource(1))
+	cells := make([]Cell, 0, n)
+	t := int64(referenceTime + 86400000)
+	for len(cells) < n {
+		t += int64(rng.Intn(50))
+		if rng.Intn(10) == 0 {
+			x, y, color := uint16(rng.Intn(900)), uint16(rng.Intn(1000)), uint8(rng.Intn(16))
+			for i := 0; i < 20 && len(cells) < n; i++ {
+				cells = append(cells, Cell{X: x + uint16(i), Y: y, Color: color, Time: t})
+			}
+
+			continue
+		}
+		cells = append(cells, Cell{X: uint16(rng.Intn(1000)), Y: uint16(rng.Intn(1000)), Color: uint8(rng.Intn(16)), Time: t})
+	}
+
+	return cells
+}
+
+func concat(cells []Cell) []byte {
+	out := make([]byte, 0, len(cells)*Version1Size)
+	for i := range cells {
+		out = append(out, cells[i].Encode()...)
+	}
+
+	return out
+}
+
+func BenchmarkEncodeConcat(b *testing.B) {
+	cells := burst(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var out []byte
+	for i := 0; i < b.N; i++ {
+		out = concat(cells)
+	}
+	b.ReportMetric(float64(len(out))/float64(len(cells)), "bytes/cell")
+}
+
+func BenchmarkEncodeBatch(b *testing.B) {
+	cells := burst(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var out []byte
+	for i := 0; i < b.N; i++ {
+		out = EncodeBatch(cells)
+	}
+	b.ReportMetric(float64(len(out))/float64(len(cells)), "bytes/cell")
+}
+
+func BenchmarkDecodeConcat(b *testing.B) {
+	data := concat(burst(1000))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		cells := make([]Cell, 0, len(data)/Version1Size)
+		for off := 0; off < len(data); off += Version1Size {
+			cell, _ := Decode(data[off : off+Version1Size])
+			cells = append(cells, *cell)
+		}
+	}
+}
+
+func BenchmarkDecodeBatch(b *testing.B) {
+	data := EncodeBatch(burst(1000))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, _ = DecodeBatch(data)
+	}
+}
@@ -0,0 +1,39 @@
+package protocol
+
+// CanvasSize is the width and height of the canvas in cells.
+const CanvasSize = 100
+
+// MaxColor is the highest color a cell can hold; colors are stored as u4.
+const MaxColor = 0x0F
+
+// ColorAt reads the color of cell x, y from a canvas bitfield of the given
+// width. Cells are stored as u4 in row-major order, the even cell of each pair
+// in the upper nibble. Redis drops trailing zero bytes, so cells past the end
+// of state are 0.
+func ColorAt(state []byte, width, x, y uint16) uint8 {
+	index := int(y)*int(width) + int(x)
+	if index/2 >= len(state) {
+		return 0
+	}
+
+	if index%2 == 0 {
+		return state[index/2] >> 4
+	}
+
+	return state[index/2] & 0x0F
+}
+
+// SetColorAt writes the color of cell x, y into a canvas bitfield of the given
+// width, laid out as for ColorAt. Cells past the end of state are ignored.
+func SetColorAt(state []byte, width, x, y uint16, color uint8) {
+	index := int(y)*int(width) + int(x)
+	if index/2 >= len(state) {
+		return
+	}
+
+	if index%2 == 0 {
+		state[index/2] = state[index/2]&0x0F | color<<4
+	} else {
+		state[index/2] = state[index/2]&0xF0 | color&0x0F
+	}
+}
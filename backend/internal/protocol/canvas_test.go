@@ -0,0 +1,29 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestColorAt(t *testing.T) {
+	// a 4x2 canvas: row 0 is 1 2 3 4, row 1 is 5 6 and then truncated
+	state := []byte{0x12, 0x34, 0x56}
+
+	assert.Equal(t, uint8(1), ColorAt(state, 4, 0, 0))
+	assert.Equal(t, uint8(2), ColorAt(state, 4, 1, 0))
+	assert.Equal(t, uint8(4), ColorAt(state, 4, 3, 0))
+	assert.Equal(t, uint8(6), ColorAt(state, 4, 1, 1))
+	assert.Equal(t, uint8(0), ColorAt(state, 4, 2, 1))
+}
+
+func TestSetColorAt(t *testing.T) {
+	state := []byte{0x12, 0x34, 0x56, 0x00}
+
+	SetColorAt(state, 4, 0, 0, 9)
+	SetColorAt(state, 4, 3, 0, 7)
+	SetColorAt(state, 4, 2, 1, 15)
+	SetColorAt(state, 4, 3, 3, 1)
+
+	assert.Equal(t, []byte{0x92, 0x37, 0x56, 0xF0}, state)
+}
@@ -2,17 +2,56 @@ package protocol
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 )
 
 const referenceTime = 1704067200000
 
+const (
+	// VersionLegacy is the original unversioned 8-byte layout: 14-bit
+	// coordinates, a 4-bit color and a uint32 millisecond offset that wraps
+	// every ~49.7 days.
+	VersionLegacy uint8 = 0
+	// Version1 prefixes a version byte and carries full 16-bit coordinates, an
+	// 8-bit color and a 48-bit millisecond offset from referenceTime.
+	Version1 uint8 = 1
+
+	CurrentVersion = Version1
+
+	LegacySize   = 8
+	Version1Size = 12
+
+	maxTimeOffset = 1<<48 - 1
+	legacyWrap    = 1 << 32
+)
+
+var (
+	ErrMalformedCell  = errors.New("malformed cell")
+	ErrUnknownVersion = errors.New("unknown cell version")
+)
+
 type Cell struct {
 	X, Y  uint16
 	Color uint8
 	Time  int64
 }
 
-func (c *Cell) Encode() [8]byte {
+// Encode serialises the cell in the CurrentVersion layout.
+func (c *Cell) Encode() []byte {
+	encoded := make([]byte, Version1Size)
+	encoded[0] = Version1
+	binary.BigEndian.PutUint16(encoded[1:3], c.X)
+	binary.BigEndian.PutUint16(encoded[3:5], c.Y)
+	encoded[5] = c.Color
+	putUint48(encoded[6:], uint64(clampTimeOffset(c.Time-referenceTime)))
+
+	return encoded
+}
+
+// EncodeLegacy serialises the cell in the VersionLegacy layout, truncating
+// anything that does not fit.
+func (c *Cell) EncodeLegacy() [8]byte {
 	var encoded [8]byte
 	combinedX := c.X | uint16(c.Color&0b1100)<<12
 	binary.BigEndian.PutUint16(encoded[0:2], combinedX)
@@ -24,7 +63,48 @@ func (c *Cell) Encode() [8]byte {
 	return encoded
 }
 
-func Decode(encoded [8]byte) *Cell {
+// Version detects the layout of an encoded cell. Legacy cells carry no version
+// byte and are recognised by their size alone.
+func Version(encoded []byte) (uint8, error) {
+	switch {
+	case len(encoded) == LegacySize:
+		return VersionLegacy, nil
+	case len(encoded) == 0:
+		return 0, fmt.Errorf("%w: empty", ErrMalformedCell)
+	case encoded[0] == Version1:
+		if len(encoded) != Version1Size {
+			return 0, fmt.Errorf("%w: version %d is %d bytes, got %d", ErrMalformedCell, Version1, Version1Size, len(encoded))
+		}
+
+		return Version1, nil
+	default:
+		return 0, fmt.Errorf("%w: %d", ErrUnknownVersion, encoded[0])
+	}
+}
+
+// Decode parses a cell in any supported layout.
+func Decode(encoded []byte) (*Cell, error) {
+	version, err := Version(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	if version == VersionLegacy {
+		return DecodeLegacy([8]byte(encoded)), nil
+	}
+
+	return &Cell{
+		X:     binary.BigEndian.Uint16(encoded[1:3]),
+		Y:     binary.BigEndian.Uint16(encoded[3:5]),
+		Color: encoded[5],
+		Time:  referenceTime + int64(uint48(encoded[6:])),
+	}, nil
+}
+
+// DecodeLegacy parses the VersionLegacy layout. The returned time has wrapped
+// for anything encoded more than ~49.7 days after referenceTime; see
+// UnwrapLegacyTime.
+func DecodeLegacy(encoded [8]byte) *Cell {
 	combinedX := binary.BigEndian.Uint16(encoded[0:2])
 	x := combinedX & 0x3FFF
 	color := uint8((combinedX >> 12) & 0b1100)
@@ -43,3 +123,33 @@ func Decode(encoded [8]byte) *Cell {
 		Time:  time,
 	}
 }
+
+// UnwrapLegacyTime recovers the real time of a legacy cell by picking the
+// wrap-around closest to near, a time known to be within ~24 days of it (the
+// stream entry ID or the time it was received).
+func UnwrapLegacyTime(decoded, near int64) int64 {
+	offset := (decoded - referenceTime) % legacyWrap
+	wraps := (near - referenceTime - offset + legacyWrap/2) / legacyWrap
+	if wraps < 0 {
+		wraps = 0
+	}
+
+	return referenceTime + offset + wraps*legacyWrap
+}
+
+func clampTimeOffset(offset int64) int64 {
+	return min(max(offset, 0), maxTimeOffset)
+}
+
+func putUint48(b []byte, v uint64) {
+	_ = b[5]
+	b[0] = byte(v >> 40)
+	b[1] = byte(v >> 32)
+	binary.BigEndian.PutUint32(b[2:], uint32(v))
+}
+
+func uint48(b []byte) uint64 {
+	_ = b[5]
+
+	return uint64(b[0])<<40 | uint64(b[1])<<32 | uint64(binary.BigEndian.Uint32(b[2:]))
+}
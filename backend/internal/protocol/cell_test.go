@@ -1,12 +1,14 @@
 package protocol
 
 import (
+	"bytes"
+	"errors"
 	"math"
-	"reflect"
 	"testing"
+	"time"
 )
 
-func TestEncode(t *testing.T) {
+func TestEncodeLegacy(t *testing.T) {
 	t.Parallel()
 
 	tests := []struct {
@@ -45,7 +47,7 @@ func TestEncode(t *testing.T) {
 				Color: tt.color,
 				Time:  tt.time,
 			}
-			result := cell.Encode()
+			result := cell.EncodeLegacy()
 
 			if result != tt.expected {
 				t.Errorf("Expected %v, got %v", tt.expected, result)
@@ -54,7 +56,7 @@ func TestEncode(t *testing.T) {
 	}
 }
 
-func TestDecode(t *testing.T) {
+func TestDecodeLegacy(t *testing.T) {
 	t.Parallel()
 
 	tests := []struct {
@@ -95,15 +97,106 @@ func TestDecode(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
 
-			cell := Decode(tt.input)
+			cell := DecodeLegacy(tt.input)
 
 			if cell.X != tt.x || cell.Y != tt.y || cell.Color != tt.color || cell.Time != tt.time {
 				t.Errorf("want %v, got %v", tt, cell)
 			}
+
+			detected, err := Decode(tt.input[:])
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if *detected != *cell {
+				t.Errorf("auto-detected decode: want %v, got %v", cell, detected)
+			}
 		})
 	}
 }
 
+func TestEncode(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		cell     Cell
+		expected []byte
+	}{
+		{
+			name:     "Basic encoding",
+			cell:     Cell{X: 1000, Y: 2000, Color: 10, Time: referenceTime + 3600000},
+			expected: []byte{Version1, 0x03, 0xE8, 0x07, 0xD0, 0x0A, 0x00, 0x00, 0x00, 0x36, 0xEE, 0x80},
+		},
+		{
+			name:     "Max coordinates and color",
+			cell:     Cell{X: math.MaxUint16, Y: math.MaxUint16, Color: math.MaxUint8, Time: referenceTime},
+			expected: []byte{Version1, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		},
+		{
+			name:     "Past the legacy wrap-around",
+			cell:     Cell{X: 1, Y: 1, Color: 1, Time: referenceTime + math.MaxUint32 + 1},
+			expected: []byte{Version1, 0x00, 0x01, 0x00, 0x01, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00},
+		},
+		{
+			name:     "Time before reference is clamped",
+			cell:     Cell{Time: referenceTime - 1},
+			expected: []byte{Version1, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if result := tt.cell.Encode(); !bytes.Equal(result, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		input []byte
+		err   error
+	}{
+		{name: "Empty", input: nil, err: ErrMalformedCell},
+		{name: "Truncated version 1", input: []byte{Version1, 0x00, 0x01}, err: ErrMalformedCell},
+		{name: "Unknown version", input: []byte{0x7F, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, err: ErrUnknownVersion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := Decode(tt.input); !errors.Is(err, tt.err) {
+				t.Errorf("want %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestUnwrapLegacyTime(t *testing.T) {
+	t.Parallel()
+
+	placed := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC).UnixMilli()
+	cell := Cell{X: 5, Y: 6, Color: 7, Time: placed}
+	decoded := DecodeLegacy(cell.EncodeLegacy())
+
+	if decoded.Time == placed {
+		t.Fatal("expected the legacy encoding to wrap")
+	}
+
+	for _, near := range []int64{placed, placed + 10*24*3600*1000, placed - 10*24*3600*1000} {
+		if got := UnwrapLegacyTime(decoded.Time, near); got != placed {
+			t.Errorf("near %d: want %d, got %d", near, placed, got)
+		}
+	}
+}
+
 func TestEncodeDecode(t *testing.T) {
 	t.Parallel()
 	cell := Cell{
@@ -113,14 +206,60 @@ func TestEncodeDecode(t *testing.T) {
 		Time:  int64(referenceTime + 86400000),
 	}
 
-	encoded := cell.Encode()
-	cellDecoded := Decode(encoded)
+	cellDecoded, err := Decode(cell.Encode())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
 
-	if reflect.DeepEqual(cell, cellDecoded) {
+	if cell != *cellDecoded {
 		t.Errorf("want %v, got %v", cell, cellDecoded)
 	}
 }
 
+func FuzzEncodeDecode(f *testing.F) {
+	f.Add(uint16(0), uint16(0), uint8(0), int64(0))
+	f.Add(uint16(12345), uint16(9321), uint8(7), int64(86400000))
+	f.Add(uint16(math.MaxUint16), uint16(math.MaxUint16), uint8(math.MaxUint8), int64(maxTimeOffset))
+
+	f.Fuzz(func(t *testing.T, x, y uint16, color uint8, offset int64) {
+		cell := Cell{X: x, Y: y, Color: color, Time: referenceTime + clampTimeOffset(offset)}
+
+		decoded, err := Decode(cell.Encode())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cell != *decoded {
+			t.Errorf("want %v, got %v", cell, decoded)
+		}
+	})
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add([]byte{0x30, 0x39, 0xD4, 0x31, 0x00, 0x51, 0x61, 0x80})
+	f.Add([]byte{Version1, 0x03, 0xE8, 0x07, 0xD0, 0x0A, 0x00, 0x00, 0x00, 0x36, 0xEE, 0x80})
+	f.Add([]byte{Version1})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cell, err := Decode(data)
+		if err != nil {
+			return
+		}
+
+		version, _ := Version(data)
+		if version == VersionLegacy {
+			if reencoded := cell.EncodeLegacy(); !bytes.Equal(reencoded[:], data) {
+				t.Errorf("legacy round trip: want %v, got %v", data, reencoded)
+			}
+
+			return
+		}
+		if reencoded := cell.Encode(); !bytes.Equal(reencoded, data) {
+			t.Errorf("round trip: want %v, got %v", data, reencoded)
+		}
+	})
+}
+
 func BenchmarkEncode(b *testing.B) {
 	cell := Cell{
 		X:     uint16(12345),
@@ -137,12 +276,22 @@ func BenchmarkEncode(b *testing.B) {
 }
 
 func BenchmarkDecode(b *testing.B) {
+	encoded := []byte{Version1, 0x30, 0x39, 0x24, 0x69, 0x07, 0x00, 0x00, 0x05, 0x26, 0x5C, 0x00}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, _ = Decode(encoded)
+	}
+}
+
+func BenchmarkDecodeLegacy(b *testing.B) {
 	encoded := [8]byte{0x30, 0x39, 0xD4, 0x31, 0x00, 0x51, 0x61, 0x80}
 
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		Decode(encoded)
+		DecodeLegacy(encoded)
 	}
 }
 
@@ -158,7 +307,6 @@ func BenchmarkEncodeDecode(b *testing.B) {
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		encoded := cell.Encode()
-		Decode(encoded)
+		_, _ = Decode(cell.Encode())
 	}
 }
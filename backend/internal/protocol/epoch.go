@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// DefaultBucketLength is how much event time one updates bucket covers.
+	DefaultBucketLength = time.Minute
+	// BucketLengthEnvVar overrides DefaultBucketLength; every service reading or
+	// writing buckets must agree on it.
+	BucketLengthEnvVar = "UPDATES_BUCKET_LENGTH"
+
+	updatesKeyPrefix = "updates"
+)
+
+// Epochs splits event time into fixed-length buckets. Updates are stored and
+// cached per bucket, keyed by the time the pixel was placed rather than the
+// time it was processed, so a late message still lands next to its neighbours.
+type Epochs struct {
+	length int64 // milliseconds
+}
+
+func NewEpochs(length time.Duration) Epochs {
+	if length < time.Millisecond {
+		length = DefaultBucketLength
+	}
+
+	return Epochs{length: length.Milliseconds()}
+}
+
+func (e Epochs) Length() time.Duration {
+	return time.Duration(e.length) * time.Millisecond
+}
+
+// Of returns the bucket holding an event at unix time ms.
+func (e Epochs) Of(ms int64) int64 {
+	if ms < 0 {
+		return (ms - e.length + 1) / e.length
+	}
+
+	return ms / e.length
+}
+
+func (e Epochs) Current() int64 {
+	return e.Of(time.Now().UnixMilli())
+}
+
+// Start returns the first unix millisecond covered by epoch.
+func (e Epochs) Start(epoch int64) int64 {
+	return epoch * e.length
+}
+
+// Span lists, in order, every bucket that overlaps the interval [fromMs, toMs].
+func (e Epochs) Span(fromMs, toMs int64) []int64 {
+	if toMs < fromMs {
+		return nil
+	}
+
+	first, last := e.Of(fromMs), e.Of(toMs)
+	epochs := make([]int64, 0, last-first+1)
+	for epoch := first; epoch <= last; epoch++ {
+		epochs = append(epochs, epoch)
+	}
+
+	return epochs
+}
+
+// UpdatesKey is the Redis sorted set holding the updates of one bucket.
+func UpdatesKey(gridKey string, epoch int64) string {
+	return fmt.Sprintf("%s:%s:%d", gridKey, updatesKeyPrefix, epoch)
+}
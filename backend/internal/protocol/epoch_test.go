@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEpochsOf(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		length   time.Duration
+		ms       int64
+		expected int64
+	}{
+		{name: "start of bucket", length: time.Minute, ms: 120_000, expected: 2},
+		{name: "end of bucket", length: time.Minute, ms: 179_999, expected: 2},
+		{name: "custom length", length: 10 * time.Second, ms: 25_000, expected: 2},
+		{name: "before unix epoch", length: time.Minute, ms: -1, expected: -1},
+		{name: "invalid length falls back to default", length: 0, ms: 60_000, expected: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := NewEpochs(tt.length).Of(tt.ms); got != tt.expected {
+				t.Errorf("want %d, got %d", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestEpochsSpan(t *testing.T) {
+	t.Parallel()
+
+	e := NewEpochs(time.Minute)
+
+	if got := e.Span(61_000, 119_000); !reflect.DeepEqual(got, []int64{1}) {
+		t.Errorf("single bucket: got %v", got)
+	}
+	if got := e.Span(110_000, 130_000); !reflect.DeepEqual(got, []int64{1, 2}) {
+		t.Errorf("straddling a boundary: got %v", got)
+	}
+	if got := e.Span(130_000, 110_000); got != nil {
+		t.Errorf("inverted interval: got %v", got)
+	}
+	if e.Start(2) != 120_000 {
+		t.Errorf("want bucket 2 to start at 120000, got %d", e.Start(2))
+	}
+}
+
+func TestUpdatesKey(t *testing.T) {
+	t.Parallel()
+
+	if got := UpdatesKey("grid", 28_000_000); got != "grid:updates:28000000" {
+		t.Errorf("unexpected key %q", got)
+	}
+}
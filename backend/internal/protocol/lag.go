@@ -0,0 +1,38 @@
+package protocol
+
+import (
+	"fmt"
+	"time"
+)
+
+// ConsumerLagKey holds the grid service's latest measurement of how far its
+// consumer group is behind the update stream.
+const ConsumerLagKey = "grid_consumer_lag"
+
+// UnknownEntries marks a lag measurement from a Redis server that does not
+// report the number of undelivered entries (before Redis 7).
+const UnknownEntries = -1
+
+type ConsumerLag struct {
+	// Entries is the number of stream entries not yet delivered to the group.
+	Entries int64
+	// Pending is the number of delivered entries that are not acknowledged yet.
+	Pending int64
+	// Behind is the age gap between the newest entry and the last delivered one.
+	Behind time.Duration
+}
+
+func (l ConsumerLag) Encode() string {
+	return fmt.Sprintf("%d:%d:%d", l.Entries, l.Pending, l.Behind.Milliseconds())
+}
+
+func DecodeConsumerLag(s string) (ConsumerLag, error) {
+	var l ConsumerLag
+	var behindMs int64
+	if _, err := fmt.Sscanf(s, "%d:%d:%d", &l.Entries, &l.Pending, &behindMs); err != nil {
+		return ConsumerLag{}, fmt.Errorf("malformed consumer lag %q: %w", s, err)
+	}
+	l.Behind = time.Duration(behindMs) * time.Millisecond
+
+	return l, nil
+}
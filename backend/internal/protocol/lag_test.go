@@ -0,0 +1,28 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConsumerLagRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	lag := ConsumerLag{Entries: 1200, Pending: 35, Behind: 4250 * time.Millisecond}
+
+	decoded, err := DecodeConsumerLag(lag.Encode())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if decoded != lag {
+		t.Errorf("want %v, got %v", lag, decoded)
+	}
+}
+
+func TestDecodeConsumerLagMalformed(t *testing.T) {
+	t.Parallel()
+
+	if _, err := DecodeConsumerLag("12:abc"); err == nil {
+		t.Error("expected an error for malformed input")
+	}
+}
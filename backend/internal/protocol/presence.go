@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// ViewersKey is a hash of the connections each ws pod reports, keyed by
+	// pod, each a ViewerCount.
+	ViewersKey = "ws_viewers"
+	// PlacersKey is a sorted set of who placed pixels recently, scored by the
+	// unix millisecond time of their latest placement.
+	PlacersKey = "active_placers"
+	// PlacerWindow is how recently someone must have placed to count as active.
+	PlacerWindow = time.Minute
+)
+
+// ViewerCount is one pod's connection count and when it was reported, so a
+// pod that died without cleaning up stops being counted.
+type ViewerCount struct {
+	Conns      int64
+	ReportedAt time.Time
+}
+
+func (v ViewerCount) Encode() string {
+	return fmt.Sprintf("%d:%d", v.Conns, v.ReportedAt.UnixMilli())
+}
+
+func DecodeViewerCount(s string) (ViewerCount, error) {
+	var v ViewerCount
+	var reportedAt int64
+	if _, err := fmt.Sscanf(s, "%d:%d", &v.Conns, &reportedAt); err != nil {
+		return ViewerCount{}, fmt.Errorf("malformed viewer count %q: %w", s, err)
+	}
+	v.ReportedAt = time.UnixMilli(reportedAt)
+
+	return v, nil
+}
@@ -0,0 +1,28 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestViewerCountRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	count := ViewerCount{Conns: 4200, ReportedAt: time.UnixMilli(1760788800123)}
+
+	decoded, err := DecodeViewerCount(count.Encode())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !decoded.ReportedAt.Equal(count.ReportedAt) || decoded.Conns != count.Conns {
+		t.Errorf("want %v, got %v", count, decoded)
+	}
+}
+
+func TestDecodeViewerCountMalformed(t *testing.T) {
+	t.Parallel()
+
+	if _, err := DecodeViewerCount("12"); err == nil {
+		t.Error("expected an error for malformed input")
+	}
+}
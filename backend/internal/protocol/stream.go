@@ -0,0 +1,11 @@
+package protocol
+
+const (
+	// UpdatesStream is the Redis stream draw appends placements to and the
+	// grid service consumes.
+	UpdatesStream = "grid_updates"
+	// CellField holds a single encoded Cell in an UpdatesStream entry.
+	CellField = "values"
+	// BatchField holds an EncodeBatch payload in an UpdatesStream entry.
+	BatchField = "batch"
+)
@@ -0,0 +1,60 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// SeqSize is the width of the big-endian sequence number prefixed to every
+// applied update.
+const SeqSize = 8
+
+// Update is a cell as applied to a canvas, tagged with the per-canvas sequence
+// number the grid service assigned to it. Sequence numbers increase by one per
+// applied cell, so a reader that sees a jump knows it missed updates.
+type Update struct {
+	Seq  uint64
+	Cell Cell
+}
+
+func (u *Update) Encode() []byte {
+	return AppendSeq(make([]byte, 0, SeqSize+Version1Size), u.Seq, u.Cell.Encode())
+}
+
+// AppendSeq appends seq followed by payload to dst.
+func AppendSeq(dst []byte, seq uint64, payload []byte) []byte {
+	dst = binary.BigEndian.AppendUint64(dst, seq)
+
+	return append(dst, payload...)
+}
+
+// DecodeUpdate parses a sequenced update. Bare cells stored before sequence
+// numbers existed are accepted too and come back with Seq 0.
+func DecodeUpdate(encoded []byte) (*Update, error) {
+	if _, err := Version(encoded); err == nil && len(encoded) < SeqSize+LegacySize {
+		cell, err := Decode(encoded)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Update{Cell: *cell}, nil
+	}
+
+	if len(encoded) < SeqSize {
+		return nil, fmt.Errorf("%w: update is %d bytes", ErrMalformedCell, len(encoded))
+	}
+
+	cell, err := Decode(encoded[SeqSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Update{Seq: binary.BigEndian.Uint64(encoded[:SeqSize]), Cell: *cell}, nil
+}
+
+// SeqKey holds the sequence number of the last update applied to the canvas
+// stored at gridKey. It is written in the same transaction as the canvas, so
+// reading both together gives a snapshot tagged with the update it reflects.
+func SeqKey(gridKey string) string {
+	return gridKey + ":seq"
+}
@@ -0,0 +1,52 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUpdateRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	update := Update{Seq: 1<<40 + 7, Cell: Cell{X: 10, Y: 20, Color: 3, Time: referenceTime + 1000}}
+	encoded := update.Encode()
+
+	if len(encoded) != SeqSize+Version1Size {
+		t.Fatalf("unexpected size %d", len(encoded))
+	}
+
+	decoded, err := DecodeUpdate(encoded)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *decoded != update {
+		t.Errorf("want %v, got %v", update, decoded)
+	}
+}
+
+func TestDecodeUpdateBareCells(t *testing.T) {
+	t.Parallel()
+
+	cell := Cell{X: 10, Y: 20, Color: 3, Time: referenceTime + 1000}
+	legacy := cell.EncodeLegacy()
+
+	for name, encoded := range map[string][]byte{"legacy": legacy[:], "version 1": cell.Encode()} {
+		decoded, err := DecodeUpdate(encoded)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if decoded.Seq != 0 || decoded.Cell != cell {
+			t.Errorf("%s: want %v, got %v", name, cell, decoded)
+		}
+	}
+}
+
+func TestDecodeUpdateErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, encoded := range [][]byte{nil, {0, 0, 0, 1}, AppendSeq(nil, 1, []byte{0x7F, 1, 2})} {
+		if _, err := DecodeUpdate(encoded); !errors.Is(err, ErrMalformedCell) && !errors.Is(err, ErrUnknownVersion) {
+			t.Errorf("%v: expected a decoding error, got %v", encoded, err)
+		}
+	}
+}
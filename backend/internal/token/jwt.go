@@ -0,0 +1,80 @@
+// Package token signs and validates the JWTs the auth service issues, so
+// other services can check them without calling auth.
+package token
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// SecretEnvVar names the variable holding the HMAC secret tokens are signed with.
+const SecretEnvVar = "JWT_SECRET"
+
+// Expiration is how long a token is valid after it is issued.
+const Expiration = 1 * time.Hour
+
+// UserHeader carries the subject of a validated token to the services behind
+// the ingress forward-auth.
+const UserHeader = "X-Auth-User"
+
+var (
+	ErrNoSecret = errors.New(SecretEnvVar + " environment variable is not set")
+	ErrInvalid  = errors.New("invalid token")
+)
+
+type Claims = jwt.StandardClaims
+
+type Signer struct {
+	secret []byte
+}
+
+func New(secret []byte) *Signer {
+	return &Signer{secret: secret}
+}
+
+// FromEnv returns a Signer using the secret in SecretEnvVar.
+func FromEnv() (*Signer, error) {
+	secret := []byte(os.Getenv(SecretEnvVar))
+	if len(secret) == 0 {
+		return nil, ErrNoSecret
+	}
+
+	return New(secret), nil
+}
+
+func (s *Signer) Sign(sub, issuer string) (string, error) {
+	claims := jwt.StandardClaims{
+		ExpiresAt: time.Now().Add(Expiration).Unix(),
+		Subject:   sub,
+		Issuer:    issuer,
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(s.secret)
+}
+
+// Validate checks the signature and expiry of tokenString and returns its claims.
+func (s *Signer) Validate(tokenString string) (*Claims, error) {
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return s.secret, nil
+	}
+
+	token, err := jwt.ParseWithClaims(tokenString, &jwt.StandardClaims{}, keyFunc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if claims, ok := token.Claims.(*jwt.StandardClaims); ok && token.Valid {
+		return claims, nil
+	}
+
+	return nil, ErrInvalid
+}
@@ -0,0 +1,46 @@
+package token
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignAndValidate(t *testing.T) {
+	s := New([]byte("secret"))
+
+	signed, err := s.Sign("user", "google")
+	assert.NoError(t, err)
+
+	claims, err := s.Validate(signed)
+	assert.NoError(t, err)
+	assert.Equal(t, "user", claims.Subject)
+	assert.Equal(t, "google", claims.Issuer)
+	assert.InDelta(t, time.Now().Add(Expiration).Unix(), claims.ExpiresAt, 1)
+
+	_, err = New([]byte("other")).Validate(signed)
+	assert.Error(t, err)
+}
+
+func TestValidateRejectsExpired(t *testing.T) {
+	expired, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
+		ExpiresAt: time.Now().Add(-time.Minute).Unix(),
+		Subject:   "user",
+	}).SignedString([]byte("secret"))
+	assert.NoError(t, err)
+
+	_, err = New([]byte("secret")).Validate(expired)
+	assert.Error(t, err)
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv(SecretEnvVar, "")
+	_, err := FromEnv()
+	assert.ErrorIs(t, err, ErrNoSecret)
+
+	t.Setenv(SecretEnvVar, "secret")
+	_, err = FromEnv()
+	assert.NoError(t, err)
+}
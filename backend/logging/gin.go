@@ -1,6 +1,7 @@
 package logging
 
 import (
+	"net/url"
 	"slices"
 	"time"
 
@@ -10,6 +11,10 @@ import (
 
 var ingnoredLogPath = []string{"/healthz", "/probes", "/metrics"}
 
+// redactedQueryParams carry credentials, such as the token an EventSource
+// has to send in the URL, and are never logged.
+var redactedQueryParams = []string{"token"}
+
 func Ginrus() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		start := time.Now()
@@ -25,7 +30,7 @@ func Ginrus() gin.HandlerFunc {
 		fields := logrus.Fields{
 			"status":  c.Writer.Status(),
 			"method":  c.Request.Method,
-			"path":    c.Request.URL.String(),
+			"path":    redactURL(c.Request.URL),
 			"ip":      c.ClientIP(),
 			"latency": time.Since(start),
 		}
@@ -39,3 +44,23 @@ func Ginrus() gin.HandlerFunc {
 		}
 	}
 }
+
+// redactURL renders u with the values of redactedQueryParams masked.
+func redactURL(u *url.URL) string {
+	query := u.Query()
+	redacted := false
+	for _, param := range redactedQueryParams {
+		if query.Has(param) {
+			query.Set(param, "REDACTED")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u.String()
+	}
+
+	masked := *u
+	masked.RawQuery = query.Encode()
+
+	return masked.String()
+}
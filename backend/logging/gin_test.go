@@ -0,0 +1,21 @@
+package logging
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactURL(t *testing.T) {
+	for raw, expected := range map[string]string{
+		"/api/events?since=4":           "/api/events?since=4",
+		"/api/events?token=abc.def":     "/api/events?token=REDACTED",
+		"/api/events?since=4&token=abc": "/api/events?since=4&token=REDACTED",
+		"/ws":                           "/ws",
+	} {
+		u, err := url.Parse(raw)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, redactURL(u), raw)
+	}
+}
@@ -49,5 +49,5 @@ func Warnf(format string, v ...interface{}) {
 }
 
 func Fatalf(format string, v ...interface{}) {
-	logger.Fatalf(format, v)
+	logger.Fatalf(format, v...)
 }
@@ -0,0 +1,53 @@
+package web
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsPath    = "/metrics"
+	unmatchedRoute = "unmatched"
+)
+
+var (
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by route and status code.",
+	}, []string{"method", "route", "status"})
+)
+
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		// use the route template, not the raw path, to keep label cardinality bounded
+		route := c.FullPath()
+		if route == "" {
+			route = unmatchedRoute
+		}
+		if route == metricsPath {
+			return
+		}
+
+		status := strconv.Itoa(c.Writer.Status())
+		httpRequestDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+		httpRequestsTotal.WithLabelValues(c.Request.Method, route, status).Inc()
+	}
+}
+
+func (s *Server) registerMetricsEndpoint() {
+	s.router.GET(metricsPath, gin.WrapH(promhttp.Handler()))
+}
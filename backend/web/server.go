@@ -9,6 +9,8 @@ import (
 	"os"
 	"os/signal"
 	"runtime/debug"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -25,6 +27,11 @@ const (
 	defaultReadTimeout    = 10 * time.Second
 	defaultWriteTimeout   = 10 * time.Second
 	defaultIdleTimeout    = 30 * time.Second
+
+	// trustedProxiesEnvVar lists the CIDRs of the proxies in front of the
+	// service, comma separated. X-Forwarded-For is only believed from them;
+	// unset, the client IP is the address of the connection.
+	trustedProxiesEnvVar = "TRUSTED_PROXIES"
 )
 
 func NewDefaultConfig() ServerConfig {
@@ -48,6 +55,8 @@ type Server struct {
 	shutdownHooks  []io.Closer
 	startupHooks   []func(ctx context.Context)
 	healthChecks   []func(ctx context.Context) error
+	drainHooks     []func(ctx context.Context)
+	draining       atomic.Bool
 	config         ServerConfig
 }
 
@@ -98,14 +107,33 @@ func WithContext(ctx context.Context) ServerOption {
 func WithGinEngine(routerConfig func(r *gin.Engine)) ServerOption {
 	return func(s *Server) {
 		s.router = gin.Default()
+		trustProxies(s.router, os.Getenv(trustedProxiesEnvVar))
 		s.router.Use(
 			logging.Ginrus(),
+			metricsMiddleware(),
 			recoveryMiddleware(),
 		)
 		routerConfig(s.router)
 	}
 }
 
+// trustProxies makes ClientIP believe X-Forwarded-For only from the given
+// proxies. Gin trusts every proxy by default, which lets a client pick its own
+// IP by sending the header itself.
+func trustProxies(r *gin.Engine, cidrs string) {
+	var proxies []string
+	for _, cidr := range strings.Split(cidrs, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr != "" {
+			proxies = append(proxies, cidr)
+		}
+	}
+
+	if err := r.SetTrustedProxies(proxies); err != nil {
+		logging.Errorf("invalid %s=%q, trusting no proxies: %v", trustedProxiesEnvVar, cidrs, err)
+		_ = r.SetTrustedProxies(nil)
+	}
+}
+
 func WithKafkaConsumer(cfg kafka.ReaderConfig, handler func(k *kafka.Reader)) ServerOption {
 	return func(s *Server) {
 		reader := kafka.NewReader(cfg)
@@ -153,6 +181,13 @@ func (s *Server) RegisterHealthCheck(check func(ctx context.Context) error) {
 	s.healthChecks = append(s.healthChecks, check)
 }
 
+// RegisterDrainHook registers work to do once the server is asked to stop,
+// while background workers still run and before the shutdown hooks. The
+// server reports not ready from then on. A second signal cancels ctx.
+func (s *Server) RegisterDrainHook(hook func(ctx context.Context)) {
+	s.drainHooks = append(s.drainHooks, hook)
+}
+
 func (s *Server) Redis() redis.UniversalClient {
 	return s.redis
 }
@@ -167,17 +202,19 @@ func (s *Server) Run() {
 
 	if s.router != nil {
 		s.registerHealthEndpoints()
+		s.registerMetricsEndpoint()
 		go s.startHTTPServer()
 	}
 
 	<-quit
+	s.drain(quit)
 
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), s.config.ShutdownTimer)
 	defer shutdownCancel()
 
 	s.cancelFunc()
 
-	for i := len(s.shutdownHooks) - 1; i > 0; i-- {
+	for i := len(s.shutdownHooks) - 1; i >= 0; i-- {
 		if err := s.shutdownHooks[i].Close(); err != nil {
 			logging.Errorf("Shutdown hook error: %v", err)
 		}
@@ -192,6 +229,29 @@ func (s *Server) Run() {
 	}
 }
 
+func (s *Server) drain(quit <-chan os.Signal) {
+	s.draining.Store(true)
+	if len(s.drainHooks) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-quit:
+			logging.Warnf("Signalled again, cutting the drain short")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	logging.Infof("Draining before shutdown")
+	for _, hook := range s.drainHooks {
+		hook(ctx)
+	}
+}
+
 func (s *Server) startHTTPServer() {
 	srv := &http.Server{
 		Addr:           s.config.Address,
@@ -231,6 +291,10 @@ func (s *Server) registerHealthEndpoints() {
 }
 
 func (s *Server) isReady() bool {
+	if s.draining.Load() {
+		return false
+	}
+
 	for _, check := range s.healthChecks {
 		if err := check(s.ctx); err != nil {
 			log.Printf("Health check failed: %v", err)
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -18,12 +19,12 @@ import (
 )
 
 type MockCloser struct {
-	closeWasCalled bool
+	closeWasCalled atomic.Bool
 	shouldError    bool
 }
 
 func (m *MockCloser) Close() error {
-	m.closeWasCalled = true
+	m.closeWasCalled.Store(true)
 	if m.shouldError {
 		return fmt.Errorf("mock close error")
 	}
@@ -104,6 +105,37 @@ func TestNewServer(t *testing.T) {
 	})
 }
 
+func TestTrustProxies(t *testing.T) {
+	clientIP := func(r *gin.Engine, remoteAddr, forwardedFor string) string {
+		var ip string
+		r.GET("/ip", func(c *gin.Context) { ip = c.ClientIP() })
+		req := httptest.NewRequest("GET", "/ip", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+		return ip
+	}
+
+	t.Run("trusts no proxy by default", func(t *testing.T) {
+		r := gin.New()
+		trustProxies(r, "")
+		assert.Equal(t, "203.0.113.7", clientIP(r, "203.0.113.7:1234", "198.51.100.1"))
+	})
+
+	t.Run("skips only trusted proxies", func(t *testing.T) {
+		r := gin.New()
+		trustProxies(r, "10.42.0.0/16, 192.168.0.0/16")
+		assert.Equal(t, "198.51.100.1", clientIP(r, "10.42.0.5:1234", "1.2.3.4, 198.51.100.1"),
+			"the spoofed leftmost value is ignored")
+	})
+
+	t.Run("trusts no proxy when misconfigured", func(t *testing.T) {
+		r := gin.New()
+		trustProxies(r, "not-a-cidr")
+		assert.Equal(t, "10.42.0.5", clientIP(r, "10.42.0.5:1234", "198.51.100.1"))
+	})
+}
+
 func TestHealthEndpoints(t *testing.T) {
 	t.Run("healthz returns 200", func(t *testing.T) {
 		s := NewServer(WithGinEngine(func(r *gin.Engine) {}))
@@ -152,6 +184,30 @@ func TestHealthEndpoints(t *testing.T) {
 	})
 }
 
+func TestMetricsEndpoint(t *testing.T) {
+	t.Run("exposes http metrics labelled by route", func(t *testing.T) {
+		s := NewServer(WithGinEngine(func(r *gin.Engine) {
+			r.GET("/items/:id", func(c *gin.Context) {
+				c.Status(http.StatusNoContent)
+			})
+		}))
+		s.registerMetricsEndpoint()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/items/42", nil)
+		s.router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/metrics", nil)
+		s.router.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), `http_request_duration_seconds_count{method="GET",route="/items/:id",status="204"}`)
+		assert.NotContains(t, w.Body.String(), `route="/metrics"`)
+	})
+}
+
 func TestServerShutdown(t *testing.T) {
 	t.Run("closes all resources on shutdown", func(t *testing.T) {
 		mock1 := &MockCloser{}
@@ -176,8 +232,8 @@ func TestServerShutdown(t *testing.T) {
 		// Give it a moment to shut down
 		time.Sleep(100 * time.Millisecond)
 
-		assert.True(t, mock1.closeWasCalled)
-		assert.True(t, mock2.closeWasCalled)
+		assert.True(t, mock1.closeWasCalled.Load())
+		assert.True(t, mock2.closeWasCalled.Load())
 	})
 
 	t.Run("handles close errors gracefully", func(t *testing.T) {
@@ -196,8 +252,72 @@ func TestServerShutdown(t *testing.T) {
 		_ = p.Signal(syscall.SIGTERM)
 		time.Sleep(100 * time.Millisecond)
 
-		assert.True(t, mock.closeWasCalled)
+		assert.True(t, mock.closeWasCalled.Load())
+	})
+
+	t.Run("drains before closing, reporting not ready", func(t *testing.T) {
+		mock := &MockCloser{}
+		var readyWhileDraining, workersRunning, closedWhileDraining bool
+
+		s := NewServer()
+		s.RegisterShutdownHook(mock)
+		s.RegisterDrainHook(func(ctx context.Context) {
+			readyWhileDraining = s.isReady()
+			workersRunning = s.ctx.Err() == nil
+			closedWhileDraining = mock.closeWasCalled.Load()
+		})
+
+		done := runServer(s)
+		terminate()
+		<-done
+
+		assert.False(t, readyWhileDraining)
+		assert.True(t, workersRunning)
+		assert.False(t, closedWhileDraining)
+		assert.True(t, mock.closeWasCalled.Load())
 	})
+
+	t.Run("second signal cuts the drain short", func(t *testing.T) {
+		mock := &MockCloser{}
+		draining := make(chan struct{})
+
+		s := NewServer()
+		s.RegisterShutdownHook(mock)
+		s.RegisterDrainHook(func(ctx context.Context) {
+			close(draining)
+			<-ctx.Done()
+		})
+
+		done := runServer(s)
+		terminate()
+		<-draining
+		assert.False(t, mock.closeWasCalled.Load(), "still draining")
+
+		terminate()
+		<-done
+		assert.True(t, mock.closeWasCalled.Load())
+	})
+}
+
+// runServer runs s until it is signalled and returns once it is listening for
+// signals, with a channel closed when it has shut down.
+func runServer(s *Server) <-chan struct{} {
+	listening := make(chan struct{})
+	s.startupHooks = append(s.startupHooks, func(context.Context) { close(listening) })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run()
+	}()
+	<-listening
+
+	return done
+}
+
+func terminate() {
+	p, _ := os.FindProcess(os.Getpid())
+	_ = p.Signal(syscall.SIGTERM)
 }
 
 func TestRedisIntegration(t *testing.T) {
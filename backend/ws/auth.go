@@ -0,0 +1,128 @@
+package ws
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"backend/internal/config"
+	"backend/internal/token"
+	"backend/logging"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// bearerSubprotocol is offered by browsers, which can't set headers on a
+	// websocket, followed by the token as a second subprotocol
+	bearerSubprotocol = "bearer"
+	tokenQueryParam   = "token"
+
+	// closeTokenExpired closes a session whose token ran out without a refresh
+	closeTokenExpired = 4001
+)
+
+var (
+	errMissingToken   = errors.New("missing token")
+	errSubjectChanged = errors.New("token is for another subject")
+
+	// authRequired makes clients present a token from the auth service; the
+	// subject is attached to the client and the session ends with the token
+	authRequired = config.Bool("WS_AUTH_REQUIRED", false)
+	tokens       *token.Signer
+)
+
+// tokenFrom reads the token of an upgrade request from the Authorization
+// header, the subprotocol after bearerSubprotocol, or ?token=, in that order.
+func tokenFrom(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+
+	protocols := websocket.Subprotocols(r)
+	for i, protocol := range protocols {
+		if protocol == bearerSubprotocol && i+1 < len(protocols) {
+			return protocols[i+1]
+		}
+	}
+
+	return r.URL.Query().Get(tokenQueryParam)
+}
+
+// authenticate validates the token of an upgrade request. It returns nil
+// claims when auth isn't required.
+func authenticate(r *http.Request) (*token.Claims, error) {
+	if !authRequired {
+		return nil, nil
+	}
+
+	raw := tokenFrom(r)
+	if raw == "" {
+		return nil, errMissingToken
+	}
+
+	return tokens.Validate(raw)
+}
+
+// refreshToken moves the end of a session to the expiry of a newer token for
+// the same subject.
+func (c *Clients) refreshToken(client *Client, raw []byte) error {
+	if !authRequired {
+		return nil
+	}
+
+	claims, err := tokens.Validate(string(raw))
+	if err != nil {
+		tokenRefreshes.WithLabelValues(refreshRejected).Inc()
+		return err
+	}
+	if claims.Subject != client.Subject {
+		tokenRefreshes.WithLabelValues(refreshRejected).Inc()
+		return errSubjectChanged
+	}
+
+	c.expireAt(client, time.Unix(claims.ExpiresAt, 0))
+	tokenRefreshes.WithLabelValues(refreshAccepted).Inc()
+
+	return nil
+}
+
+// expireAt closes client with closeTokenExpired at expiresAt unless a refresh
+// moves it.
+func (c *Clients) expireAt(client *Client, expiresAt time.Time) {
+	client.authMu.Lock()
+	defer client.authMu.Unlock()
+
+	client.expiresAt.Store(expiresAt.UnixNano())
+	if client.expiry == nil {
+		client.expiry = time.AfterFunc(time.Until(expiresAt), func() { c.expire(client) })
+		return
+	}
+	client.expiry.Reset(time.Until(expiresAt))
+}
+
+func (c *Clients) expire(client *Client) {
+	// a refresh may have raced the timer firing
+	if time.Now().UnixNano() < client.expiresAt.Load() {
+		return
+	}
+	select {
+	case <-client.closing:
+		return
+	default:
+	}
+
+	logging.Infof("token of client %d expired, closing", client.ID)
+	sessionsExpired.Inc()
+	client.closeWith(closeTokenExpired, "token expired")
+	c.remove(client)
+}
+
+func (c *Client) stopExpiry() {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	if c.expiry != nil {
+		c.expiry.Stop()
+	}
+}
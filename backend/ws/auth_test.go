@@ -0,0 +1,96 @@
+package ws
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"backend/internal/token"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func requireAuth(t *testing.T) {
+	required, signer := authRequired, tokens
+	authRequired, tokens = true, token.New([]byte("secret"))
+	t.Cleanup(func() { authRequired, tokens = required, signer })
+}
+
+func signedToken(t *testing.T, sub string, expiresAt time.Time) string {
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
+		ExpiresAt: expiresAt.Unix(),
+		Subject:   sub,
+	}).SignedString([]byte("secret"))
+	assert.NoError(t, err)
+
+	return signed
+}
+
+func TestTokenFrom(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "/ws?token=query", nil)
+	assert.Equal(t, "query", tokenFrom(req))
+
+	req.Header.Set("Sec-WebSocket-Protocol", "bearer, protocol")
+	assert.Equal(t, "protocol", tokenFrom(req))
+
+	req.Header.Set("Authorization", "Bearer header")
+	assert.Equal(t, "header", tokenFrom(req))
+}
+
+func TestAuthenticate(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "/ws", nil)
+	claims, err := authenticate(req)
+	assert.NoError(t, err, "anyone may connect unless auth is required")
+	assert.Nil(t, claims)
+
+	requireAuth(t)
+	_, err = authenticate(req)
+	assert.ErrorIs(t, err, errMissingToken)
+
+	req.Header.Set("Authorization", "Bearer "+signedToken(t, "user", time.Now().Add(-time.Minute)))
+	_, err = authenticate(req)
+	assert.Error(t, err, "expired tokens are refused")
+
+	req.Header.Set("Authorization", "Bearer "+signedToken(t, "user", time.Now().Add(time.Hour)))
+	claims, err = authenticate(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "user", claims.Subject)
+}
+
+func TestSessionExpiresWithoutRefresh(t *testing.T) {
+	requireAuth(t)
+	c := newClients(1, 1, policyDisconnect)
+	defer c.Close()
+
+	conn := newFakeConn()
+	client := c.register(conn, peer{Subject: "user"})
+	c.expireAt(client, time.Now().Add(20*time.Millisecond))
+
+	select {
+	case <-client.closing:
+	case <-time.After(time.Second):
+		t.Fatal("session outlived its token")
+	}
+	assert.EqualValues(t, closeTokenExpired, conn.closeCode.Load())
+}
+
+func TestRefreshTokenExtendsSession(t *testing.T) {
+	requireAuth(t)
+	c := newClients(1, 1, policyDisconnect)
+	defer c.Close()
+
+	conn := newFakeConn()
+	client := c.register(conn, peer{Subject: "user"})
+	c.expireAt(client, time.Now().Add(50*time.Millisecond))
+
+	assert.ErrorIs(t, c.refreshToken(client, []byte(signedToken(t, "other", time.Now().Add(time.Hour)))), errSubjectChanged)
+	assert.Error(t, c.refreshToken(client, []byte("garbage")))
+	assert.NoError(t, c.refreshToken(client, []byte(signedToken(t, "user", time.Now().Add(time.Hour)))))
+
+	select {
+	case <-client.closing:
+		t.Fatal("refreshed session was closed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Zero(t, conn.closeCode.Load())
+}
@@ -1,81 +1,147 @@
 package ws
 
 import (
-	"strconv"
-	"strings"
 	"sync"
-	"time"
+	"unsafe"
+
+	"backend/internal/protocol"
 )
 
+const defaultCacheBytes = 8 << 20
+
+// cacheSlotSize is what one cached update costs.
+const cacheSlotSize = int(unsafe.Sizeof(protocol.Update{}))
+
+// Cache holds the most recent updates this pod received, for catching up
+// clients after a snapshot and resuming sessions without going to Redis. It
+// is a ring of slots allocated once from a byte budget, and an update lives in
+// the slot its sequence number maps to, so finding where a range starts takes
+// no search and a newer update evicts the one that is a whole ring older.
 type Cache struct {
-	data            map[string][][]byte
-	mu              sync.RWMutex
-	done            chan struct{}
-	retentionPeriod int64
+	mu    sync.RWMutex
+	slots []protocol.Update
+	// latest is the highest sequence number added, zero while empty
+	latest uint64
 }
 
-func NewCache(retentionPeriod int64) *Cache {
-	c := &Cache{
-		data:            make(map[string][][]byte),
-		done:            make(chan struct{}),
-		retentionPeriod: retentionPeriod,
-	}
+func NewCache(budget int) *Cache {
+	c := &Cache{slots: make([]protocol.Update, max(budget/cacheSlotSize, 1))}
+	cacheCapacityBytes.Set(float64(len(c.slots) * cacheSlotSize))
 
 	return c
 }
 
-func (c *Cache) Update(key string, value []byte) {
+// Add caches an update. Updates without a sequence number can't be looked up
+// and are skipped.
+func (c *Cache) Add(update protocol.Update) {
+	if update.Seq == 0 {
+		return
+	}
+
 	c.mu.Lock()
-	c.data[key] = append(c.data[key], value)
-	c.mu.Unlock()
+	defer c.mu.Unlock()
+
+	if update.Seq+uint64(len(c.slots)) <= c.latest {
+		// far behind everything held: the canvas was reset
+		c.reset()
+	}
+
+	slot := &c.slots[update.Seq%uint64(len(c.slots))]
+	switch slot.Seq {
+	case 0:
+		cacheEntries.Inc()
+	case update.Seq:
+	default:
+		cacheEvictions.Inc()
+	}
+	*slot = update
+	c.latest = max(c.latest, update.Seq)
 }
 
-func (c *Cache) Get(key string) ([][]byte, bool) {
+// Backfill caches updates read from history, such as those this pod missed.
+// Unlike Add it never evicts newer updates, and skips what is too old for the
+// ring. It returns how many updates it cached.
+func (c *Cache) Backfill(updates []protocol.Update) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	added := 0
+	for _, update := range updates {
+		if update.Seq == 0 || update.Seq+uint64(len(c.slots)) <= c.latest {
+			continue
+		}
+
+		slot := &c.slots[update.Seq%uint64(len(c.slots))]
+		if slot.Seq >= update.Seq {
+			continue
+		}
+		if slot.Seq == 0 {
+			cacheEntries.Inc()
+		} else {
+			cacheEvictions.Inc()
+		}
+		*slot = update
+		c.latest = max(c.latest, update.Seq)
+		added++
+	}
+
+	return added
+}
+
+// Latest returns the highest sequence number cached, or zero if none is.
+func (c *Cache) Latest() uint64 {
 	c.mu.RLock()
-	value, exists := c.data[key]
-	c.mu.RUnlock()
-	return value, exists
+	defer c.mu.RUnlock()
+
+	return c.latest
 }
 
-func (c *Cache) runCleanup() {
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
+// LatestTime returns when the latest cached update was placed, or zero if
+// none is.
+func (c *Cache) LatestTime() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
-	for {
-		select {
-		case <-ticker.C:
-			c.cleanup()
-		case <-c.done:
-			return
-		}
+	update := c.slots[c.latest%uint64(len(c.slots))]
+	if c.latest == 0 || update.Seq != c.latest {
+		return 0
 	}
+
+	return update.Cell.Time
 }
 
-func (c *Cache) cleanup() {
-	currentEpoch := getCurrentEpoch()
-	threshold := currentEpoch - c.retentionPeriod
+func (c *Cache) reset() {
+	clear(c.slots)
+	c.latest = 0
+	cacheEntries.Set(0)
+}
 
+// After returns the updates with a sequence number above seq, in order. It
+// reports false if any of them up to the latest one received is missing,
+// whether evicted or never received.
+func (c *Cache) After(seq uint64) ([]protocol.Update, bool) {
 	c.mu.RLock()
-	keysToDelete := make([]string, 0)
-	for key := range c.data {
-		if epochStart := strings.LastIndex(key, ":"); epochStart != -1 {
-			if epoch, err := strconv.ParseInt(key[epochStart+1:], 10, 64); err == nil && epoch < threshold {
-				keysToDelete = append(keysToDelete, key)
-			}
-		}
+	defer c.mu.RUnlock()
+
+	if seq >= c.latest {
+		cacheLookups.WithLabelValues(cacheHit).Inc()
+		return nil, true
+	}
+	if c.latest-seq > uint64(len(c.slots)) {
+		cacheLookups.WithLabelValues(cacheMiss).Inc()
+		return nil, false
 	}
-	c.mu.RUnlock()
 
-	if len(keysToDelete) > 0 {
-		c.mu.Lock()
-		for _, key := range keysToDelete {
-			delete(c.data, key)
+	updates := make([]protocol.Update, 0, c.latest-seq)
+	for next := seq + 1; next <= c.latest; next++ {
+		update := c.slots[next%uint64(len(c.slots))]
+		if update.Seq != next {
+			cacheLookups.WithLabelValues(cacheMiss).Inc()
+			return nil, false
 		}
-		c.mu.Unlock()
+		updates = append(updates, update)
 	}
-}
+	cacheLookups.WithLabelValues(cacheHit).Inc()
 
-func (c *Cache) Close() error {
-	close(c.done)
-	return nil
+	return updates, true
 }
@@ -1,45 +1,98 @@
 package ws
 
 import (
-	"fmt"
-	"github.com/stretchr/testify/assert"
-	"strconv"
-	"strings"
 	"testing"
+
+	"backend/internal/protocol"
+	"github.com/stretchr/testify/assert"
 )
 
-func TestCacheCleanup(t *testing.T) {
-	c := NewCache(2) // 2 epoch retention
-	currentEpoch := getCurrentEpoch()
+func cachedUpdate(seq uint64) protocol.Update {
+	return protocol.Update{Seq: seq, Cell: protocol.Cell{X: uint16(seq), Y: 1, Color: 1, Time: 1760788800000 + int64(seq)}}
+}
+
+func TestCacheAfter(t *testing.T) {
+	c := NewCache(8 * cacheSlotSize)
+	for seq := uint64(1); seq <= 5; seq++ {
+		c.Add(cachedUpdate(seq))
+	}
+
+	updates, ok := c.After(2)
+	assert.True(t, ok)
+	assert.Equal(t, []protocol.Update{cachedUpdate(3), cachedUpdate(4), cachedUpdate(5)}, updates)
+
+	updates, ok = c.After(5)
+	assert.True(t, ok, "nothing newer has been received")
+	assert.Empty(t, updates)
+}
+
+func TestCacheEvictsOldestAtBudget(t *testing.T) {
+	c := NewCache(4 * cacheSlotSize)
+	for seq := uint64(1); seq <= 6; seq++ {
+		c.Add(cachedUpdate(seq))
+	}
+
+	_, ok := c.After(1)
+	assert.False(t, ok, "update 2 was evicted")
+	updates, ok := c.After(2)
+	assert.True(t, ok)
+	assert.Len(t, updates, 4)
+}
+
+func TestCacheReportsHoles(t *testing.T) {
+	c := NewCache(8 * cacheSlotSize)
+	c.Add(cachedUpdate(1))
+	c.Add(cachedUpdate(3))
 
-	// Setup test data
-	validKey := fmt.Sprintf("%s:updates:%d", gridKey, currentEpoch-1)
-	expiredKey := fmt.Sprintf("%s:updates:%d", gridKey, currentEpoch-3)
+	_, ok := c.After(1)
+	assert.False(t, ok, "this pod never received update 2")
+	updates, ok := c.After(2)
+	assert.True(t, ok)
+	assert.Equal(t, []protocol.Update{cachedUpdate(3)}, updates)
 
-	c.Update(validKey, []byte("valid"))
-	c.Update(expiredKey, []byte("expired"))
+	c.Add(protocol.Update{Cell: protocol.Cell{X: 1}})
+	updates, _ = c.After(2)
+	assert.Len(t, updates, 1, "updates without a sequence number aren't cached")
+}
+
+func TestCacheStartsOverWhenCanvasResets(t *testing.T) {
+	c := NewCache(4 * cacheSlotSize)
+	for seq := uint64(100); seq <= 103; seq++ {
+		c.Add(cachedUpdate(seq))
+	}
 
-	c.cleanup()
+	c.Add(cachedUpdate(1))
+	c.Add(cachedUpdate(2))
+
+	updates, ok := c.After(0)
+	assert.True(t, ok)
+	assert.Equal(t, []protocol.Update{cachedUpdate(1), cachedUpdate(2)}, updates)
+}
 
-	t.Run("Retains recent entries", func(t *testing.T) {
-		_, exists := c.Get(validKey)
-		assert.True(t, exists)
-	})
+func BenchmarkCacheAfter(b *testing.B) {
+	c := NewCache(defaultCacheBytes)
+	for seq := uint64(1); seq <= 100_000; seq++ {
+		c.Add(cachedUpdate(seq))
+	}
 
-	t.Run("Removes expired entries", func(t *testing.T) {
-		_, exists := c.Get(expiredKey)
-		assert.False(t, exists)
-	})
+	b.ResetTimer()
+	for range b.N {
+		if _, ok := c.After(99_900); !ok {
+			b.Fatal("missing updates")
+		}
+	}
 }
 
-func TestCacheKeyParsing(t *testing.T) {
-	key := "grid123:updates:1715616000000"
-	expectedEpoch := int64(1715616000000)
+func TestCacheBackfillKeepsNewerUpdates(t *testing.T) {
+	c := NewCache(4 * cacheSlotSize)
+	c.Add(cachedUpdate(9))
+	c.Add(cachedUpdate(7))
 
-	epochStart := strings.LastIndex(key, ":")
-	epochStr := key[epochStart+1:]
-	epoch, err := strconv.ParseInt(epochStr, 10, 64)
+	added := c.Backfill([]protocol.Update{cachedUpdate(3), cachedUpdate(5), cachedUpdate(6), cachedUpdate(8)})
+	assert.Equal(t, 2, added, "3 and 5 are too old for the ring")
 
-	assert.Nil(t, err)
-	assert.Equal(t, expectedEpoch, epoch)
+	updates, ok := c.After(5)
+	assert.True(t, ok)
+	assert.Equal(t, []protocol.Update{cachedUpdate(6), cachedUpdate(7), cachedUpdate(8), cachedUpdate(9)}, updates)
+	assert.Equal(t, uint64(9), c.Latest())
 }
@@ -0,0 +1,337 @@
+package ws
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"backend/internal/config"
+	"backend/logging"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// chatChannel carries chat and deletion frames to every pod
+	chatChannel = "grid_chat"
+	// chatHistoryKey is a list of the latest chat frames, newest first
+	chatHistoryKey = "chat_history"
+	chatSeqKey     = "chat_seq"
+	// chatBannedKey is a set of subjects that may not chat
+	chatBannedKey   = "chat_banned"
+	chatRatePrefix  = "chat_rate:"
+	chatQueryParam  = "chat"
+	maxChatText     = 280
+	chatHandleBytes = 4
+
+	// chatHandleKeyEnvVar keys the handles; every ws pod needs the same one
+	chatHandleKeyEnvVar = "WS_CHAT_HANDLE_KEY"
+
+	// chatTimeout bounds the Redis calls of one chat frame
+	chatTimeout = 2 * time.Second
+
+	defaultChatHistory    = 100
+	defaultChatRateLimit  = 5
+	defaultChatRateWindow = 10 * time.Second
+)
+
+// Why a chat message was refused, sent back to its author.
+const (
+	chatRejectedInvalid uint8 = iota + 1
+	chatRejectedRate
+	chatRejectedBanned
+	chatRejectedForbidden
+	chatRejectedUnavailable
+	chatRejectedAnonymous
+)
+
+var (
+	ErrMalformedChat = errors.New("malformed chat frame")
+	errChatRate      = errors.New("chat rate limit exceeded")
+	errChatBanned    = errors.New("subject is banned from chat")
+	errChatAnonymous = errors.New("chat needs an authenticated subject")
+	errNotModerator  = errors.New("subject is not a chat moderator")
+)
+
+// chatRoom relays chat over Redis. Messages are published to every pod and
+// kept in a bounded history that clients get when they connect. Authors are
+// shown by a handle derived from their subject, not the subject itself.
+type chatRoom struct {
+	rdb        redis.UniversalClient
+	hub        *Clients
+	history    int64
+	rateLimit  int64
+	rateWindow time.Duration
+	moderators []string
+	handleKey  []byte
+}
+
+// chat is nil unless WS_CHAT is on; its methods are no-ops then.
+var chat *chatRoom
+
+func newChatRoom(rdb redis.UniversalClient, hub *Clients) *chatRoom {
+	if !config.Bool("WS_CHAT", true) {
+		return nil
+	}
+
+	handleKey := []byte(os.Getenv(chatHandleKeyEnvVar))
+	if len(handleKey) == 0 {
+		logging.Warnf("%s is not set, chat handles differ between ws pods", chatHandleKeyEnvVar)
+		handleKey = make([]byte, 32)
+		_, _ = rand.Read(handleKey)
+	}
+
+	return &chatRoom{
+		rdb:        rdb,
+		hub:        hub,
+		history:    int64(config.Int("WS_CHAT_HISTORY", defaultChatHistory)),
+		rateLimit:  int64(config.Int("WS_CHAT_RATE_LIMIT", defaultChatRateLimit)),
+		rateWindow: config.Duration("WS_CHAT_RATE_WINDOW", defaultChatRateWindow),
+		moderators: strings.FieldsFunc(config.String("WS_CHAT_MODERATORS", ""), func(r rune) bool { return r == ',' }),
+		handleKey:  handleKey,
+	}
+}
+
+// wantsChat reads whether a client asked for chat with ?chat=1.
+func wantsChat(c *gin.Context) bool {
+	want, _ := strconv.ParseBool(c.Query(chatQueryParam))
+	return want
+}
+
+// handle is the name a speaker is shown by.
+func (r *chatRoom) handle(speaker string) string {
+	mac := hmac.New(sha256.New, r.handleKey)
+	mac.Write([]byte(speaker))
+
+	return "anon-" + hex.EncodeToString(mac.Sum(nil)[:chatHandleBytes])
+}
+
+// chatText validates the text of a chat message.
+func chatText(payload []byte) (string, error) {
+	text := strings.TrimSpace(string(payload))
+	if text == "" || len(text) > maxChatText || !utf8.ValidString(text) {
+		return "", ErrMalformedChat
+	}
+	if strings.ContainsFunc(text, unicode.IsControl) {
+		return "", ErrMalformedChat
+	}
+
+	return text, nil
+}
+
+// send posts a chat message from client, unless it has no token subject or
+// the subject is banned or over the rate limit. A refusal is reported back to the client.
+func (r *chatRoom) send(ctx context.Context, client *Client, payload []byte, now time.Time) error {
+	if r == nil {
+		return nil
+	}
+
+	err := r.post(ctx, client, payload, now)
+	if err != nil {
+		reason := chatRejectedUnavailable
+		switch {
+		case errors.Is(err, ErrMalformedChat):
+			reason = chatRejectedInvalid
+		case errors.Is(err, errChatRate):
+			reason = chatRejectedRate
+		case errors.Is(err, errChatBanned):
+			reason = chatRejectedBanned
+		case errors.Is(err, errChatAnonymous):
+			reason = chatRejectedAnonymous
+		}
+		r.reject(client, reason)
+		chatMessages.WithLabelValues(chatResultRejected).Inc()
+
+		return err
+	}
+	chatMessages.WithLabelValues(chatResultSent).Inc()
+
+	return nil
+}
+
+func (r *chatRoom) post(ctx context.Context, client *Client, payload []byte, now time.Time) error {
+	speaker := client.Subject
+	if speaker == "" {
+		return errChatAnonymous
+	}
+	text, err := chatText(payload)
+	if err != nil {
+		return err
+	}
+
+	if err = r.admit(ctx, speaker); err != nil {
+		return err
+	}
+
+	id, err := r.rdb.Incr(ctx, chatSeqKey).Uint64()
+	if err != nil {
+		return err
+	}
+
+	frame := chatFrame(id, now, r.handle(speaker), text)
+	_, err = r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, chatHistoryKey, frame)
+		pipe.LTrim(ctx, chatHistoryKey, 0, r.history-1)
+		pipe.Publish(ctx, chatChannel, frame)
+		return nil
+	})
+
+	return err
+}
+
+// admit checks the ban list and counts the message against the speaker's
+// rate limit, which holds across pods.
+func (r *chatRoom) admit(ctx context.Context, speaker string) error {
+	var banned *redis.BoolCmd
+	var sent *redis.IntCmd
+	_, err := r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		banned = pipe.SIsMember(ctx, chatBannedKey, speaker)
+		sent = pipe.Incr(ctx, chatRatePrefix+speaker)
+		pipe.ExpireNX(ctx, chatRatePrefix+speaker, r.rateWindow)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case banned.Val():
+		return errChatBanned
+	case r.rateLimit > 0 && sent.Val() > r.rateLimit:
+		return errChatRate
+	}
+
+	return nil
+}
+
+// remove deletes a message for every client and from the history. Only
+// moderators may delete.
+func (r *chatRoom) remove(ctx context.Context, client *Client, payload []byte) error {
+	if r == nil {
+		return nil
+	}
+	if len(payload) != 8 {
+		return ErrMalformedChat
+	}
+	if client.Subject == "" || !slices.Contains(r.moderators, client.Subject) {
+		r.reject(client, chatRejectedForbidden)
+		return errNotModerator
+	}
+
+	id := binary.BigEndian.Uint64(payload)
+	history, err := r.rdb.LRange(ctx, chatHistoryKey, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+
+	_, err = r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, frame := range history {
+			if chatFrameID([]byte(frame)) == id {
+				pipe.LRem(ctx, chatHistoryKey, 0, frame)
+			}
+		}
+		pipe.Publish(ctx, chatChannel, chatDeletedFrame(id))
+		return nil
+	})
+	if err == nil {
+		chatMessages.WithLabelValues(chatResultDeleted).Inc()
+	}
+
+	return err
+}
+
+func (r *chatRoom) reject(client *Client, reason uint8) {
+	frame, err := prepareFrame([]byte{msgTypeChatRejected, reason})
+	if err != nil {
+		return
+	}
+	if client.enqueue(frame) == nil {
+		client.hub.startWriter(client)
+	}
+}
+
+// sendHistory queues the chat history to a client that just connected,
+// oldest first.
+func (r *chatRoom) sendHistory(ctx context.Context, client *Client) {
+	if r == nil || !client.chat.Load() {
+		return
+	}
+
+	history, err := r.rdb.LRange(ctx, chatHistoryKey, 0, r.history-1).Result()
+	if err != nil {
+		logging.Errorf("Failed to read chat history: %v", err)
+		return
+	}
+
+	for i := len(history) - 1; i >= 0; i-- {
+		if err = client.queueWait(ctx, []byte(history[i])); err != nil {
+			logging.Errorf("Failed sending chat history to client %d: %v", client.ID, err)
+			return
+		}
+	}
+}
+
+// Run fans out the chat frames every pod publishes until ctx is done.
+func (r *chatRoom) Run(ctx context.Context) {
+	if r == nil {
+		return
+	}
+
+	pubsub := r.rdb.Subscribe(ctx, chatChannel)
+	defer pubsub.Close()
+	messages := pubsub.Channel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			frame := []byte(msg.Payload)
+			if len(frame) == 0 || (frame[0] != msgTypeChat && frame[0] != msgTypeChatDeleted) {
+				logging.Errorf("dropping malformed chat frame")
+				continue
+			}
+			r.hub.broadcastChat(frame)
+		}
+	}
+}
+
+// chatFrame encodes a chat message as
+// [type][id u64][unix ms u64][handle length u8][handle][text].
+func chatFrame(id uint64, at time.Time, handle, text string) []byte {
+	frame := make([]byte, 1, 1+8+8+1+len(handle)+len(text))
+	frame[0] = msgTypeChat
+	frame = binary.BigEndian.AppendUint64(frame, id)
+	frame = binary.BigEndian.AppendUint64(frame, uint64(at.UnixMilli()))
+	frame = append(frame, byte(len(handle)))
+	frame = append(frame, handle...)
+
+	return append(frame, text...)
+}
+
+// chatFrameID reads the id of a chat frame, zero if it isn't one.
+func chatFrameID(frame []byte) uint64 {
+	if len(frame) < 9 || frame[0] != msgTypeChat {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(frame[1:])
+}
+
+func chatDeletedFrame(id uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte{msgTypeChatDeleted}, id)
+}
@@ -0,0 +1,92 @@
+package ws
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChatText(t *testing.T) {
+	text, err := chatText([]byte("  meet at the flag  "))
+	assert.NoError(t, err)
+	assert.Equal(t, "meet at the flag", text)
+
+	for _, bad := range []string{"", "   ", strings.Repeat("a", maxChatText+1), "\xff\xfe", "line\nbreak"} {
+		_, err = chatText([]byte(bad))
+		assert.ErrorIs(t, err, ErrMalformedChat, "%q", bad)
+	}
+}
+
+func TestChatFrames(t *testing.T) {
+	at := time.UnixMilli(1700000000123)
+	frame := chatFrame(42, at, "anon-0a0b0c0d", "hi")
+
+	assert.Equal(t, uint8(msgTypeChat), frame[0])
+	assert.EqualValues(t, 42, chatFrameID(frame))
+	assert.EqualValues(t, at.UnixMilli(), binary.BigEndian.Uint64(frame[9:]))
+	assert.EqualValues(t, len("anon-0a0b0c0d"), frame[17])
+	assert.Equal(t, "anon-0a0b0c0dhi", string(frame[18:]))
+
+	deleted := chatDeletedFrame(42)
+	assert.Equal(t, []byte{msgTypeChatDeleted, 0, 0, 0, 0, 0, 0, 0, 42}, deleted)
+	assert.Zero(t, chatFrameID(deleted), "a deletion is not a chat message")
+}
+
+func TestChatHandlesAreStableAndOpaque(t *testing.T) {
+	r := &chatRoom{handleKey: []byte("secret")}
+
+	handle := r.handle("1234567890")
+	assert.Equal(t, handle, r.handle("1234567890"))
+	assert.NotEqual(t, handle, r.handle("1234567891"))
+	assert.NotContains(t, handle, "1234567890")
+	assert.Len(t, handle, len("anon-")+2*chatHandleBytes)
+}
+
+func TestChatDeleteIsForModeratorsOnly(t *testing.T) {
+	c := newClients(1, 16, policyDisconnect)
+	defer c.Close()
+	r := &chatRoom{hub: c, moderators: []string{"mod"}}
+
+	conn := newFakeConn()
+	client := c.register(conn, peer{Subject: "someone"})
+
+	err := r.remove(context.Background(), client, binary.BigEndian.AppendUint64(nil, 1))
+	assert.ErrorIs(t, err, errNotModerator)
+	assert.ErrorIs(t, r.remove(context.Background(), client, []byte{1}), ErrMalformedChat)
+	assert.Eventually(t, func() bool { return conn.messages.Load() == 1 }, time.Second, time.Millisecond,
+		"the client is told its delete was refused")
+}
+
+func TestChatSendNeedsASubject(t *testing.T) {
+	c := newClients(1, 16, policyDisconnect)
+	defer c.Close()
+	r := &chatRoom{hub: c}
+
+	conn := newFakeConn()
+	client := c.register(conn, peer{})
+
+	err := r.send(context.Background(), client, []byte("hi"), time.Now())
+	assert.ErrorIs(t, err, errChatAnonymous)
+	assert.Eventually(t, func() bool { return conn.messages.Load() == 1 }, time.Second, time.Millisecond,
+		"the client is told its message was refused")
+}
+
+func TestHubSendsChatOnlyToClientsThatAsked(t *testing.T) {
+	c := newClients(1, 16, policyDisconnect)
+	defer c.Close()
+
+	chatting := newFakeConn()
+	c.register(chatting, peer{}).chat.Store(true)
+	other := newFakeConn()
+	c.register(other, peer{})
+
+	c.broadcastChat(chatFrame(1, time.Now(), "anon-00000000", "hello"))
+	waitDrained(t, c)
+
+	assert.EqualValues(t, 1, chatting.messages.Load())
+	assert.Zero(t, other.messages.Load())
+}
@@ -2,77 +2,130 @@ package ws
 
 import (
 	"context"
+	"errors"
 	"math/rand"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"backend/internal/protocol"
 	"backend/logging"
 	"github.com/gorilla/websocket"
 )
 
+var (
+	errQueueFull    = errors.New("client write queue full")
+	errClientClosed = errors.New("client closed")
+)
+
 const (
 	pongWait     = 60 * time.Second
 	pingInterval = (pongWait * 9) / 10
 	writeTimeout = 100 * time.Millisecond
 	readTimeout  = 1 * time.Second
-)
 
-type Clients struct {
-	pool       *sync.Map
-	totalConns atomic.Int64
+	writePipeSize = 256
+	// bulkPipeSize bounds the state frames queued ahead of a client, so a
+	// snapshot is paced to the connection instead of crowding out updates
+	bulkPipeSize = 16
+	// maxWriteBatch bounds the queued frames a writer takes at once; runs of
+	// consecutive updates among them go out as one batch frame
+	maxWriteBatch = 64
 
-	pingTicker    *time.Ticker
-	cleanupTicker *time.Ticker
-	pingMsg       *websocket.PreparedMessage
+	// maxClientFrame bounds what a client may send; JSON frames get more room
+	maxClientFrame     = 512
+	maxClientTextFrame = 2048
+)
+
+// wsConn is the part of *websocket.Conn clients use.
+type wsConn interface {
+	ReadMessage() (int, []byte, error)
+	SetReadLimit(limit int64)
+	SetReadDeadline(t time.Time) error
+	SetPongHandler(h func(appData string) error)
+	SetWriteDeadline(t time.Time) error
+	EnableWriteCompression(enable bool)
+	WritePreparedMessage(pm *websocket.PreparedMessage) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	Subprotocol() string
+	Close() error
 }
 
+// Client is one connection. Only its reader has a goroutine of its own; a
+// writer is started whenever frames are queued and exits once they are sent.
 type Client struct {
-	serverCtx context.Context
-	ID        uint64
-	Conn      *websocket.Conn
-	writePipe chan *websocket.PreparedMessage
-	done      chan struct{}
+	ID   uint64
+	Conn wsConn
+	peer
+	hub *Clients
+	// json is set on clients that negotiated jsonSubprotocol
+	json      bool
+	writePipe chan outFrame
+	bulkPipe  chan outFrame
+	writing   atomic.Bool
 	lastPing  atomic.Int64
+	region    atomic.Pointer[region]
+	rle       atomic.Bool
+	// subscribeMu guards unsent, the chunks subscribed to but not sent yet,
+	// and sendingChunks, set while a goroutine is sending them
+	subscribeMu   sync.Mutex
+	unsent        region
+	sendingChunks bool
+	// cursors and chat are set on clients that follow those topics
+	cursors atomic.Bool
+	chat    atomic.Bool
+	// cursorID stands in for the client in shared cursors; lastCursor is
+	// when it last moved its own, zero until it shares one
+	cursorID   uint32
+	lastCursor atomic.Int64
+
+	// pipeMu guards the pipes against sends racing their close; closing is
+	// closed first to wake senders waiting on bulkPipe
+	pipeMu      sync.RWMutex
+	pipeClosed  bool
+	closing     chan struct{}
+	closingOnce sync.Once
+
+	slowMu sync.Mutex
+	slow   slowState
+
+	// authMu guards expiry, which closes the client when its token runs out
+	authMu    sync.Mutex
+	expiry    *time.Timer
+	expiresAt atomic.Int64
 }
 
-func NewClients() *Clients {
-	pingMsg, _ := websocket.NewPreparedMessage(websocket.PingMessage, []byte{})
-	return &Clients{
-		pool:          &sync.Map{},
-		cleanupTicker: time.NewTicker(time.Minute),
-		pingTicker:    time.NewTicker(pingInterval),
-		pingMsg:       pingMsg,
-	}
+// peer is who is on the other end of a connection.
+type peer struct {
+	ip string
+	// Subject is the token subject, empty when auth isn't required
+	Subject string
 }
 
-func (c *Clients) Add(conn *websocket.Conn) *Client {
-	clientID := generateClientID()
+func newClient(hub *Clients, id uint64, conn wsConn) *Client {
 	client := &Client{
-		ID:        clientID,
+		ID:        id,
 		Conn:      conn,
-		writePipe: make(chan *websocket.PreparedMessage, 256),
-		done:      make(chan struct{}),
+		hub:       hub,
+		writePipe: make(chan outFrame, writePipeSize),
+		bulkPipe:  make(chan outFrame, bulkPipeSize),
+		closing:   make(chan struct{}),
+		cursorID:  rand.Uint32(),
+	}
+	if conn != nil {
+		client.json = conn.Subprotocol() == jsonSubprotocol
 	}
 	client.lastPing.Store(time.Now().UnixNano())
-	c.pool.Store(clientID, client)
-
-	c.totalConns.Add(1)
-
-	go c.writePump(client)
-	go c.readPump(client)
 
 	return client
 }
 
 func (c *Clients) readPump(client *Client) {
-	client.Conn.SetReadLimit(512) // Small limit since we don't expect client messages
-	//client.Conn.SetPingHandler(func(string) error {
-	//	if err := client.Conn.WriteControl(websocket.PongMessage, []byte{}, time.Now().Add(writeTimeout)); err != nil {
-	//		return err
-	//	}
-	//	return nil
-	//})
+	if client.json {
+		client.Conn.SetReadLimit(maxClientTextFrame)
+	} else {
+		client.Conn.SetReadLimit(maxClientFrame)
+	}
 	defer func() {
 		c.remove(client)
 	}()
@@ -84,7 +137,7 @@ func (c *Clients) readPump(client *Client) {
 
 	_ = client.Conn.SetReadDeadline(time.Now().Add(pongWait))
 	for {
-		_, _, err := client.Conn.ReadMessage()
+		messageType, msg, err := client.Conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				logging.Errorf("unexpected close error: %v", err)
@@ -92,114 +145,260 @@ func (c *Clients) readPump(client *Client) {
 
 			break
 		}
+		if messageType == websocket.TextMessage {
+			if msg, err = binaryFrame(msg); err != nil {
+				logging.Debugf("client %d: %v", client.ID, err)
+				continue
+			}
+		}
+
+		handleClientFrame(client, msg)
 	}
 }
 
-func (c *Clients) Broadcast(message []byte) {
-	prepMsg, err := websocket.NewPreparedMessage(websocket.BinaryMessage, message)
-	if err != nil {
-		logging.Errorf("failed to create perp msg %v", err)
-		return
+// startWriter makes sure a writer is draining the client's pipes.
+func (c *Clients) startWriter(client *Client) {
+	if client.writing.CompareAndSwap(false, true) {
+		go c.writeLoop(client)
 	}
+}
+
+var batchPool = sync.Pool{New: func() any {
+	batch := make([]outFrame, 0, maxWriteBatch)
+	return &batch
+}}
+
+func (c *Clients) writeLoop(client *Client) {
+	pooled := batchPool.Get().(*[]outFrame)
+	defer batchPool.Put(pooled)
+
+	batch := *pooled
+	defer func() { clear(batch[:cap(batch)]) }()
+
+	for {
+		var open bool
+		batch, open = drain(client.writePipe, batch[:0])
+		if !c.writeBatch(client, batch) || !open {
+			return
+		}
 
-	c.pool.Range(func(key, value any) bool {
-		cli := value.(*Client)
 		select {
-		case cli.writePipe <- prepMsg:
+		case frame, ok := <-client.bulkPipe:
+			if !ok || !c.write(client, frame) {
+				return
+			}
+			continue
 		default:
-			logging.Debugf("client is full, closing it ")
-			cli.done <- struct{}{}
 		}
-		return true
-	})
+		if len(batch) > 0 {
+			continue
+		}
 
-}
+		if !c.catchUp(client) {
+			return
+		}
 
-func (c *Clients) Close() error {
-	c.pingTicker.Stop()
-	c.pool.Range(func(key, value any) bool {
-		value.(*Client).sendCloseMsg()
-		return true
-	})
-	return nil
+		// anything queued after the pipes looked empty started no writer of
+		// its own while this one was still marked running
+		client.writing.Store(false)
+		if len(client.writePipe) == 0 && len(client.bulkPipe) == 0 {
+			return
+		}
+		if !client.writing.CompareAndSwap(false, true) {
+			return
+		}
+	}
 }
 
-func (c *Clients) writePump(client *Client) {
-	for {
+// drain takes the frames already queued, up to maxWriteBatch. It reports false
+// once the pipe is closed.
+func drain(pipe chan outFrame, batch []outFrame) ([]outFrame, bool) {
+	for len(batch) < maxWriteBatch {
 		select {
-		case msg, ok := <-client.writePipe:
-			client.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		case frame, ok := <-pipe:
 			if !ok {
-				return
+				return batch, false
 			}
-			err := client.Conn.WritePreparedMessage(msg)
-			if err != nil {
-				logging.Errorf("Failed to send msg to client %d: %v", client.ID, err)
-				return
+			batch = append(batch, frame)
+		default:
+			return batch, true
+		}
+	}
+
+	return batch, true
+}
+
+// writeBatch writes frames in order, sending each run of consecutive updates
+// as a single batch frame.
+func (c *Clients) writeBatch(client *Client, frames []outFrame) bool {
+	for start := 0; start < len(frames); {
+		end := start + 1
+		if frames[start].update != nil {
+			for end < len(frames) && frames[end].update != nil && frames[end].update.Seq == frames[end-1].update.Seq+1 {
+				end++
 			}
-		case <-c.pingTicker.C:
-			err := client.Conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(time.Second))
-			if err != nil {
-				if !websocket.IsCloseError(err,
-					websocket.CloseNormalClosure,
-					websocket.CloseGoingAway,
-					websocket.CloseAbnormalClosure) {
-					logging.Errorf("Failed to send ping to client %d: %v", client.ID, err)
-				}
-				c.remove(client)
-				return
+		}
+
+		frame := frames[start]
+		if end-start > 1 {
+			updates := make([]protocol.Update, 0, end-start)
+			for _, f := range frames[start:end] {
+				updates = append(updates, *f.update)
 			}
-		case <-c.cleanupTicker.C:
-			c.cleanupInactiveClients()
-		case <-client.done:
-			return
+
+			var err error
+			if frame, err = prepareFrame(batchFrames(updates)[0]); err != nil {
+				logging.Errorf("failed to create perp msg %v", err)
+				return false
+			}
+		}
+		writeBatchSize.Observe(float64(end - start))
+
+		if !c.write(client, frame) {
+			return false
 		}
+		start = end
 	}
+
+	return true
 }
 
-func (c *Clients) cleanupInactiveClients() {
-	threshold := time.Now().Add(-2 * time.Minute).UnixNano()
-	inactiveCount := 0
+// write sends one frame, deflated if it is worth it and the client
+// negotiated permessage-deflate.
+func (c *Clients) write(client *Client, frame outFrame) bool {
+	var err error
+	if frame.ping {
+		err = client.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+	} else if events, ok := client.Conn.(*sseConn); ok {
+		err = events.writeFrame(frame.data)
+	} else {
+		msg := frame.msg
+		if client.json {
+			if msg, err = frame.textMessage(); err != nil {
+				// nothing a JSON client can be sent in its place
+				logging.Errorf("Failed to translate frame for client %d: %v", client.ID, err)
+				return true
+			}
+		}
+		client.Conn.EnableWriteCompression(frame.compress)
+		client.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		err = client.Conn.WritePreparedMessage(msg)
+	}
 
-	c.pool.Range(func(key, value any) bool {
-		client := value.(*Client)
-		if client.lastPing.Load() < threshold {
-			c.remove(client)
-			inactiveCount++
-			logging.Infof("Cleaned up inactive client %d (last ping: %v)",
-				client.ID, time.Unix(0, client.lastPing.Load()))
+	if err != nil {
+		if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			logging.Errorf("Failed to send msg to client %d: %v", client.ID, err)
 		}
-		return true
-	})
+		c.remove(client)
+		return false
+	}
+
+	return true
+}
+
+func (c *Client) enqueue(frame outFrame) error {
+	c.pipeMu.RLock()
+	defer c.pipeMu.RUnlock()
+
+	if c.pipeClosed {
+		return errClientClosed
+	}
 
-	if inactiveCount > 0 {
-		logging.Infof("cleaned up %d inactive clients", inactiveCount)
+	select {
+	case c.writePipe <- frame:
+		return nil
+	default:
+		return errQueueFull
 	}
 }
 
-func (c *Clients) remove(cli *Client) {
-	c.pool.Delete(cli.ID)
-	close(cli.writePipe)
-	cli.Conn.Close()
+// outFrame is a frame queued to a client's writer.
+type outFrame struct {
+	msg *websocket.PreparedMessage
+	// data is the frame as it was prepared, for connections that aren't
+	// websockets; text is its JSON form, for JSON clients
+	data []byte
+	text *lazyText
+	// compress is set on frames large enough for permessage-deflate to pay
+	// off; single updates come out bigger than they went in
+	compress bool
+	// update is set on update frames, so the writer can batch runs of them
+	update *protocol.Update
+	// ephemeral frames, such as cursors, are dropped for a client that is
+	// behind instead of invoking the slow consumer policy
+	ephemeral bool
+	ping      bool
+}
+
+var pingFrame = outFrame{ping: true}
+
+func prepareFrame(message []byte) (outFrame, error) {
+	msg, err := websocket.NewPreparedMessage(websocket.BinaryMessage, message)
+	if err != nil {
+		return outFrame{}, err
+	}
+
+	return outFrame{msg: msg, data: message, text: new(lazyText), compress: len(message) >= compressionMinSize}, nil
 }
 
-func (c *Client) sendRaw(message []byte) error {
-	err := c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+// queueWait hands a frame of a bulk send, such as a snapshot, to the writer.
+// Rather than failing when the client is behind, it waits for room, so slow
+// clients are paced instead of cut off.
+func (c *Client) queueWait(ctx context.Context, message []byte) error {
+	frame, err := prepareFrame(message)
 	if err != nil {
-		logging.Errorf("Failed to set deadline timeout %d: %v", c.ID, err)
 		return err
 	}
-	if err = c.Conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
-		logging.Errorf("Failed writing to client %d: %v", c.ID, err)
+
+	if err = c.sendBulk(ctx, frame); err != nil {
 		return err
 	}
+	frameBytes.WithLabelValues(frameName(message[0])).Add(float64(len(message)))
+	c.hub.startWriter(c)
+
 	return nil
 }
 
+func (c *Client) sendBulk(ctx context.Context, frame outFrame) error {
+	c.pipeMu.RLock()
+	defer c.pipeMu.RUnlock()
+
+	if c.pipeClosed {
+		return errClientClosed
+	}
+
+	select {
+	case c.bulkPipe <- frame:
+		return nil
+	case <-c.closing:
+		return errClientClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closePipe closes the pipes once, stopping the writer.
+func (c *Client) closePipe() {
+	c.closingOnce.Do(func() { close(c.closing) })
+
+	c.pipeMu.Lock()
+	defer c.pipeMu.Unlock()
+
+	if !c.pipeClosed {
+		c.pipeClosed = true
+		close(c.writePipe)
+		close(c.bulkPipe)
+	}
+}
+
 func (c *Client) sendCloseMsg() {
-	close(c.writePipe)
-	c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
-	err := c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.closeWith(websocket.CloseNormalClosure, "")
+}
+
+// closeWith stops the writer and sends a close frame with code.
+func (c *Client) closeWith(code int, text string) {
+	c.closePipe()
+	err := c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(writeTimeout))
 	if err != nil {
 		logging.Errorf("Failed to send close to client %d: %v", c.ID, err)
 	}
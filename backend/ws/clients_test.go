@@ -1,9 +1,13 @@
 package ws
 
 import (
+	"context"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestGenerateClientID(t *testing.T) {
@@ -56,3 +60,54 @@ func BenchmarkGenerateClientID(b *testing.B) {
 		generateClientID()
 	}
 }
+
+func newTestClient() *Client {
+	client := newClient(nil, generateClientID(), nil)
+	client.writePipe = make(chan outFrame, 1)
+	client.bulkPipe = make(chan outFrame, 1)
+
+	return client
+}
+
+func TestSendBulkPacesBulkSends(t *testing.T) {
+	client := newTestClient()
+	ctx := context.Background()
+
+	assert.NoError(t, client.sendBulk(ctx, outFrame{}))
+
+	sent := make(chan error)
+	go func() { sent <- client.sendBulk(ctx, outFrame{}) }()
+
+	select {
+	case <-sent:
+		t.Fatal("sendBulk should wait while the bulk pipe is full")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	<-client.bulkPipe
+	assert.NoError(t, <-sent)
+	assert.Empty(t, client.writePipe, "bulk sends leave the update pipe free")
+}
+
+func TestPrepareFrameCompressesLargeFrames(t *testing.T) {
+	small, err := prepareFrame(make([]byte, 21))
+	assert.NoError(t, err)
+	assert.False(t, small.compress)
+
+	large, err := prepareFrame(make([]byte, compressionMinSize))
+	assert.NoError(t, err)
+	assert.True(t, large.compress)
+}
+
+func TestSendBulkStopsWhenClientCloses(t *testing.T) {
+	client := newTestClient()
+	assert.NoError(t, client.sendBulk(context.Background(), outFrame{}))
+
+	sent := make(chan error)
+	go func() { sent <- client.sendBulk(context.Background(), outFrame{}) }()
+
+	time.Sleep(10 * time.Millisecond)
+	client.closePipe()
+	assert.ErrorIs(t, <-sent, errClientClosed)
+	assert.ErrorIs(t, client.sendBulk(context.Background(), outFrame{}), errClientClosed)
+}
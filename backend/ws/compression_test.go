@@ -0,0 +1,159 @@
+package ws
+
+import (
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"backend/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// canvases are typical snapshots: untouched, mostly background with some
+// drawing, and the worst case of every cell random.
+func canvases() map[string][]byte {
+	rng := rand.New(rand.NewSource(1))
+	size := protocol.CanvasSize * protocol.CanvasSize / 2
+
+	drawn := make([]byte, size)
+	for range 40 {
+		// short horizontal strokes of one color
+		start, color := rng.Intn(size-8), byte(rng.Intn(16))
+		for i := start; i < start+8; i++ {
+			drawn[i] = color<<4 | color
+		}
+	}
+
+	noise := make([]byte, size)
+	rng.Read(noise)
+
+	return map[string][]byte{"blank": make([]byte, size), "drawn": drawn, "noise": noise}
+}
+
+// BenchmarkSnapshotBytes reports the bytes of chunk frames a client receives
+// for a full snapshot with and without run-length encoding.
+func BenchmarkSnapshotBytes(b *testing.B) {
+	g := newChunkGrid(protocol.CanvasSize, defaultChunkSize)
+	for name, state := range canvases() {
+		for _, rle := range []bool{false, true} {
+			b.Run(name+map[bool]string{false: "/raw", true: "/rle"}[rle], func(b *testing.B) {
+				total := 0
+				for range b.N {
+					total = 0
+					for chunk := range g.count() {
+						total += len(g.chunkFrame(1, state, chunk, rle))
+					}
+				}
+				b.ReportMetric(float64(total), "bytes/client")
+			})
+		}
+	}
+}
+
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+// updateFrames returns n frames of single random updates.
+func updateFrames(n int) [][]byte {
+	rng := rand.New(rand.NewSource(1))
+	frames := make([][]byte, n)
+	for i := range frames {
+		update := protocol.Update{Seq: uint64(i + 1), Cell: protocol.Cell{
+			X: uint16(rng.Intn(protocol.CanvasSize)), Y: uint16(rng.Intn(protocol.CanvasSize)),
+			Color: uint8(rng.Intn(16)), Time: 1760788800000 + int64(i)*50,
+		}}
+		frames[i] = addMsgType(msgTypeUpdate, update.Encode())
+	}
+
+	return frames
+}
+
+// batchFrame returns one batch frame of n random consecutive updates.
+func batchFrame(n int) []byte {
+	updates := make([]protocol.Update, n)
+	for i, frame := range updateFrames(n) {
+		update, _ := protocol.DecodeUpdate(frame[1:])
+		updates[i] = *update
+	}
+
+	return batchFrames(updates)[0]
+}
+
+// wireBytes sends frames over a real connection and returns the bytes the
+// client read, with or without permessage-deflate.
+func wireBytes(b *testing.B, frames [][]byte, compress bool) int64 {
+	up := websocket.Upgrader{EnableCompression: compress}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.EnableWriteCompression(compress)
+
+		for _, frame := range frames {
+			if err = conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	var read atomic.Int64
+	dialer := websocket.Dialer{
+		EnableCompression: compress,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			return countingConn{Conn: conn, read: &read}, err
+		},
+	}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	for range frames {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return read.Load()
+}
+
+// BenchmarkWireBytes reports the bytes on the wire per frame with and without
+// permessage-deflate, over a real connection.
+func BenchmarkWireBytes(b *testing.B) {
+	g := newChunkGrid(protocol.CanvasSize, defaultChunkSize)
+	frames := map[string][]byte{
+		"update":      updateFrames(1)[0],
+		"batch100":    batchFrame(100),
+		"batch1000":   batchFrame(1000),
+		"chunk_drawn": g.chunkFrame(1, canvases()["drawn"], 0, false),
+	}
+
+	for name, frame := range frames {
+		for _, compress := range []bool{false, true} {
+			b.Run(name+map[bool]string{false: "/plain", true: "/deflate"}[compress], func(b *testing.B) {
+				sent := make([][]byte, b.N)
+				for i := range sent {
+					sent[i] = frame
+				}
+				b.ReportMetric(float64(wireBytes(b, sent, compress))/float64(b.N), "bytes/frame")
+			})
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package ws
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"backend/internal/config"
+	"backend/internal/protocol"
+	"backend/logging"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// cursorsChannel carries every pod's cursor batches to every pod
+	cursorsChannel = "grid_cursors"
+	// cursorsQueryParam opts a client in to receiving others' cursors
+	cursorsQueryParam = "cursors"
+
+	// hiddenCursor as both coordinates withdraws a cursor
+	hiddenCursor = 0xFFFF
+	cursorSize   = 8
+	// maxCursorBatch bounds the cursors published in one message
+	maxCursorBatch = 4096
+
+	defaultCursorFlushInterval = 100 * time.Millisecond
+	defaultCursorMinInterval   = 50 * time.Millisecond
+)
+
+var ErrMalformedCursor = errors.New("malformed cursor frame")
+
+// cursor is where one client points. It is identified by a random id drawn
+// per connection, never by who the client is.
+type cursor struct {
+	id   uint32
+	x, y uint16
+}
+
+func (c cursor) hidden() bool {
+	return c.x == hiddenCursor && c.y == hiddenCursor
+}
+
+// cursorFeed collects the cursors clients of this pod share, publishes them as
+// one batch per flush interval, and fans the batches of every pod out to the
+// clients watching the chunks they fall in.
+type cursorFeed struct {
+	rdb redis.UniversalClient
+	hub *Clients
+	// minInterval throttles each client's cursor frames; extras are dropped
+	minInterval time.Duration
+	interval    time.Duration
+
+	mu      sync.Mutex
+	pending map[uint32]cursor
+}
+
+// cursors is nil unless WS_CURSORS is on; its methods are no-ops then.
+var cursors *cursorFeed
+
+func newCursorFeed(rdb redis.UniversalClient, hub *Clients) *cursorFeed {
+	if !config.Bool("WS_CURSORS", true) {
+		return nil
+	}
+
+	return &cursorFeed{
+		rdb:         rdb,
+		hub:         hub,
+		minInterval: config.Duration("WS_CURSOR_MIN_INTERVAL", defaultCursorMinInterval),
+		interval:    config.Duration("WS_CURSOR_FLUSH_INTERVAL", defaultCursorFlushInterval),
+		pending:     make(map[uint32]cursor),
+	}
+}
+
+// wantsCursors reads whether a client asked for others' cursors with ?cursors=1.
+func wantsCursors(c *gin.Context) bool {
+	want, _ := strconv.ParseBool(c.Query(cursorsQueryParam))
+	return want
+}
+
+// move records a cursor frame from client, dropping it if the client sends
+// faster than minInterval.
+func (f *cursorFeed) move(client *Client, payload []byte, now time.Time) error {
+	if f == nil {
+		return nil
+	}
+	if len(payload) != 4 {
+		return ErrMalformedCursor
+	}
+
+	cur := cursor{id: client.cursorID, x: binary.BigEndian.Uint16(payload), y: binary.BigEndian.Uint16(payload[2:])}
+	if !cur.hidden() && (int(cur.x) >= protocol.CanvasSize || int(cur.y) >= protocol.CanvasSize) {
+		return ErrMalformedCursor
+	}
+
+	last := client.lastCursor.Load()
+	if now.UnixNano()-last < f.minInterval.Nanoseconds() || !client.lastCursor.CompareAndSwap(last, now.UnixNano()) {
+		cursorsDropped.Inc()
+		return nil
+	}
+
+	f.mu.Lock()
+	f.pending[cur.id] = cur
+	f.mu.Unlock()
+
+	return nil
+}
+
+// hide withdraws the cursor of a client that is going away, if it shared one.
+func (f *cursorFeed) hide(client *Client) {
+	if f == nil || client.lastCursor.Load() == 0 {
+		return
+	}
+
+	f.mu.Lock()
+	f.pending[client.cursorID] = cursor{id: client.cursorID, x: hiddenCursor, y: hiddenCursor}
+	f.mu.Unlock()
+}
+
+// take returns the cursors recorded since the last call.
+func (f *cursorFeed) take() []cursor {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.pending) == 0 {
+		return nil
+	}
+	batch := make([]cursor, 0, len(f.pending))
+	for _, cur := range f.pending {
+		batch = append(batch, cur)
+	}
+	clear(f.pending)
+
+	return batch
+}
+
+// Run publishes this pod's cursors and fans out every pod's until ctx is done.
+func (f *cursorFeed) Run(ctx context.Context) {
+	if f == nil {
+		return
+	}
+
+	pubsub := f.rdb.Subscribe(ctx, cursorsChannel)
+	defer pubsub.Close()
+	messages := pubsub.Channel()
+
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for batch := range slices.Chunk(f.take(), maxCursorBatch) {
+				if err := f.rdb.Publish(ctx, cursorsChannel, encodeCursors(batch)).Err(); err != nil {
+					logging.Errorf("failed to publish cursors: %v", err)
+				}
+			}
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			batch, err := decodeCursors([]byte(msg.Payload))
+			if err != nil {
+				logging.Errorf("dropping cursor batch: %v", err)
+				continue
+			}
+			for chunk, frame := range cursorFrames(batch) {
+				f.hub.broadcastCursors(frame, chunk)
+			}
+		}
+	}
+}
+
+// cursorFrames splits a batch into one cursor frame per chunk. Hidden cursors
+// may be shown anywhere, so they go to every chunk.
+func cursorFrames(batch []cursor) map[int][]byte {
+	byChunk := make(map[int][]cursor)
+	for _, cur := range batch {
+		chunk := allChunks
+		if !cur.hidden() {
+			chunk = chunks.chunkOf(cur.x, cur.y)
+		}
+		byChunk[chunk] = append(byChunk[chunk], cur)
+	}
+
+	frames := make(map[int][]byte, len(byChunk))
+	for chunk, inChunk := range byChunk {
+		frames[chunk] = addMsgType(msgTypeCursors, encodeCursors(inChunk))
+	}
+
+	return frames
+}
+
+// encodeCursors writes a cursor batch as [count u16] followed by
+// [id u32][x u16][y u16] per cursor; it is both the Redis message and the body
+// of a cursors frame.
+func encodeCursors(batch []cursor) []byte {
+	buf := make([]byte, 2, 2+len(batch)*cursorSize)
+	binary.BigEndian.PutUint16(buf, uint16(len(batch)))
+	for _, cur := range batch {
+		buf = binary.BigEndian.AppendUint32(buf, cur.id)
+		buf = binary.BigEndian.AppendUint16(buf, cur.x)
+		buf = binary.BigEndian.AppendUint16(buf, cur.y)
+	}
+
+	return buf
+}
+
+func decodeCursors(buf []byte) ([]cursor, error) {
+	if len(buf) < 2 {
+		return nil, ErrMalformedCursor
+	}
+	count := int(binary.BigEndian.Uint16(buf))
+	if len(buf) != 2+count*cursorSize {
+		return nil, ErrMalformedCursor
+	}
+
+	batch := make([]cursor, count)
+	for i := range batch {
+		entry := buf[2+i*cursorSize:]
+		batch[i] = cursor{
+			id: binary.BigEndian.Uint32(entry),
+			x:  binary.BigEndian.Uint16(entry[4:]),
+			y:  binary.BigEndian.Uint16(entry[6:]),
+		}
+	}
+
+	return batch, nil
+}
@@ -0,0 +1,96 @@
+package ws
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func cursorPayload(x, y uint16) []byte {
+	return binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, x), y)
+}
+
+func TestCursorBatchRoundTrip(t *testing.T) {
+	batch := []cursor{{id: 1, x: 2, y: 3}, {id: 0xDEADBEEF, x: hiddenCursor, y: hiddenCursor}}
+
+	decoded, err := decodeCursors(encodeCursors(batch))
+	assert.NoError(t, err)
+	assert.Equal(t, batch, decoded)
+
+	_, err = decodeCursors(encodeCursors(batch)[:10])
+	assert.ErrorIs(t, err, ErrMalformedCursor)
+}
+
+func TestCursorFeedThrottlesPerClient(t *testing.T) {
+	f := &cursorFeed{minInterval: 50 * time.Millisecond, pending: make(map[uint32]cursor)}
+	client := newTestClient()
+	now := time.Now()
+
+	assert.NoError(t, f.move(client, cursorPayload(1, 1), now))
+	assert.NoError(t, f.move(client, cursorPayload(2, 2), now.Add(10*time.Millisecond)))
+	assert.ErrorIs(t, f.move(client, cursorPayload(1000, 1), now.Add(time.Second)), ErrMalformedCursor)
+	assert.ErrorIs(t, f.move(client, []byte{1}, now.Add(time.Second)), ErrMalformedCursor)
+	assert.Equal(t, []cursor{{id: client.cursorID, x: 1, y: 1}}, f.take(), "the second move came too soon")
+
+	assert.NoError(t, f.move(client, cursorPayload(3, 3), now.Add(60*time.Millisecond)))
+	assert.Equal(t, []cursor{{id: client.cursorID, x: 3, y: 3}}, f.take())
+	assert.Nil(t, f.take())
+}
+
+func TestCursorFeedHidesDepartingClients(t *testing.T) {
+	f := &cursorFeed{pending: make(map[uint32]cursor)}
+	lurker := newTestClient()
+	sharer := newTestClient()
+	assert.NoError(t, f.move(sharer, cursorPayload(1, 1), time.Now()))
+	f.take()
+
+	f.hide(lurker)
+	f.hide(sharer)
+	assert.Equal(t, []cursor{{id: sharer.cursorID, x: hiddenCursor, y: hiddenCursor}}, f.take())
+}
+
+func TestCursorFramesSplitByChunk(t *testing.T) {
+	near := cursor{id: 1, x: 1, y: 1}
+	alsoNear := cursor{id: 2, x: 2, y: 2}
+	far := cursor{id: 3, x: 99, y: 99}
+	gone := cursor{id: 4, x: hiddenCursor, y: hiddenCursor}
+
+	frames := cursorFrames([]cursor{near, far, alsoNear, gone})
+	assert.Len(t, frames, 3)
+
+	first, err := decodeCursors(frames[chunks.chunkOf(1, 1)][1:])
+	assert.NoError(t, err)
+	assert.Equal(t, []cursor{near, alsoNear}, first)
+	assert.Equal(t, uint8(msgTypeCursors), frames[allChunks][0])
+}
+
+func TestHubSendsCursorsOnlyToClientsThatAsked(t *testing.T) {
+	c := newClients(1, 16, policyDisconnect)
+	defer c.Close()
+
+	watching := newFakeConn()
+	c.register(watching, peer{}).cursors.Store(true)
+	other := newFakeConn()
+	c.register(other, peer{})
+
+	c.broadcastCursors(addMsgType(msgTypeCursors, encodeCursors([]cursor{{id: 1, x: 1, y: 1}})), allChunks)
+	waitDrained(t, c)
+
+	assert.EqualValues(t, 1, watching.messages.Load())
+	assert.Zero(t, other.messages.Load())
+}
+
+func TestEphemeralFramesSkipSlowConsumerPolicy(t *testing.T) {
+	c := &Clients{policy: policyDisconnect}
+	client := newTestClient()
+
+	frame, err := prepareFrame(addMsgType(msgTypeCursors, encodeCursors(nil)))
+	assert.NoError(t, err)
+	frame.ephemeral = true
+
+	assert.True(t, c.deliver(client, frame))
+	assert.False(t, c.deliver(client, frame), "dropped while the client is full")
+	assert.False(t, client.pipeClosed, "and the client is kept")
+}
@@ -0,0 +1,142 @@
+package ws
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"slices"
+	"time"
+
+	"backend/internal/config"
+	"backend/logging"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultDrainDelay  = 5 * time.Second
+	defaultDrainWindow = 20 * time.Second
+	// drainTick is how often clients due to be closed are
+	drainTick = 100 * time.Millisecond
+	// drainRetryAfter is what refused connections are told while draining;
+	// by then the pod is being taken out of the service
+	drainRetryAfter = time.Second
+)
+
+var (
+	// drainDelay gives the ingress time to stop routing to the pod before
+	// clients are sent elsewhere, so they don't land back on it
+	drainDelay  = config.Duration("WS_DRAIN_DELAY", defaultDrainDelay)
+	drainWindow = config.Duration("WS_DRAIN_WINDOW", defaultDrainWindow)
+)
+
+// drainFrame tells a client this pod is going away and how long it has to
+// reconnect, which will land it on another pod:
+//
+//	drain: [type][delay ms u32]
+func drainFrame(delay time.Duration) []byte {
+	return binary.BigEndian.AppendUint32([]byte{msgTypeDrain}, uint32(delay.Milliseconds()))
+}
+
+// Drain moves clients off this pod before it stops, instead of closing them
+// all at once and having them reconnect together, likely back here. New
+// connections are refused, and every client is sent a drain frame with its own
+// delay, past drainDelay and spread over the window. Each is closed with
+// CloseServiceRestart once its delay is up unless it left first. Whoever is
+// left when ctx is done is closed right away.
+func (c *Clients) Drain(ctx context.Context) {
+	c.limits.startDraining()
+	c.drain(ctx, drainDelay, drainWindow)
+}
+
+// drainDue is a client told to reconnect and when it is to be closed.
+type drainDue struct {
+	cli *Client
+	at  time.Time
+}
+
+func (c *Clients) drain(ctx context.Context, delay, window time.Duration) {
+	start := time.Now().Add(delay)
+	end := start.Add(window)
+	seen := make(map[uint64]struct{})
+	var pending []drainDue
+
+	// schedule tells clients not yet seen to reconnect. The first ones are
+	// spread over the window in random order; those that register later,
+	// having been admitted just before draining started, are due at its end.
+	schedule := func(now time.Time, first bool) int {
+		var fresh []*Client
+		for _, s := range c.shards {
+			for _, cli := range s.snapshot() {
+				if _, ok := seen[cli.ID]; !ok {
+					seen[cli.ID] = struct{}{}
+					fresh = append(fresh, cli)
+				}
+			}
+		}
+		rand.Shuffle(len(fresh), func(i, j int) { fresh[i], fresh[j] = fresh[j], fresh[i] })
+
+		for i, cli := range fresh {
+			at := end
+			if first {
+				// client i is due after delay + window*i/n
+				at = start.Add(window * time.Duration(i) / time.Duration(len(fresh)))
+			}
+			if at.Before(now) {
+				at = now
+			}
+			pending = append(pending, drainDue{cli: cli, at: at})
+
+			frame, err := prepareFrame(drainFrame(at.Sub(now)))
+			if err != nil {
+				continue
+			}
+			if cli.enqueue(frame) == nil {
+				c.startWriter(cli)
+			}
+		}
+
+		return len(fresh)
+	}
+
+	total := schedule(time.Now(), true)
+	logging.Infof("draining %d clients over %s after %s", total, window, delay)
+
+	ticker := time.NewTicker(drainTick)
+	defer ticker.Stop()
+
+	for cut := false; !cut; {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			cut, now = true, time.Now()
+		case now = <-ticker.C:
+		}
+		total += schedule(now, false)
+
+		pending = slices.DeleteFunc(pending, func(due drainDue) bool {
+			if !cut && due.at.After(now) {
+				return false
+			}
+			if c.connected(due.cli) {
+				due.cli.closeWith(websocket.CloseServiceRestart, "draining")
+				drainedClients.Inc()
+			}
+			return true
+		})
+		if len(pending) == 0 {
+			break
+		}
+	}
+	logging.Infof("drained %d clients", total)
+}
+
+// connected reports whether cli is still registered with the hub.
+func (c *Clients) connected(cli *Client) bool {
+	s := c.shardOf(cli.ID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.clients[cli.ID]
+
+	return ok
+}
@@ -0,0 +1,96 @@
+package ws
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrainFrame(t *testing.T) {
+	frame := drainFrame(1500 * time.Millisecond)
+	assert.Equal(t, []byte{msgTypeDrain, 0, 0, 0x05, 0xDC}, frame)
+
+	text, err := textFrame(frame)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"type":"drain","delay":1500}`, string(text))
+}
+
+func TestDrainClosesClientsOverWindow(t *testing.T) {
+	c := newClients(2, 16, policyDisconnect)
+	conns := make([]*fakeConn, 10)
+	for i := range conns {
+		conns[i] = newFakeConn()
+		c.register(conns[i], peer{})
+	}
+	left := c.register(newFakeConn(), peer{})
+	c.remove(left)
+
+	closedCount := func() int {
+		n := 0
+		for _, conn := range conns {
+			if conn.closeCode.Load() != 0 {
+				n++
+			}
+		}
+		return n
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.drain(context.Background(), 100*time.Millisecond, time.Second)
+	}()
+
+	time.Sleep(400 * time.Millisecond)
+	assert.Less(t, closedCount(), len(conns), "closes are spread over the window")
+	<-done
+
+	for _, conn := range conns {
+		assert.Equal(t, int64(websocket.CloseServiceRestart), conn.closeCode.Load())
+		assert.Positive(t, conn.messages.Load(), "told to reconnect before being closed")
+	}
+	assert.Zero(t, left.Conn.(*fakeConn).closeCode.Load(), "clients that left aren't closed")
+}
+
+func TestDrainClosesEveryoneWhenCut(t *testing.T) {
+	c := newClients(1, 16, policyDisconnect)
+	conns := make([]*fakeConn, 5)
+	for i := range conns {
+		conns[i] = newFakeConn()
+		c.register(conns[i], peer{})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.drain(ctx, time.Hour, time.Hour)
+
+	for _, conn := range conns {
+		assert.Equal(t, int64(websocket.CloseServiceRestart), conn.closeCode.Load())
+	}
+}
+
+func TestDrainCatchesClientsThatRegisterLate(t *testing.T) {
+	c := newClients(1, 16, policyDisconnect)
+	early := newFakeConn()
+	c.register(early, peer{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.drain(context.Background(), 100*time.Millisecond, 300*time.Millisecond)
+	}()
+
+	// admitted before draining started, but registered after the first look
+	late := newFakeConn()
+	time.Sleep(50 * time.Millisecond)
+	c.register(late, peer{})
+	<-done
+
+	for _, conn := range []*fakeConn{early, late} {
+		assert.Equal(t, int64(websocket.CloseServiceRestart), conn.closeCode.Load())
+		assert.Positive(t, conn.messages.Load(), "told to reconnect before being closed")
+	}
+}
@@ -0,0 +1,234 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+
+	"backend/internal/protocol"
+	"backend/logging"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// updatesChannel is where the grid service publishes, grid.BroadcastChannel
+	updatesChannel = "grid_updates_brd"
+
+	// feedPingInterval is how long the subscription may stay quiet before it
+	// is pinged; a ping unanswered for as long again means the connection is
+	// dead
+	feedPingInterval = 5 * time.Second
+	feedBackoffMin   = 100 * time.Millisecond
+	feedBackoffMax   = 10 * time.Second
+	// feedRecoverTimeout bounds reading missed updates from Redis
+	feedRecoverTimeout = 10 * time.Second
+)
+
+// subscription is the part of a Redis subscription the feed reads.
+type subscription interface {
+	ReceiveTimeout(ctx context.Context, timeout time.Duration) (interface{}, error)
+	Ping(ctx context.Context, payload ...string) error
+	Close() error
+}
+
+// updateFeed follows the updates the grid service broadcasts and hands them,
+// in sequence order, to the cache, the replica and clients. Redis drops what
+// is published while a subscriber is disconnected, so the feed tracks
+// sequence numbers: a hole, seen in the stream or found when resubscribing,
+// is replayed from the stored buckets, or if they no longer hold all of it,
+// every client is resynced with a fresh snapshot.
+type updateFeed struct {
+	subscribe func(ctx context.Context) subscription
+	hub       *Clients
+	// last is the sequence number of the last update delivered, zero until
+	// one is
+	last uint64
+	// lastTime is when that update was placed
+	lastTime int64
+}
+
+func newUpdateFeed(rdb redis.UniversalClient, hub *Clients) *updateFeed {
+	return &updateFeed{
+		subscribe: func(ctx context.Context) subscription {
+			return rdb.Subscribe(ctx, updatesChannel)
+		},
+		hub: hub,
+	}
+}
+
+// Run follows the feed until ctx is done, subscribing again with backoff
+// whenever the subscription fails.
+func (f *updateFeed) Run(ctx context.Context) {
+	backoff := feedBackoffMin
+	for {
+		subscribed, err := f.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if subscribed {
+			backoff = feedBackoffMin
+		}
+
+		// jittered so every pod doesn't come back at once after Redis does
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)))
+		logging.Warnf("update subscription lost, resubscribing in %s: %v", wait, err)
+		feedResubscribes.Inc()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, feedBackoffMax)
+	}
+}
+
+// follow subscribes and delivers updates until the subscription fails. It
+// reports whether the subscription was confirmed before that.
+func (f *updateFeed) follow(ctx context.Context) (bool, error) {
+	sub := f.subscribe(ctx)
+	defer sub.Close()
+
+	// the first reply confirms the subscription; from here nothing is missed
+	if _, err := sub.ReceiveTimeout(ctx, feedPingInterval); err != nil {
+		return false, err
+	}
+	f.catchUp(ctx)
+
+	pinged := false
+	for ctx.Err() == nil {
+		msg, err := sub.ReceiveTimeout(ctx, feedPingInterval)
+		if err != nil {
+			if !isTimeout(err) || pinged {
+				return true, err
+			}
+			if err = sub.Ping(ctx); err != nil {
+				return true, err
+			}
+			pinged = true
+			continue
+		}
+
+		pinged = false
+		if m, ok := msg.(*redis.Message); ok {
+			f.handle(ctx, []byte(m.Payload))
+		}
+	}
+
+	return true, ctx.Err()
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// catchUp delivers what was published before the feed subscribed, if it was
+// following before.
+func (f *updateFeed) catchUp(ctx context.Context) {
+	if f.last == 0 {
+		return
+	}
+
+	current, err := redisClient.Get(ctx, protocol.SeqKey(gridKey)).Uint64()
+	if err != nil {
+		// the next update shows whether any were missed
+		logging.Errorf("Failed to read sequence after resubscribing: %v", err)
+		return
+	}
+	if current > f.last {
+		f.recover(ctx, current)
+	}
+}
+
+func (f *updateFeed) handle(ctx context.Context, payload []byte) {
+	data := addMsgType(msgTypeUpdate, payload)
+	logging.Debugf("got a new message, broadcasting it")
+
+	update, err := decodeUpdate(payload)
+	if err != nil {
+		logging.Errorf("dropping malformed update from cache: %v", err)
+		f.hub.Broadcast(data, nil)
+		return
+	}
+
+	if update.Seq != 0 && f.last != 0 {
+		switch {
+		case update.Seq <= f.last && !f.wasReset(ctx):
+			// already replayed from history
+			return
+		case update.Seq > f.last+1:
+			f.recover(ctx, update.Seq-1)
+		}
+	}
+
+	f.deliver(*update, data)
+}
+
+// wasReset reports whether the canvas sequence went back below the last
+// update delivered, which only a reset does.
+func (f *updateFeed) wasReset(ctx context.Context) bool {
+	current, err := redisClient.Get(ctx, protocol.SeqKey(gridKey)).Uint64()
+	if err != nil {
+		logging.Errorf("Failed to read sequence for an update from before the last one: %v", err)
+		return false
+	}
+
+	return current < f.last
+}
+
+func (f *updateFeed) deliver(update protocol.Update, frame []byte) {
+	// the cache and replica are brought up to date first, so a client added
+	// after this broadcast gets the update in its snapshot
+	cacheFill.observe(update.Seq)
+	localCache.Add(update)
+	canvas.apply(update)
+	f.hub.Broadcast(frame, &update)
+
+	if update.Seq != 0 {
+		f.last, f.lastTime = update.Seq, update.Cell.Time
+	}
+}
+
+// recover delivers the updates after the last one delivered through to, read
+// from the stored buckets placed since it. If those no longer hold every one
+// of them, the replica and every client are resynced instead.
+func (f *updateFeed) recover(ctx context.Context, to uint64) {
+	ctx, cancel := context.WithTimeout(ctx, feedRecoverTimeout)
+	defer cancel()
+
+	from := f.last
+	if to-from <= resumeMaxUpdates && f.replay(ctx, from, to) {
+		feedRecoveries.WithLabelValues(recoveryReplayed).Inc()
+		return
+	}
+
+	logging.Warnf("updates %d to %d missed by the subscription are gone from history, resyncing every client", from+1, to)
+	canvas.resync(ctx)
+	f.hub.resyncAll()
+	f.last, f.lastTime = to, 0
+	feedRecoveries.WithLabelValues(recoveryResynced).Inc()
+}
+
+// replay delivers the updates after from through to if the stored buckets
+// still hold all of them.
+func (f *updateFeed) replay(ctx context.Context, from, to uint64) bool {
+	now := time.Now().UnixMilli()
+	since := max(f.lastTime-applyDelayMargin.Milliseconds(), now-resumeWindow.Milliseconds())
+	missed := updatesAfter(storedUpdates(ctx, since, now, 0), from)
+	if !coversGap(missed, from, to) {
+		return false
+	}
+
+	logging.Infof("replaying updates %d to %d missed by the subscription", from+1, to)
+	for _, update := range missed {
+		if update.Seq > to {
+			break
+		}
+		f.deliver(update, addMsgType(msgTypeUpdate, update.Encode()))
+	}
+
+	return true
+}
@@ -0,0 +1,129 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"backend/internal/protocol"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// fakeSubscription replies with what is queued to it: messages, or errors to
+// fail with.
+type fakeSubscription struct {
+	replies chan interface{}
+	closed  chan struct{}
+}
+
+func newFakeSubscription(replies ...interface{}) *fakeSubscription {
+	s := &fakeSubscription{replies: make(chan interface{}, 16), closed: make(chan struct{})}
+	s.replies <- &redis.Subscription{Kind: "subscribe", Channel: updatesChannel, Count: 1}
+	for _, reply := range replies {
+		s.replies <- reply
+	}
+
+	return s
+}
+
+func (s *fakeSubscription) ReceiveTimeout(ctx context.Context, timeout time.Duration) (interface{}, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case reply := <-s.replies:
+		if err, ok := reply.(error); ok {
+			return nil, err
+		}
+		return reply, nil
+	case <-time.After(timeout):
+		return nil, timeoutError{}
+	}
+}
+
+func (s *fakeSubscription) Ping(context.Context, ...string) error {
+	s.replies <- &redis.Pong{}
+	return nil
+}
+
+func (s *fakeSubscription) Close() error {
+	close(s.closed)
+	return nil
+}
+
+func feedUpdate(seq uint64, now int64) protocol.Update {
+	return protocol.Update{Seq: seq, Cell: protocol.Cell{X: uint16(seq), Y: 1, Color: 2, Time: now}}
+}
+
+func published(update protocol.Update) *redis.Message {
+	return &redis.Message{Channel: updatesChannel, Payload: string(update.Encode())}
+}
+
+// feedFixture sets up the globals a feed delivers to, with history in a
+// Redis stub.
+func feedFixture(t *testing.T) (*updateFeed, *bucketRedis, int64) {
+	localCache = NewCache(defaultCacheBytes)
+	stored := &bucketRedis{buckets: map[string][]string{}}
+	redisClient = stored
+	t.Cleanup(func() { localCache, redisClient, canvas = nil, nil, nil })
+
+	return &updateFeed{hub: newClients(1, 16, policyResync)}, stored, time.Now().UnixMilli()
+}
+
+func TestFeedReplaysHoleFromHistory(t *testing.T) {
+	feed, stored, now := feedFixture(t)
+	// 2 was placed before 1 but applied after it, as the grid's workers may
+	updates := []protocol.Update{feedUpdate(1, now-300), feedUpdate(2, now-1_000), feedUpdate(3, now-100), feedUpdate(4, now)}
+	stored.add(protocol.UpdatesKey(gridKey, epochs.Of(now)), updates...)
+	stored.seq = 4
+
+	feed.handle(context.Background(), updates[0].Encode())
+	feed.handle(context.Background(), updates[3].Encode())
+	feed.handle(context.Background(), updates[2].Encode())
+
+	cached, ok := localCache.After(0)
+	assert.True(t, ok)
+	assert.Equal(t, updates, cached, "2 and 3 replayed in order, and 3 not delivered twice")
+	assert.Equal(t, uint64(4), feed.last)
+	assert.Equal(t, now-300-applyDelayMargin.Milliseconds(), stored.from,
+		"history is read from shortly before the last update delivered")
+}
+
+func TestFeedDeliversUpdatesAfterAReset(t *testing.T) {
+	feed, stored, now := feedFixture(t)
+	conn := newFakeConn()
+	feed.hub.register(conn, peer{})
+	defer conn.Close()
+
+	handle := func(update protocol.Update) {
+		feed.handle(context.Background(), update.Encode())
+		waitDrained(t, feed.hub)
+	}
+
+	handle(feedUpdate(50, now))
+
+	stored.seq = 1
+	reset := feedUpdate(1, now)
+	handle(reset)
+	assert.Equal(t, uint64(1), feed.last, "the sequence went back, so the canvas was reset")
+
+	stored.seq = 2
+	handle(feedUpdate(2, now))
+	handle(reset)
+	assert.Equal(t, uint64(2), feed.last)
+	assert.EqualValues(t, 3, conn.messages.Load(), "a late duplicate of an update already delivered is dropped")
+}
+
+func TestIsTimeout(t *testing.T) {
+	assert.True(t, isTimeout(timeoutError{}))
+	assert.True(t, isTimeout(fmt.Errorf("read: %w", timeoutError{})))
+	assert.False(t, isTimeout(errors.New("connection reset by peer")))
+}
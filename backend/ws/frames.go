@@ -0,0 +1,147 @@
+package ws
+
+import (
+	"backend/internal/protocol"
+)
+
+// These are the binary frames; clients that negotiate jsonSubprotocol get and
+// send the same frames as JSON instead, see text.go.
+//
+// Every frame starts with a message type byte. Frames that carry canvas data
+// follow it with the big-endian sequence number they relate to:
+//
+//	update: [type][seq][encoded cell]
+//	batch:  [type][seq of the first cell][protocol batch of consecutive updates]
+//	chunk:  [type][seq of the last update the snapshot reflects][x u16][y u16][w u16][h u16][chunk bitfield]
+//
+// A snapshot is sent as one chunk frame per chunk, all with the same seq. The
+// single-frame state message is no longer sent; its type stays reserved.
+//
+// Clients that connect with ?encodings=rle may get chunk frames whose type has
+// msgFlagRLE set. Their cells are then a sequence of uvarint(run<<4 | color)
+// covering the chunk row-major.
+//
+// Clients send a subscribe frame to receive only the chunks overlapping a set
+// of viewports, and can resend it whenever their viewport changes:
+//
+//	subscribe: [type][count u8][x u16][y u16][w u16][h u16]...
+//
+// Updates outside the subscribed chunks are left out, so a subscribed client
+// sees gaps in their sequence numbers and can't take one for a missed update.
+//
+// When auth is required, a client refreshes its session before the token it
+// connected with expires by sending a newer token for the same subject:
+//
+//	auth: [type][token]
+//
+// Every few seconds all clients get the viewers connected across pods and the
+// people who placed within the last minute:
+//
+//	presence: [type][viewers u32][active placers u32]
+//
+// Clients that share their cursor send where they point, at most every few
+// tens of milliseconds, or x = y = 0xFFFF to stop sharing:
+//
+//	cursor: [type][x u16][y u16]
+//
+// Clients that connect with ?cursors=1 get the cursors of others in the
+// chunks they are subscribed to, identified by a random id per connection:
+//
+//	cursors: [type][count u16]([id u32][x u16][y u16])...
+//
+// Clients that connect with ?chat=1 get the recent chat history after the
+// canvas, then every message and deletion as they happen. Authors appear by a
+// handle derived from who they are:
+//
+//	chat send:     [type][utf-8 text]                     (client)
+//	chat delete:   [type][id u64]                         (client, moderators only)
+//	chat:          [type][id u64][unix ms u64][handle length u8][handle][utf-8 text]
+//	chat deleted:  [type][id u64]
+//	chat rejected: [type][reason u8]                      (to the author of a refused send or delete)
+//
+// When a pod shuts down its clients get a drain frame, see drain.go, and are
+// closed with CloseServiceRestart after the delay it gives.
+//
+// Types were single bits up to msgTypeAuth; msgFlagRLE takes the last one, so
+// later types use the values in between.
+const (
+	_            uint8 = iota
+	msgTypeState       = 1 << iota
+	msgTypeUpdate
+	msgTypeBatch
+	msgTypeChunk
+	msgTypeSubscribe
+	msgTypeAuth
+
+	msgTypePresence = 3
+	msgTypeCursor   = 5
+	msgTypeCursors  = 6
+
+	msgTypeChatSend     = 7
+	msgTypeChat         = 9
+	msgTypeChatDelete   = 10
+	msgTypeChatDeleted  = 11
+	msgTypeChatRejected = 12
+
+	msgTypeDrain = 13
+
+	msgFlagRLE uint8 = 0x80
+)
+
+// frameName labels a frame by its type for metrics.
+func frameName(msgType uint8) string {
+	name := "unknown"
+	switch msgType &^ msgFlagRLE {
+	case msgTypeUpdate:
+		name = "update"
+	case msgTypeBatch:
+		name = "batch"
+	case msgTypeChunk:
+		name = "chunk"
+	case msgTypePresence:
+		name = "presence"
+	case msgTypeCursors:
+		name = "cursors"
+	case msgTypeChat, msgTypeChatDeleted, msgTypeChatRejected:
+		name = "chat"
+	case msgTypeDrain:
+		name = "drain"
+	}
+
+	if msgType&msgFlagRLE != 0 {
+		return name + "_rle"
+	}
+
+	return name
+}
+
+func addMsgType(msgType uint8, msg []byte) []byte {
+	result := make([]byte, len(msg)+1)
+	result[0] = msgType
+	copy(result[1:], msg)
+	return result
+}
+
+// batchFrames packs updates, sorted by sequence number, into as few batch
+// frames as possible. A frame only covers consecutive sequence numbers, so a
+// client can still track every update it was sent.
+func batchFrames(updates []protocol.Update) [][]byte {
+	frames := make([][]byte, 0, 1)
+	for start := 0; start < len(updates); {
+		end := start + 1
+		for end < len(updates) && updates[end].Seq == updates[end-1].Seq+1 {
+			end++
+		}
+
+		cells := make([]protocol.Cell, 0, end-start)
+		for _, update := range updates[start:end] {
+			cells = append(cells, update.Cell)
+		}
+
+		frame := protocol.AppendSeq([]byte{msgTypeBatch}, updates[start].Seq, protocol.EncodeBatch(cells))
+		frames = append(frames, frame)
+		start = end
+	}
+
+	return frames
+}
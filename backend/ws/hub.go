@@ -0,0 +1,330 @@
+package ws
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"backend/internal/config"
+	"backend/internal/protocol"
+	"backend/logging"
+)
+
+const (
+	defaultShardQueue = 1024
+	inactiveAfter     = 2 * time.Minute
+)
+
+// Clients is the broadcast hub. Connections are spread over shards, each with
+// its own worker, so fan-out runs in parallel and Broadcast only hands a
+// prepared frame to every shard's queue: it never waits on a client, so the
+// Redis subscription is never held up by fan-out.
+type Clients struct {
+	shards []*shard
+	policy slowConsumerPolicy
+	limits *connLimits
+	// totalConns counts the clients connected to this pod
+	totalConns atomic.Int64
+	// pending counts broadcasts queued to shards and not yet fanned out
+	pending   atomic.Int64
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type shard struct {
+	mu      sync.RWMutex
+	clients map[uint64]*Client
+	jobs    chan broadcastJob
+	// overflowed is set when a broadcast couldn't be queued; the shard's
+	// clients missed it and are resynced
+	overflowed atomic.Bool
+}
+
+type broadcastJob struct {
+	frame   outFrame
+	size    int
+	msgType uint8
+	chunk   int
+	topic   topic
+}
+
+// topic is an opt-in feed; jobs of a topic only go to clients following it.
+type topic uint8
+
+const (
+	topicCanvas topic = iota
+	topicCursors
+	topicChat
+)
+
+func (c *Client) follows(t topic) bool {
+	switch t {
+	case topicCursors:
+		return c.cursors.Load()
+	case topicChat:
+		return c.chat.Load()
+	default:
+		return true
+	}
+}
+
+func NewClients() *Clients {
+	c := newClients(
+		config.Int("WS_HUB_SHARDS", runtime.GOMAXPROCS(0)),
+		config.Int("WS_HUB_SHARD_QUEUE", defaultShardQueue),
+		parseSlowConsumerPolicy(config.String("WS_SLOW_CONSUMER_POLICY", string(defaultSlowConsumerPolicy))),
+	)
+	c.limits = newConnLimitsFromEnv()
+
+	return c
+}
+
+func newClients(shards, queue int, policy slowConsumerPolicy) *Clients {
+	c := &Clients{
+		shards: make([]*shard, max(shards, 1)),
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+	for i := range c.shards {
+		c.shards[i] = &shard{
+			clients: make(map[uint64]*Client),
+			jobs:    make(chan broadcastJob, max(queue, 1)),
+		}
+		go c.shards[i].run(c)
+	}
+
+	return c
+}
+
+func (c *Clients) shardOf(id uint64) *shard {
+	return c.shards[id%uint64(len(c.shards))]
+}
+
+// Add registers a connection admitted by the limits Middleware; the slot of
+// its ip is released when the client is removed. Broadcasts to it are held
+// back until startSession calls startBroadcasts.
+func (c *Clients) Add(conn wsConn, p peer) *Client {
+	client := newClient(c, generateClientID(), conn)
+	client.peer = p
+	client.slow.holding = true
+	c.insert(client)
+	go c.readPump(client)
+
+	return client
+}
+
+// register adds a client to its shard without starting its reader.
+func (c *Clients) register(conn wsConn, p peer) *Client {
+	client := newClient(c, generateClientID(), conn)
+	client.peer = p
+	c.insert(client)
+
+	return client
+}
+
+func (c *Clients) insert(client *Client) {
+	s := c.shardOf(client.ID)
+	s.mu.Lock()
+	s.clients[client.ID] = client
+	s.mu.Unlock()
+
+	c.totalConns.Add(1)
+	connectedClients.Inc()
+}
+
+func (c *Clients) remove(cli *Client) {
+	s := c.shardOf(cli.ID)
+	s.mu.Lock()
+	_, ok := s.clients[cli.ID]
+	delete(s.clients, cli.ID)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	c.totalConns.Add(-1)
+	connectedClients.Dec()
+	c.limits.release(cli.ip)
+	cli.stopExpiry()
+	cursors.hide(cli)
+	cli.closePipe()
+	cli.Conn.Close()
+}
+
+// Broadcast sends message to every client subscribed to the chunk of update,
+// or to every client if update is nil.
+func (c *Clients) Broadcast(message []byte, update *protocol.Update) {
+	frame, err := prepareFrame(message)
+	if err != nil {
+		logging.Errorf("failed to create perp msg %v", err)
+		return
+	}
+
+	job := broadcastJob{frame: frame, size: len(message), msgType: message[0], chunk: allChunks}
+	if update != nil {
+		job.chunk = chunks.chunkOf(update.Cell.X, update.Cell.Y)
+		if update.Seq != 0 {
+			job.frame.update = update
+		}
+	}
+
+	c.queue(job)
+}
+
+// broadcastCursors sends a cursor batch to the clients following cursors that
+// are subscribed to chunk. Clients that are behind skip it.
+func (c *Clients) broadcastCursors(message []byte, chunk int) {
+	frame, err := prepareFrame(message)
+	if err != nil {
+		logging.Errorf("failed to prepare cursor frame: %v", err)
+		return
+	}
+	frame.ephemeral = true
+
+	c.queue(broadcastJob{frame: frame, size: len(message), msgType: message[0], chunk: chunk, topic: topicCursors})
+}
+
+// broadcastChat sends a chat frame to every client following chat.
+func (c *Clients) broadcastChat(message []byte) {
+	frame, err := prepareFrame(message)
+	if err != nil {
+		logging.Errorf("failed to prepare chat frame: %v", err)
+		return
+	}
+
+	c.queue(broadcastJob{frame: frame, size: len(message), msgType: message[0], chunk: allChunks, topic: topicChat})
+}
+
+// queue hands a job to every shard without waiting.
+func (c *Clients) queue(job broadcastJob) {
+	for _, s := range c.shards {
+		c.pending.Add(1)
+		select {
+		case s.jobs <- job:
+		default:
+			c.pending.Add(-1)
+			if !s.overflowed.Swap(true) {
+				logging.Warnf("broadcast shard queue full, resyncing its clients")
+			}
+			hubShardOverflows.Inc()
+		}
+	}
+}
+
+func (s *shard) run(c *Clients) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	jobsBuf := make([]broadcastJob, 0, maxWriteBatch)
+	for {
+		select {
+		case job := <-s.jobs:
+			if s.overflowed.Swap(false) {
+				s.resyncAll(c)
+			}
+			// under load take everything queued, so each client is handed
+			// the whole burst and its writer can batch it
+			jobs := append(jobsBuf[:0], job)
+			for len(jobs) < maxWriteBatch && len(s.jobs) > 0 {
+				jobs = append(jobs, <-s.jobs)
+			}
+			s.fanOut(c, jobs)
+			c.pending.Add(-int64(len(jobs)))
+		case <-ticker.C:
+			s.ping(c)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (s *shard) fanOut(c *Clients, jobs []broadcastJob) {
+	start := time.Now()
+	delivered := make([]int, len(jobs))
+
+	for _, cli := range s.snapshot() {
+		r := cli.region.Load()
+		queued := false
+		for i, job := range jobs {
+			if job.chunk != allChunks && !r.has(job.chunk) || !cli.follows(job.topic) {
+				continue
+			}
+			if c.deliver(cli, job.frame) {
+				delivered[i]++
+				queued = true
+			}
+		}
+		if queued {
+			c.startWriter(cli)
+		}
+	}
+
+	broadcastFanout.Observe(time.Since(start).Seconds() / float64(len(jobs)))
+	for i, job := range jobs {
+		frameBytes.WithLabelValues(frameName(job.msgType)).Add(float64(job.size * delivered[i]))
+	}
+}
+
+// resyncAll sends every client a fresh snapshot once its queue has drained.
+func (c *Clients) resyncAll() {
+	for _, s := range c.shards {
+		s.resyncAll(c)
+	}
+}
+
+// resyncAll schedules a fresh snapshot for every client of the shard after it
+// dropped a broadcast.
+func (s *shard) resyncAll(c *Clients) {
+	for _, cli := range s.snapshot() {
+		cli.slowMu.Lock()
+		cli.slow.resyncPending = true
+		cli.slowMu.Unlock()
+		c.startWriter(cli)
+	}
+}
+
+// ping queues a ping to every client of the shard and drops those that
+// haven't answered in a while.
+func (s *shard) ping(c *Clients) {
+	threshold := time.Now().Add(-inactiveAfter).UnixNano()
+	inactive := 0
+
+	for _, cli := range s.snapshot() {
+		if cli.lastPing.Load() < threshold {
+			c.remove(cli)
+			inactive++
+			continue
+		}
+		if cli.enqueue(pingFrame) == nil {
+			c.startWriter(cli)
+		}
+	}
+
+	if inactive > 0 {
+		logging.Infof("cleaned up %d inactive clients", inactive)
+	}
+}
+
+func (s *shard) snapshot() []*Client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	all := make([]*Client, 0, len(s.clients))
+	for _, cli := range s.clients {
+		all = append(all, cli)
+	}
+
+	return all
+}
+
+func (c *Clients) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	for _, s := range c.shards {
+		for _, cli := range s.snapshot() {
+			cli.sendCloseMsg()
+		}
+	}
+
+	return nil
+}
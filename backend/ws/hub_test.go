@@ -0,0 +1,230 @@
+package ws
+
+import (
+	"encoding/binary"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"backend/internal/protocol"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConn stands in for a websocket connection, counting what is written.
+type fakeConn struct {
+	messages  atomic.Int64
+	pings     atomic.Int64
+	closeCode atomic.Int64
+	closed    chan struct{}
+	once      sync.Once
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{closed: make(chan struct{})}
+}
+
+func (f *fakeConn) ReadMessage() (int, []byte, error) {
+	<-f.closed
+	return 0, nil, errors.New("closed")
+}
+func (f *fakeConn) Subprotocol() string               { return "" }
+func (f *fakeConn) SetReadLimit(int64)                {}
+func (f *fakeConn) SetReadDeadline(time.Time) error   { return nil }
+func (f *fakeConn) SetPongHandler(func(string) error) {}
+func (f *fakeConn) SetWriteDeadline(time.Time) error  { return nil }
+func (f *fakeConn) EnableWriteCompression(bool)       {}
+func (f *fakeConn) WritePreparedMessage(*websocket.PreparedMessage) error {
+	f.messages.Add(1)
+	return nil
+}
+func (f *fakeConn) WriteControl(messageType int, data []byte, _ time.Time) error {
+	switch messageType {
+	case websocket.PingMessage:
+		f.pings.Add(1)
+	case websocket.CloseMessage:
+		f.closeCode.Store(int64(binary.BigEndian.Uint16(data)))
+	}
+	return nil
+}
+func (f *fakeConn) Close() error {
+	f.once.Do(func() { close(f.closed) })
+	return nil
+}
+
+// waitDrained waits until every broadcast has been fanned out and every
+// client's writer is idle.
+func waitDrained(tb testing.TB, c *Clients) {
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		if drained(c) {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	tb.Fatal("hub did not drain")
+}
+
+func drained(c *Clients) bool {
+	if c.pending.Load() > 0 {
+		return false
+	}
+	for _, s := range c.shards {
+		for _, cli := range s.snapshot() {
+			if cli.writing.Load() || len(cli.writePipe) > 0 {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func broadcastUpdate(c *Clients, seq uint64, x, y uint16) {
+	update := protocol.Update{Seq: seq, Cell: protocol.Cell{X: x, Y: y, Color: 1, Time: 1760788800000}}
+	c.Broadcast(updateFrame(update), &update)
+}
+
+func TestHubBroadcastReachesEveryShard(t *testing.T) {
+	c := newClients(4, 16, policyDisconnect)
+	defer c.Close()
+
+	conns := make([]*fakeConn, 32)
+	for i := range conns {
+		conns[i] = newFakeConn()
+		c.register(conns[i], peer{})
+	}
+
+	broadcastUpdate(c, 1, 1, 1)
+	waitDrained(t, c)
+
+	for _, conn := range conns {
+		assert.Equal(t, int64(1), conn.messages.Load())
+	}
+}
+
+func TestHubFiltersByRegion(t *testing.T) {
+	c := newClients(1, 16, policyDisconnect)
+	defer c.Close()
+
+	everything := newFakeConn()
+	c.register(everything, peer{})
+	corner := newFakeConn()
+	r := chunks.region([]rect{{X: 0, Y: 0, W: 1, H: 1}})
+	c.register(corner, peer{}).region.Store(&r)
+
+	broadcastUpdate(c, 1, 99, 99)
+	broadcastUpdate(c, 2, 0, 0)
+	waitDrained(t, c)
+
+	assert.Equal(t, int64(1), corner.messages.Load())
+	assert.Positive(t, everything.messages.Load())
+}
+
+func TestWriterBatchesConsecutiveUpdates(t *testing.T) {
+	c := newClients(1, 16, policyDisconnect)
+	defer c.Close()
+
+	conn := newFakeConn()
+	client := c.register(conn, peer{})
+
+	// queue before any writer runs, as a burst would
+	for seq := uint64(1); seq <= 5; seq++ {
+		update := protocol.Update{Seq: seq, Cell: protocol.Cell{X: 1, Y: 1, Color: 1}}
+		frame, err := prepareFrame(updateFrame(update))
+		assert.NoError(t, err)
+		frame.update = &update
+		if seq == 4 {
+			frame.update = nil // a frame that can't be batched splits the run
+		}
+		assert.NoError(t, client.enqueue(frame))
+	}
+
+	c.startWriter(client)
+	waitDrained(t, c)
+
+	// [1 2 3] as a batch, 4 on its own, 5 on its own
+	assert.Equal(t, int64(3), conn.messages.Load())
+}
+
+func TestShardPingsAndDropsInactiveClients(t *testing.T) {
+	c := newClients(1, 16, policyDisconnect)
+	defer c.Close()
+
+	alive := newFakeConn()
+	c.register(alive, peer{})
+	stale := newFakeConn()
+	c.register(stale, peer{}).lastPing.Store(time.Now().Add(-2 * inactiveAfter).UnixNano())
+
+	c.shards[0].ping(c)
+	waitDrained(t, c)
+
+	assert.Equal(t, int64(1), alive.pings.Load())
+	assert.Len(t, c.shards[0].snapshot(), 1)
+	select {
+	case <-stale.closed:
+	default:
+		t.Fatal("stale client should be closed")
+	}
+}
+
+func TestBroadcastDoesNotBlockOnFullShard(t *testing.T) {
+	// no worker drains the shard, so its queue fills up
+	c := &Clients{
+		shards: []*shard{{clients: make(map[uint64]*Client), jobs: make(chan broadcastJob, 1)}},
+		done:   make(chan struct{}),
+	}
+	c.register(newFakeConn(), peer{})
+
+	done := make(chan struct{})
+	go func() {
+		for seq := uint64(1); seq <= 10; seq++ {
+			broadcastUpdate(c, seq, 1, 1)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Broadcast blocked on a full shard")
+	}
+	assert.True(t, c.shards[0].overflowed.Load())
+}
+
+// BenchmarkHubBroadcast100k fans updates out to 100k in-process connections
+// and reports how long each update takes to reach all of them, how long the
+// subscription goroutine spends in Broadcast, and how many websocket messages
+// the writers needed.
+func BenchmarkHubBroadcast100k(b *testing.B) {
+	const conns = 100_000
+
+	c := newClients(runtime.GOMAXPROCS(0), 4096, policyDisconnect)
+	defer c.Close()
+
+	fakes := make([]*fakeConn, conns)
+	for i := range fakes {
+		fakes[i] = newFakeConn()
+		c.register(fakes[i], peer{})
+	}
+
+	var inBroadcast time.Duration
+	b.ResetTimer()
+	for i := range b.N {
+		start := time.Now()
+		broadcastUpdate(c, uint64(i+1), uint16(i%protocol.CanvasSize), 0)
+		inBroadcast += time.Since(start)
+	}
+	waitDrained(b, c)
+	b.StopTimer()
+
+	var messages int64
+	for _, f := range fakes {
+		messages += f.messages.Load()
+	}
+	b.ReportMetric(float64(inBroadcast.Nanoseconds())/float64(b.N), "ns-in-Broadcast/op")
+	b.ReportMetric(float64(messages)/float64(b.N)/conns, "msgs/client/op")
+}
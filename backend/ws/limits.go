@@ -0,0 +1,195 @@
+package ws
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"backend/internal/config"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultMaxConns        = 150_000
+	defaultMaxConnsPerIP   = 64
+	defaultConnBurstPerIP  = 10
+	defaultConnRefill      = time.Second
+	defaultFullRetryAfter  = 5 * time.Second
+	connLimitsSweepPeriod  = time.Minute
+	maxConnRefusalJitterMs = 1000
+)
+
+// refusal says why a connection was turned away; it is the label of
+// connectionsRefused.
+type refusal string
+
+const (
+	admitted        refusal = ""
+	refusedCapacity refusal = "capacity"
+	refusedPerIP    refusal = "per_ip"
+	refusedRate     refusal = "rate"
+	// refusedUnauthorized is counted by the handler, after the limits
+	refusedUnauthorized refusal = "unauthorized"
+	// refusedOrigin is counted by the origin allowlist, ahead of the limits
+	refusedOrigin refusal = "origin"
+	// refusedDraining turns connections away while the pod shuts down
+	refusedDraining refusal = "draining"
+)
+
+// connLimits caps connections to the pod and per client IP, and rate limits
+// new connections per IP with a token bucket, so a reconnect storm after a
+// deploy is refused before the upgrade instead of after it. A zero limit
+// disables that check.
+type connLimits struct {
+	mu         sync.Mutex
+	conns      int
+	ips        map[string]*ipConns
+	maxConns   int
+	maxPerIP   int
+	burst      float64
+	refill     time.Duration
+	retryAfter time.Duration
+	draining   atomic.Bool
+	done       chan struct{}
+}
+
+type ipConns struct {
+	conns  int
+	tokens float64
+	last   time.Time
+}
+
+func newConnLimitsFromEnv() *connLimits {
+	return newConnLimits(
+		config.Int("WS_MAX_CONNS", defaultMaxConns),
+		config.Int("WS_MAX_CONNS_PER_IP", defaultMaxConnsPerIP),
+		config.Int("WS_CONN_BURST_PER_IP", defaultConnBurstPerIP),
+		config.Duration("WS_CONN_REFILL_PER_IP", defaultConnRefill),
+	)
+}
+
+func newConnLimits(maxConns, maxPerIP, burst int, refill time.Duration) *connLimits {
+	return &connLimits{
+		ips:        make(map[string]*ipConns),
+		maxConns:   maxConns,
+		maxPerIP:   maxPerIP,
+		burst:      float64(burst),
+		refill:     refill,
+		retryAfter: defaultFullRetryAfter,
+		done:       make(chan struct{}),
+	}
+}
+
+// acquire takes a connection slot for ip. When it refuses, it also says how
+// long the client should wait before trying again.
+func (l *connLimits) acquire(ip string, now time.Time) (refusal, time.Duration) {
+	if l.draining.Load() {
+		return refusedDraining, drainRetryAfter
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxConns > 0 && l.conns >= l.maxConns {
+		return refusedCapacity, l.retryAfter
+	}
+
+	state := l.ips[ip]
+	if state == nil {
+		state = &ipConns{tokens: l.burst, last: now}
+		l.ips[ip] = state
+	}
+	if l.maxPerIP > 0 && state.conns >= l.maxPerIP {
+		return refusedPerIP, l.retryAfter
+	}
+	if l.burst > 0 && l.refill > 0 {
+		state.tokens = min(l.burst, state.tokens+float64(now.Sub(state.last))/float64(l.refill))
+		state.last = now
+		if state.tokens < 1 {
+			return refusedRate, time.Duration((1 - state.tokens) * float64(l.refill))
+		}
+		state.tokens--
+	}
+
+	state.conns++
+	l.conns++
+
+	return admitted, 0
+}
+
+// startDraining refuses every connection from now on.
+func (l *connLimits) startDraining() {
+	if l != nil {
+		l.draining.Store(true)
+	}
+}
+
+func (l *connLimits) release(ip string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if state := l.ips[ip]; state != nil && state.conns > 0 {
+		state.conns--
+		l.conns--
+	}
+}
+
+func (l *connLimits) runCleanup() {
+	ticker := time.NewTicker(connLimitsSweepPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			l.sweep(now)
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// sweep forgets IPs with no connections whose bucket has refilled, since a
+// fresh entry would start out the same.
+func (l *connLimits) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ip, state := range l.ips {
+		if state.conns == 0 && (l.refill <= 0 || now.Sub(state.last) >= time.Duration(l.burst)*l.refill) {
+			delete(l.ips, ip)
+		}
+	}
+}
+
+func (l *connLimits) Close() error {
+	close(l.done)
+
+	return nil
+}
+
+// Middleware refuses connections over the limits with 503 and Retry-After
+// before the upgrade. The wait is jittered so refused clients don't all come
+// back at once.
+func (l *connLimits) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		reason, wait := l.acquire(c.ClientIP(), time.Now())
+		if reason == admitted {
+			c.Next()
+
+			return
+		}
+
+		connectionsRefused.WithLabelValues(string(reason)).Inc()
+		wait += time.Duration(rand.Intn(maxConnRefusalJitterMs)) * time.Millisecond
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "too many connections, try again later"})
+	}
+}
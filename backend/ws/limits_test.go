@@ -0,0 +1,145 @@
+package ws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"backend/web"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnLimitsCaps(t *testing.T) {
+	l := newConnLimits(3, 2, 0, 0)
+	now := time.Now()
+
+	for range 2 {
+		reason, _ := l.acquire("1.1.1.1", now)
+		assert.Equal(t, admitted, reason)
+	}
+	reason, wait := l.acquire("1.1.1.1", now)
+	assert.Equal(t, refusedPerIP, reason)
+	assert.Equal(t, defaultFullRetryAfter, wait)
+
+	reason, _ = l.acquire("2.2.2.2", now)
+	assert.Equal(t, admitted, reason)
+	reason, _ = l.acquire("3.3.3.3", now)
+	assert.Equal(t, refusedCapacity, reason)
+
+	l.release("1.1.1.1")
+	reason, _ = l.acquire("3.3.3.3", now)
+	assert.Equal(t, admitted, reason, "a released slot can be taken again")
+}
+
+func TestConnLimitsRefuseWhileDraining(t *testing.T) {
+	l := newConnLimits(0, 0, 0, 0)
+	l.startDraining()
+
+	reason, wait := l.acquire("1.1.1.1", time.Now())
+	assert.Equal(t, refusedDraining, reason)
+	assert.Equal(t, drainRetryAfter, wait)
+}
+
+func TestConnLimitsRate(t *testing.T) {
+	l := newConnLimits(0, 0, 2, time.Second)
+	now := time.Now()
+
+	for range 2 {
+		reason, _ := l.acquire("1.1.1.1", now)
+		assert.Equal(t, admitted, reason)
+	}
+	reason, wait := l.acquire("1.1.1.1", now.Add(250*time.Millisecond))
+	assert.Equal(t, refusedRate, reason)
+	assert.Equal(t, 750*time.Millisecond, wait)
+
+	reason, _ = l.acquire("2.2.2.2", now)
+	assert.Equal(t, admitted, reason, "other IPs have buckets of their own")
+
+	reason, _ = l.acquire("1.1.1.1", now.Add(time.Second))
+	assert.Equal(t, admitted, reason, "the bucket refills")
+}
+
+func TestConnLimitsSweep(t *testing.T) {
+	l := newConnLimits(0, 0, 2, time.Second)
+	now := time.Now()
+	l.acquire("1.1.1.1", now)
+	l.acquire("2.2.2.2", now)
+	l.release("2.2.2.2")
+
+	l.sweep(now.Add(time.Second))
+	assert.Len(t, l.ips, 2, "2.2.2.2 hasn't refilled yet")
+
+	l.sweep(now.Add(2 * time.Second))
+	assert.Contains(t, l.ips, "1.1.1.1", "connected IPs are kept")
+	assert.NotContains(t, l.ips, "2.2.2.2")
+}
+
+func TestHubReleasesSlotOnRemove(t *testing.T) {
+	c := newClients(1, 1, policyDisconnect)
+	defer c.Close()
+	c.limits = newConnLimits(1, 0, 0, 0)
+
+	reason, _ := c.limits.acquire("1.1.1.1", time.Now())
+	assert.Equal(t, admitted, reason)
+	client := c.register(newFakeConn(), peer{ip: "1.1.1.1"})
+
+	c.remove(client)
+	c.remove(client)
+	assert.Equal(t, 0, c.limits.conns)
+}
+
+func TestConnLimitsMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := newConnLimits(1, 0, 0, 0)
+
+	r := gin.New()
+	r.GET("/ws", l.Middleware(), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/ws", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, retryAfter, int(defaultFullRetryAfter.Seconds()))
+}
+
+func TestConnLimitsIgnoreSpoofedForwardedFor(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("TRUSTED_PROXIES", "10.42.0.0/16")
+	l := newConnLimits(0, 0, 1, time.Hour)
+
+	var r *gin.Engine
+	web.NewServer(web.WithGinEngine(func(engine *gin.Engine) {
+		engine.GET("/ws", l.Middleware(), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+		r = engine
+	}))
+
+	connect := func(remoteAddr, forwardedFor string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/ws", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, connect("203.0.113.7:1000", "1.1.1.1"))
+	assert.Equal(t, http.StatusServiceUnavailable, connect("203.0.113.7:1001", "2.2.2.2"),
+		"a direct client can't pick its own IP")
+
+	assert.Equal(t, http.StatusOK, connect("10.42.0.5:1000", "3.3.3.3, 198.51.100.1"))
+	assert.Equal(t, http.StatusServiceUnavailable, connect("10.42.0.5:1001", "4.4.4.4, 198.51.100.1"),
+		"behind the ingress, only the address it saw counts")
+}
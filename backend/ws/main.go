@@ -1,12 +1,19 @@
 package ws
 
 import (
+	"cmp"
+	"compress/flate"
 	"context"
 	"fmt"
 	"net/http"
 	"os"
+	"slices"
+	"sync"
 	"time"
 
+	"backend/internal/config"
+	"backend/internal/protocol"
+	"backend/internal/token"
 	"backend/logging"
 	"backend/web"
 	"github.com/gin-gonic/gin"
@@ -15,97 +22,225 @@ import (
 )
 
 const (
-	_            uint8 = iota
-	msgTypeState       = 1 << iota
-	msgTypeUpdate
-
 	redisRetryAttempts = 3
 	redisRetryDelay    = 500 * time.Millisecond
+
+	defaultStateSendTimeout   = 30 * time.Second
+	defaultCompressionMinSize = 256
+	// defaultApplyDelayMargin matches how far behind the grid consumer may
+	// fall before it reports not ready
+	defaultApplyDelayMargin = 30 * time.Second
 )
 
 var (
 	upgrader = websocket.Upgrader{
+		// origins.Middleware has already refused and counted these
 		CheckOrigin: func(r *http.Request) bool {
-			return true
+			return origins.allowed(r)
 		},
+		// in order of preference; a client offering none of the formats
+		// gets binary frames
+		Subprotocols:    []string{jsonSubprotocol, binarySubprotocol, bearerSubprotocol},
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
+		// idle connections hand their write buffer back between writes
+		WriteBufferPool:   &sync.Pool{},
+		EnableCompression: config.Bool("WS_COMPRESSION", true),
 	}
-	gridKey = os.Getenv("REDIS_GRID_KEY")
+	// compressionLevel trades CPU for bandwidth on deflated frames
+	compressionLevel = config.Int("WS_COMPRESSION_LEVEL", flate.BestSpeed)
+	// compressionMinSize is the smallest frame worth deflating. Messages are
+	// compressed independently, so small ones grow; see BenchmarkWireBytes.
+	compressionMinSize = config.Int("WS_COMPRESSION_MIN_SIZE", defaultCompressionMinSize)
+	gridKey            = os.Getenv("REDIS_GRID_KEY")
+	epochs             = protocol.NewEpochs(config.Duration(protocol.BucketLengthEnvVar, protocol.DefaultBucketLength))
+
+	// stateSendTimeout bounds how long a client may take to receive a snapshot
+	stateSendTimeout = config.Duration("WS_STATE_SEND_TIMEOUT", defaultStateSendTimeout)
 
 	clients     = NewClients()
 	redisClient redis.UniversalClient
 	localCache  *Cache
+	cacheFill   *cacheFiller
+	canvas      *replica
 )
 
 func Run() {
+	if authRequired {
+		var err error
+		if tokens, err = token.FromEnv(); err != nil {
+			logging.Fatalf("WS_AUTH_REQUIRED is set: %v", err)
+		}
+	}
+
 	ginEngine := web.WithGinEngine(func(r *gin.Engine) {
-		r.GET("/ws", handleWebSocket)
+		r.GET("/ws", origins.Middleware(), clients.limits.Middleware(), handleWebSocket)
+		r.GET(eventsRoute, origins.Middleware(), clients.limits.Middleware(), handleEvents)
 	})
-	localCache = NewCache(5)
-	go localCache.runCleanup()
+	localCache = NewCache(config.Int("WS_CACHE_BYTES", defaultCacheBytes))
+	cacheFill = newCacheFiller()
+	canvas = newReplica()
+	go clients.limits.runCleanup()
 	redisClient = web.DefaultRedis()
+	viewers := newPresence(redisClient, clients)
+	cursors = newCursorFeed(redisClient, clients)
+	chat = newChatRoom(redisClient, clients)
 	server := web.NewServer(
 		web.WithRedis(redisClient),
 		ginEngine,
-		web.WithBackgroundWorker(func(ctx context.Context) {
-			consumer(ctx, redisClient)
-		}),
+		web.WithBackgroundWorker(newUpdateFeed(redisClient, clients).Run),
+		web.WithBackgroundWorker(cacheFill.Run),
+		web.WithBackgroundWorker(canvas.Run),
+		web.WithBackgroundWorker(viewers.Run),
+		web.WithBackgroundWorker(cursors.Run),
+		web.WithBackgroundWorker(chat.Run),
 	)
+	server.RegisterHealthCheck(cacheFill.ready)
+	server.RegisterDrainHook(clients.Drain)
+	server.RegisterShutdownHook(viewers)
 	server.RegisterShutdownHook(clients)
-	server.RegisterShutdownHook(localCache)
+	server.RegisterShutdownHook(clients.limits)
 
 	server.Run()
 }
 
 func handleWebSocket(c *gin.Context) {
+	claims, ok := admitToken(c)
+	if !ok {
+		return
+	}
+
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		logging.Errorf("Upgrade error: %v", err)
+		clients.limits.release(c.ClientIP())
 		return
 	}
+	if err = conn.SetCompressionLevel(compressionLevel); err != nil {
+		logging.Warnf("invalid compression level %d: %v", compressionLevel, err)
+	}
 
-	client := clients.Add(conn)
-	if client == nil {
-		logging.Errorf("Failed to add client - worker pool full")
-		conn.Close()
-		return
+	startSession(c, clients.Add(conn, peerOf(c, claims)), claims)
+}
+
+// admitToken authenticates a connection admitted by the limits Middleware,
+// refusing it with 401 and giving back its slot if the token is missing or
+// invalid.
+func admitToken(c *gin.Context) (*token.Claims, bool) {
+	claims, err := authenticate(c.Request)
+	if err != nil {
+		logging.Debugf("refusing unauthenticated connection: %v", err)
+		connectionsRefused.WithLabelValues(string(refusedUnauthorized)).Inc()
+		clients.limits.release(c.ClientIP())
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+		return nil, false
 	}
 
-	sendLatestStateAndUpdates(client)
+	return claims, true
 }
-func consumer(ctx context.Context, cli redis.UniversalClient) {
 
-	pubsub := cli.Subscribe(context.Background(), "grid_updates_brd")
+// peerOf describes the other end of a request, with the token subject when
+// auth is required.
+func peerOf(c *gin.Context, claims *token.Claims) peer {
+	p := peer{ip: c.ClientIP()}
+	if claims != nil {
+		p.Subject = claims.Subject
+	}
 
-	for msg := range pubsub.Channel() {
-		select {
-		case <-ctx.Done():
+	return p
+}
+
+// startSession applies the options of a newly connected client and sends it
+// the canvas, or only what it missed when it resumes. The chat history, if it
+// asked for chat, comes after.
+func startSession(c *gin.Context, client *Client, claims *token.Claims) {
+	if claims != nil {
+		clients.expireAt(client, time.Unix(claims.ExpiresAt, 0))
+	}
+
+	client.rle.Store(acceptsEncoding(c, encodingRLE))
+	client.cursors.Store(cursors != nil && wantsCursors(c))
+	client.chat.Store(chat != nil && wantsChat(c))
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), stateSendTimeout)
+		defer cancel()
+		chat.sendHistory(ctx, client)
+	}()
+
+	if viewports, ok := viewportsFrom(c); ok {
+		r := chunks.region(viewports)
+		client.region.Store(&r)
+	}
+
+	if since, ok := resumeFrom(c); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), stateSendTimeout)
+		defer cancel()
+		if resumeSession(ctx, client, since) {
 			return
-		default:
 		}
-		data := addMsgType(msgTypeUpdate, []byte(msg.Payload))
-		logging.Debugf("got a new message, broadcasting it")
-		clients.Broadcast(data)
-		cacheKey := fmt.Sprintf("%s:updates:%d", gridKey, getCurrentEpoch())
-		localCache.Update(cacheKey, data)
 	}
 
+	client.hub.startBroadcasts(client, nil)
+	sendLatestStateAndUpdates(client)
+}
+
+func decodeUpdate(payload []byte) (*protocol.Update, error) {
+	update, err := protocol.DecodeUpdate(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	cellPayload := payload
+	if update.Seq != 0 {
+		cellPayload = payload[protocol.SeqSize:]
+	}
+	if version, _ := protocol.Version(cellPayload); version == protocol.VersionLegacy {
+		// legacy timestamps wrap; entries still in flight from before the
+		// format change are recent, so unwrap them around the current time
+		update.Cell.Time = protocol.UnwrapLegacyTime(update.Cell.Time, time.Now().UnixMilli())
+	}
+
+	return update, nil
 }
 
-func getCurrentEpoch() int64 {
-	epoch := time.Now().UnixMilli() / 60_000
-	return epoch
+// latestState reads the canvas together with the sequence number of the last
+// update applied to it.
+func latestState(ctx context.Context) (string, uint64, error) {
+	var stateCmd *redis.StringCmd
+	var seqCmd *redis.StringCmd
+	_, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		stateCmd = pipe.Get(ctx, gridKey)
+		seqCmd = pipe.Get(ctx, protocol.SeqKey(gridKey))
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return "", 0, err
+	}
+
+	state, err := stateCmd.Result()
+	if err != nil {
+		return "", 0, err
+	}
+
+	seq, err := seqCmd.Uint64()
+	if err != nil && err != redis.Nil {
+		return "", 0, err
+	}
+
+	return state, seq, nil
 }
 
+// sendLatestStateAndUpdates streams a snapshot to the client chunk by chunk
+// through its write pump, followed by the updates applied while it was read.
 func sendLatestStateAndUpdates(client *Client) {
-	ctx := context.Background()
-	epoch := getCurrentEpoch()
+	ctx, cancel := context.WithTimeout(context.Background(), stateSendTimeout)
+	defer cancel()
 
-	var state string
+	var state []byte
+	var seq uint64
 	var err error
 	for i := 0; i < redisRetryAttempts; i++ {
-		state, err = redisClient.Get(ctx, gridKey).Result()
+		state, seq, err = canvasState(ctx)
 		if err == nil {
 			break
 		}
@@ -122,48 +257,83 @@ func sendLatestStateAndUpdates(client *Client) {
 		return
 	}
 
-	data := addMsgType(msgTypeState, []byte(state))
-	err = client.sendRaw(data)
-	if err != nil {
-		logging.Errorf("Client %d queue full when sending state", client.ID)
-		return
+	start := time.Now()
+	for _, chunk := range client.stateChunks() {
+		if err = client.queueWait(ctx, chunks.chunkFrame(seq, state, chunk, client.rle.Load())); err != nil {
+			logging.Errorf("Failed sending state to client %d: %v", client.ID, err)
+			return
+		}
 	}
+	stateSendDuration.Observe(time.Since(start).Seconds())
 
-	updates := make([][]byte, 0)
-	cacheKey := fmt.Sprintf("%s:updates:%d", gridKey, epoch)
-	if cachedUpdates, ok := localCache.Get(cacheKey); ok {
-		updates = append(updates, cachedUpdates...)
+	// updates applied after the snapshot was read may already be in flight to
+	// the client; send any that landed in between from history
+	newer, ok := localCache.After(seq)
+	if !ok {
+		newer = updatesAfter(recentUpdates(ctx, time.Now().UnixMilli()), seq)
+	}
+	for _, frame := range batchFrames(client.inRegion(newer)) {
+		if err = client.queueWait(ctx, frame); err != nil {
+			logging.Errorf("Failed sending updates to client %d: %v", client.ID, err)
+			return
+		}
 	}
+}
 
-	// If no cached updates, try Redis
-	if len(updates) == 0 {
-		redisUpdates, err := redisClient.ZRangeByScore(ctx, cacheKey, &redis.ZRangeBy{
-			Min: "-inf",
-			Max: "+inf",
-		}).Result()
+// updatesAfter returns the updates with a sequence number above seq, in
+// sequence order.
+func updatesAfter(updates []protocol.Update, seq uint64) []protocol.Update {
+	newer := make([]protocol.Update, 0, len(updates))
+	for _, update := range updates {
+		if update.Seq > seq {
+			newer = append(newer, update)
+		}
+	}
+	slices.SortFunc(newer, func(a, b protocol.Update) int {
+		return cmp.Compare(a.Seq, b.Seq)
+	})
+
+	return newer
+}
+
+// recentUpdates returns the updates placed within one bucket length before
+// now. That window usually straddles a bucket boundary, so both buckets are
+// read.
+func recentUpdates(ctx context.Context, now int64) []protocol.Update {
+	return storedUpdates(ctx, now-epochs.Length().Milliseconds(), now, 0)
+}
+
+// applyDelayMargin widens reads of stored updates that start from the time
+// of an update already seen. The grid service applies stream entries on
+// several workers, so an update can get its sequence number after one placed
+// later than it.
+var applyDelayMargin = config.Duration("WS_APPLY_DELAY_MARGIN", defaultApplyDelayMargin)
+
+// storedUpdates reads the updates placed in [from, to] from every bucket in
+// Redis the interval overlaps, oldest first and at most limit of them unless
+// limit is 0.
+func storedUpdates(ctx context.Context, from, to int64, limit int64) []protocol.Update {
+	updates := make([]protocol.Update, 0)
 
+	for _, epoch := range epochs.Span(from, to) {
+		opt := &redis.ZRangeBy{Min: fmt.Sprint(from), Max: fmt.Sprint(to)}
+		if limit > 0 {
+			opt.Count = limit - int64(len(updates))
+		}
+		stored, err := redisClient.ZRangeByScore(ctx, protocol.UpdatesKey(gridKey, epoch), opt).Result()
 		if err != nil && err != redis.Nil {
 			logging.Errorf("Error getting updates: %v", err)
-		} else {
-			for _, update := range redisUpdates {
-				updates = append(updates, []byte(update))
+			continue
+		}
+		for _, member := range stored {
+			if update, err := decodeUpdate([]byte(member)); err == nil {
+				updates = append(updates, *update)
 			}
 		}
-	}
-
-	for _, update := range updates {
-		data = addMsgType(msgTypeUpdate, update)
-		err = client.sendRaw(data)
-		if err != nil {
-			logging.Errorf("Client %d queue full when sending state", client.ID)
-			return
+		if limit > 0 && int64(len(updates)) >= limit {
+			break
 		}
 	}
-}
 
-func addMsgType(msgType uint8, msg []byte) []byte {
-	result := make([]byte, len(msg)+1)
-	result[0] = msgType
-	copy(result[1:], msg)
-	return result
+	return updates
 }
@@ -0,0 +1,63 @@
+package ws
+
+import (
+	"context"
+	"testing"
+
+	"backend/internal/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func updateFrame(update protocol.Update) []byte {
+	return addMsgType(msgTypeUpdate, update.Encode())
+}
+
+func TestRecentUpdatesStraddlesBucketBoundary(t *testing.T) {
+	stored := &bucketRedis{buckets: map[string][]string{}}
+	redisClient = stored
+	defer func() { redisClient = nil }()
+
+	bucket := epochs.Current()
+	boundary := epochs.Start(bucket)
+	now := boundary + 20_000
+
+	tooOld := protocol.Update{Seq: 1, Cell: protocol.Cell{X: 1, Y: 2, Color: 3, Time: now - epochs.Length().Milliseconds() - 1}}
+	previous := protocol.Update{Seq: 2, Cell: protocol.Cell{X: 4, Y: 5, Color: 6, Time: boundary - 5_000}}
+	current := protocol.Update{Seq: 3, Cell: protocol.Cell{X: 7, Y: 8, Color: 9, Time: boundary + 10_000}}
+	later := protocol.Update{Seq: 4, Cell: protocol.Cell{X: 1, Y: 1, Color: 1, Time: now + 1}}
+
+	stored.add(protocol.UpdatesKey(gridKey, bucket-1), tooOld, previous)
+	stored.add(protocol.UpdatesKey(gridKey, bucket), current, later)
+
+	updates := recentUpdates(context.Background(), now)
+
+	assert.Equal(t, []protocol.Update{previous, current}, updates)
+	assert.Equal(t, []protocol.Update{tooOld, previous}, storedUpdates(context.Background(), tooOld.Cell.Time, now, 2),
+		"a limited read keeps the oldest updates and skips the rest of the buckets")
+}
+
+func TestUpdatesAfter(t *testing.T) {
+	updates := []protocol.Update{{Seq: 12}, {Seq: 9}, {Seq: 10}, {Seq: 11}}
+
+	assert.Equal(t, []protocol.Update{{Seq: 11}, {Seq: 12}}, updatesAfter(updates, 10))
+	assert.Empty(t, updatesAfter(updates, 12))
+}
+
+func TestBatchFramesSplitOnSequenceGaps(t *testing.T) {
+	cell := protocol.Cell{X: 1, Y: 1, Color: 1, Time: 1760788800000}
+	updates := []protocol.Update{{Seq: 5, Cell: cell}, {Seq: 6, Cell: cell}, {Seq: 9, Cell: cell}}
+
+	frames := batchFrames(updates)
+	assert.Len(t, frames, 2)
+
+	for i, expected := range []struct {
+		seq   byte
+		cells int
+	}{{seq: 5, cells: 2}, {seq: 9, cells: 1}} {
+		assert.Equal(t, uint8(msgTypeBatch), frames[i][0])
+		assert.Equal(t, expected.seq, frames[i][protocol.SeqSize])
+		cells, err := protocol.DecodeBatch(frames[i][1+protocol.SeqSize:])
+		assert.NoError(t, err)
+		assert.Len(t, cells, expected.cells)
+	}
+}
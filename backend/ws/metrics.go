@@ -0,0 +1,160 @@
+package ws
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	connectedClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ws_connected_clients",
+		Help: "WebSocket clients currently connected to this pod.",
+	})
+
+	connectionsRefused = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_connections_refused_total",
+		Help: "Connections refused before the upgrade, by the limit they hit, their origin, or a missing or invalid token.",
+	}, []string{"reason"})
+
+	broadcastFanout = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ws_broadcast_fanout_seconds",
+		Help:    "Time for a hub shard to hand a broadcast message to each of its clients.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 14),
+	})
+
+	hubShardOverflows = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ws_hub_shard_overflows_total",
+		Help: "Broadcasts a hub shard dropped because its queue was full; its clients are resynced.",
+	})
+
+	writeBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ws_write_batch_updates",
+		Help:    "Queued frames sent to a client as one websocket message.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 7),
+	})
+
+	slowConsumerEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_slow_consumer_events_total",
+		Help: "What happened to broadcasts and clients whose write queue was full, by outcome.",
+	}, []string{"outcome"})
+
+	cacheEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ws_cache_entries",
+		Help: "Updates held in the local catch-up cache.",
+	})
+	cacheCapacityBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ws_cache_capacity_bytes",
+		Help: "Memory allocated to the local catch-up cache.",
+	})
+	cacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ws_cache_evictions_total",
+		Help: "Updates dropped from the local catch-up cache to make room for newer ones.",
+	})
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_cache_lookups_total",
+		Help: "Catch-up lookups in the local cache, by whether it held every update asked for.",
+	}, []string{"result"})
+	cacheBackfilled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_cache_backfilled_updates_total",
+		Help: "Updates read from Redis into the local catch-up cache, by whether at startup or to fill a gap.",
+	}, []string{"reason"})
+
+	replicaChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_replica_syncs_total",
+		Help: "Syncs of the local canvas replica with Redis, by outcome: seeded, matched, diverged, replaced while updates were in flight, or a gap that forced one.",
+	}, []string{"result"})
+	stateReads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_state_reads_total",
+		Help: "Canvas snapshots read for clients, by whether they came from the local replica or Redis.",
+	}, []string{"source"})
+
+	sessionResumes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_session_resumes_total",
+		Help: "Reconnects asking to resume, by whether missed updates or a full state were sent.",
+	}, []string{"result"})
+
+	stateSendDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ws_state_send_seconds",
+		Help:    "Time to queue a full snapshot to a client, paced by its connection.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+	})
+
+	frameBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_frame_bytes_total",
+		Help: "Bytes of frames queued to clients before permessage-deflate, by frame type and encoding.",
+	}, []string{"frame"})
+
+	subscriptionChanges = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ws_subscription_changes_total",
+		Help: "Region subscriptions received from clients.",
+	})
+
+	cursorsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ws_cursors_dropped_total",
+		Help: "Cursor frames dropped for arriving faster than a client's allowed rate.",
+	})
+
+	drainedClients = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ws_drained_clients_total",
+		Help: "Clients closed by this pod while draining before shutdown, having not reconnected elsewhere first.",
+	})
+
+	feedResubscribes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ws_feed_resubscribes_total",
+		Help: "Times the Redis subscription to updates was lost and set up again.",
+	})
+	feedRecoveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_feed_recoveries_total",
+		Help: "Holes in the update subscription, by whether they were replayed from history or every client was resynced.",
+	}, []string{"result"})
+
+	sseConnections = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ws_sse_connections_total",
+		Help: "Clients that connected to the events endpoint instead of a websocket.",
+	})
+
+	chatMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_chat_messages_total",
+		Help: "Chat messages from clients of this pod, by whether they were sent, refused, or deleted by a moderator.",
+	}, []string{"result"})
+
+	tokenRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_token_refreshes_total",
+		Help: "In-band token refreshes, by whether the session was extended.",
+	}, []string{"result"})
+
+	sessionsExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ws_sessions_expired_total",
+		Help: "Sessions closed because their token expired without a refresh.",
+	})
+)
+
+const (
+	cacheHit  = "hit"
+	cacheMiss = "miss"
+
+	cacheFillWarmup = "warmup"
+	cacheFillGap    = "gap"
+
+	replicaSeeded   = "seeded"
+	replicaMatched  = "matched"
+	replicaDiverged = "diverged"
+	replicaReplaced = "replaced"
+	replicaGap      = "gap"
+
+	stateFromReplica = "replica"
+	stateFromRedis   = "redis"
+
+	recoveryReplayed = "replayed"
+	recoveryResynced = "resynced"
+
+	resumeResumed   = "resumed"
+	resumeFullState = "full_state"
+
+	refreshAccepted = "accepted"
+	refreshRejected = "rejected"
+
+	chatResultSent     = "sent"
+	chatResultRejected = "rejected"
+	chatResultDeleted  = "deleted"
+)
@@ -0,0 +1,109 @@
+package ws
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"backend/internal/config"
+	"backend/logging"
+	"github.com/gin-gonic/gin"
+)
+
+var origins = newOriginAllowlist(config.String("WS_ALLOWED_ORIGINS", ""))
+
+// originAllowlist decides which pages may open a websocket, so another site
+// can't ride a visitor's session. Entries are origins such as
+// https://grid.example.com, or https://*.example.com for any subdomain; an
+// entry without a scheme matches any scheme. "*" allows every origin and is
+// meant for development. An empty list allows only the host itself.
+type originAllowlist struct {
+	any     bool
+	entries []originPattern
+}
+
+type originPattern struct {
+	scheme string
+	host   string
+	// wildcard matches subdomains of host, not host itself
+	wildcard bool
+}
+
+func newOriginAllowlist(list string) *originAllowlist {
+	a := &originAllowlist{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			a.any = true
+			continue
+		}
+
+		var p originPattern
+		if scheme, host, ok := strings.Cut(entry, "://"); ok {
+			p.scheme, entry = scheme, host
+		}
+		p.host, p.wildcard = strings.CutPrefix(strings.TrimSuffix(entry, "/"), "*.")
+		a.entries = append(a.entries, p)
+	}
+
+	if a.any {
+		logging.Warnf("websocket upgrades are allowed from any origin")
+	}
+
+	return a
+}
+
+// allowed reports whether the upgrade request r may proceed. Requests without
+// an Origin header don't come from a browser page and are let through.
+func (a *originAllowlist) allowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || a.any {
+		return true
+	}
+
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if len(a.entries) == 0 {
+		return strings.EqualFold(u.Host, r.Host)
+	}
+
+	for _, p := range a.entries {
+		if p.matches(u.Scheme, u.Host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p originPattern) matches(scheme, host string) bool {
+	if p.scheme != "" && p.scheme != scheme {
+		return false
+	}
+	if p.wildcard {
+		return strings.HasSuffix(host, "."+p.host)
+	}
+
+	return host == p.host
+}
+
+// Middleware refuses upgrades from origins off the allowlist with 403, ahead
+// of the connection limits.
+func (a *originAllowlist) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if a.allowed(c.Request) {
+			c.Next()
+
+			return
+		}
+
+		logging.Warnf("refusing websocket upgrade from origin %q", c.GetHeader("Origin"))
+		connectionsRefused.WithLabelValues(string(refusedOrigin)).Inc()
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "origin not allowed"})
+	}
+}
@@ -0,0 +1,70 @@
+package ws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func originRequest(host, origin string) *http.Request {
+	req, _ := http.NewRequest(http.MethodGet, "http://"+host+"/ws", nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+
+	return req
+}
+
+func TestOriginAllowlist(t *testing.T) {
+	a := newOriginAllowlist("https://grid.example.com, https://*.example.org, *.example.net")
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{origin: "", allowed: true},
+		{origin: "https://grid.example.com", allowed: true},
+		{origin: "https://GRID.example.com", allowed: true},
+		{origin: "http://grid.example.com", allowed: false},
+		{origin: "https://evil.example.com", allowed: false},
+		{origin: "https://a.b.example.org", allowed: true},
+		{origin: "https://example.org", allowed: false},
+		{origin: "https://evilexample.org", allowed: false},
+		{origin: "http://app.example.net", allowed: true},
+		{origin: "null", allowed: false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.allowed, a.allowed(originRequest("ws.internal", tt.origin)), tt.origin)
+	}
+}
+
+func TestOriginAllowlistDefaultsToSameOrigin(t *testing.T) {
+	a := newOriginAllowlist("")
+
+	assert.True(t, a.allowed(originRequest("grid.example.com", "https://grid.example.com")))
+	assert.False(t, a.allowed(originRequest("grid.example.com", "https://evil.example.com")))
+}
+
+func TestOriginAllowlistDevMode(t *testing.T) {
+	assert.True(t, newOriginAllowlist("*").allowed(originRequest("localhost:8082", "http://localhost:3000")))
+}
+
+func TestOriginMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ws", newOriginAllowlist("https://grid.example.com").Middleware(), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, originRequest("ws.internal", "https://evil.example.com"))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, originRequest("ws.internal", "https://grid.example.com"))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,126 @@
+package ws
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+
+	"backend/internal/config"
+	"backend/internal/protocol"
+	"backend/logging"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	defaultPresenceInterval = 5 * time.Second
+	// viewerCountTTL is how many intervals a pod's count is trusted without a
+	// fresh report
+	viewerCountTTL = 3
+)
+
+// presence reports this pod's connections to Redis, adds up every pod's, and
+// broadcasts the totals to all clients.
+type presence struct {
+	rdb      redis.UniversalClient
+	hub      *Clients
+	pod      string
+	interval time.Duration
+}
+
+func newPresence(rdb redis.UniversalClient, hub *Clients) *presence {
+	pod, err := os.Hostname()
+	if err != nil {
+		pod = fmt.Sprintf("ws-%d", generateClientID())
+	}
+
+	return &presence{
+		rdb:      rdb,
+		hub:      hub,
+		pod:      pod,
+		interval: config.Duration("WS_PRESENCE_INTERVAL", defaultPresenceInterval),
+	}
+}
+
+func (p *presence) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			viewers, placers, err := p.report(ctx, now)
+			if err != nil {
+				logging.Errorf("failed to report presence: %v", err)
+				continue
+			}
+			p.hub.Broadcast(presenceFrame(viewers, placers), nil)
+		}
+	}
+}
+
+// report publishes this pod's count and returns the viewers of every pod and
+// the placers active within protocol.PlacerWindow.
+func (p *presence) report(ctx context.Context, now time.Time) (int64, int64, error) {
+	own := protocol.ViewerCount{Conns: p.hub.totalConns.Load(), ReportedAt: now}
+	since := now.Add(-protocol.PlacerWindow).UnixMilli()
+
+	var counts *redis.StringStringMapCmd
+	var placers *redis.IntCmd
+	_, err := p.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, protocol.ViewersKey, p.pod, own.Encode())
+		counts = pipe.HGetAll(ctx, protocol.ViewersKey)
+		pipe.ZRemRangeByScore(ctx, protocol.PlacersKey, "-inf", fmt.Sprint(since-1))
+		placers = pipe.ZCard(ctx, protocol.PlacersKey)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	viewers, stale := sumViewers(counts.Val(), now.Add(-viewerCountTTL*p.interval))
+	if len(stale) > 0 {
+		// a pod that died without cleaning up
+		if err = p.rdb.HDel(ctx, protocol.ViewersKey, stale...).Err(); err != nil {
+			logging.Warnf("failed to drop stale viewer counts: %v", err)
+		}
+	}
+
+	return viewers, placers.Val(), nil
+}
+
+// sumViewers adds up the counts reported after threshold and returns the pods
+// whose counts are older or unreadable.
+func sumViewers(counts map[string]string, threshold time.Time) (int64, []string) {
+	var viewers int64
+	var stale []string
+	for pod, raw := range counts {
+		count, err := protocol.DecodeViewerCount(raw)
+		if err != nil || count.ReportedAt.Before(threshold) {
+			stale = append(stale, pod)
+			continue
+		}
+		viewers += count.Conns
+	}
+
+	return viewers, stale
+}
+
+// Close withdraws this pod's count so it stops being added up right away.
+func (p *presence) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	return p.rdb.HDel(ctx, protocol.ViewersKey, p.pod).Err()
+}
+
+func presenceFrame(viewers, placers int64) []byte {
+	frame := make([]byte, 1, 9)
+	frame[0] = msgTypePresence
+	frame = binary.BigEndian.AppendUint32(frame, uint32(min(viewers, 1<<32-1)))
+
+	return binary.BigEndian.AppendUint32(frame, uint32(min(placers, 1<<32-1)))
+}
@@ -0,0 +1,47 @@
+package ws
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"backend/internal/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSumViewersSkipsStalePods(t *testing.T) {
+	now := time.Now()
+	counts := map[string]string{
+		"ws-a":    protocol.ViewerCount{Conns: 10, ReportedAt: now}.Encode(),
+		"ws-b":    protocol.ViewerCount{Conns: 5, ReportedAt: now.Add(-time.Second)}.Encode(),
+		"ws-dead": protocol.ViewerCount{Conns: 7, ReportedAt: now.Add(-time.Minute)}.Encode(),
+		"ws-bad":  "nope",
+	}
+
+	viewers, stale := sumViewers(counts, now.Add(-15*time.Second))
+	assert.EqualValues(t, 15, viewers)
+	assert.ElementsMatch(t, []string{"ws-dead", "ws-bad"}, stale)
+}
+
+func TestPresenceFrame(t *testing.T) {
+	frame := presenceFrame(1234, 56)
+
+	assert.Len(t, frame, 9)
+	assert.Equal(t, uint8(msgTypePresence), frame[0])
+	assert.EqualValues(t, 1234, binary.BigEndian.Uint32(frame[1:]))
+	assert.EqualValues(t, 56, binary.BigEndian.Uint32(frame[5:]))
+	assert.Equal(t, "presence", frameName(frame[0]))
+}
+
+func TestHubCountsLiveConnections(t *testing.T) {
+	c := newClients(2, 1, policyDisconnect)
+	defer c.Close()
+
+	first := c.register(newFakeConn(), peer{})
+	c.register(newFakeConn(), peer{})
+	assert.EqualValues(t, 2, c.totalConns.Load())
+
+	c.remove(first)
+	c.remove(first)
+	assert.EqualValues(t, 1, c.totalConns.Load())
+}
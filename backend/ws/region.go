@@ -0,0 +1,243 @@
+package ws
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"backend/internal/protocol"
+)
+
+const (
+	defaultChunkSize = 32
+	rectSize         = 8
+)
+
+var (
+	ErrMalformedSubscribe = errors.New("malformed subscribe message")
+	errMalformedRuns      = errors.New("malformed color runs")
+)
+
+// chunkGrid divides the canvas into square chunks, the unit clients subscribe
+// to. Chunks on the right and bottom edges are clipped to the canvas.
+type chunkGrid struct {
+	canvas uint16
+	size   uint16
+}
+
+func newChunkGrid(canvas uint16, size int) chunkGrid {
+	if size <= 0 || size > int(canvas) {
+		size = int(canvas)
+	}
+
+	return chunkGrid{canvas: canvas, size: uint16(size)}
+}
+
+func (g chunkGrid) perRow() int {
+	return (int(g.canvas) + int(g.size) - 1) / int(g.size)
+}
+
+func (g chunkGrid) count() int {
+	return g.perRow() * g.perRow()
+}
+
+func (g chunkGrid) chunkOf(x, y uint16) int {
+	return int(y/g.size)*g.perRow() + int(x/g.size)
+}
+
+// bounds returns the origin and size in cells of a chunk.
+func (g chunkGrid) bounds(chunk int) (x, y, w, h uint16) {
+	x = uint16(chunk%g.perRow()) * g.size
+	y = uint16(chunk/g.perRow()) * g.size
+
+	return x, y, min(g.size, g.canvas-x), min(g.size, g.canvas-y)
+}
+
+// rect is a viewport in canvas cells.
+type rect struct {
+	X, Y, W, H uint16
+}
+
+// region returns every chunk rects overlap. Parts of a rect outside the
+// canvas are ignored.
+func (g chunkGrid) region(rects []rect) region {
+	r := make(region, (g.count()+63)/64)
+	for _, rc := range rects {
+		if rc.W == 0 || rc.H == 0 || rc.X >= g.canvas || rc.Y >= g.canvas {
+			continue
+		}
+
+		right := min(int(rc.X)+int(rc.W), int(g.canvas)) - 1
+		bottom := min(int(rc.Y)+int(rc.H), int(g.canvas)) - 1
+		for cy := int(rc.Y / g.size); cy <= bottom/int(g.size); cy++ {
+			for cx := int(rc.X / g.size); cx <= right/int(g.size); cx++ {
+				chunk := cy*g.perRow() + cx
+				r[chunk/64] |= 1 << (chunk % 64)
+			}
+		}
+	}
+
+	return r
+}
+
+// region is the set of chunks a client is subscribed to. A client without a
+// region receives the whole canvas.
+type region []uint64
+
+func (r *region) has(chunk int) bool {
+	if r == nil {
+		return true
+	}
+
+	return chunk/64 < len(*r) && (*r)[chunk/64]&(1<<(chunk%64)) != 0
+}
+
+// add puts chunk in r.
+func (r *region) add(chunk int) {
+	for chunk/64 >= len(*r) {
+		*r = append(*r, 0)
+	}
+	(*r)[chunk/64] |= 1 << (chunk % 64)
+}
+
+// chunks lists the chunks in r, in order.
+func (r region) chunks() []int {
+	return r.chunksNotIn(&region{})
+}
+
+// chunksNotIn lists the chunks of r missing from previous, in order.
+func (r region) chunksNotIn(previous *region) []int {
+	chunks := make([]int, 0)
+	for i, word := range r {
+		for word != 0 {
+			chunk := i*64 + bits.TrailingZeros64(word)
+			word &= word - 1
+			if !previous.has(chunk) {
+				chunks = append(chunks, chunk)
+			}
+		}
+	}
+
+	return chunks
+}
+
+// parseSubscribe reads the rects of a subscribe message body:
+//
+//	[count u8][x u16][y u16][w u16][h u16]...
+func parseSubscribe(body []byte) ([]rect, error) {
+	if len(body) < 1 {
+		return nil, fmt.Errorf("%w: missing count", ErrMalformedSubscribe)
+	}
+
+	count := int(body[0])
+	if len(body) != 1+count*rectSize {
+		return nil, fmt.Errorf("%w: %d rects need %d bytes, got %d", ErrMalformedSubscribe, count, 1+count*rectSize, len(body))
+	}
+
+	rects := make([]rect, count)
+	for i := range rects {
+		b := body[1+i*rectSize:]
+		rects[i] = rect{
+			X: binary.BigEndian.Uint16(b),
+			Y: binary.BigEndian.Uint16(b[2:]),
+			W: binary.BigEndian.Uint16(b[4:]),
+			H: binary.BigEndian.Uint16(b[6:]),
+		}
+	}
+
+	return rects, nil
+}
+
+// chunkFrame cuts one chunk out of a canvas bitfield. Its cells are packed the
+// same way as the canvas, row-major within the chunk. With rle set, the cells
+// are run-length encoded instead whenever that is smaller, and the frame type
+// carries msgFlagRLE.
+func (g chunkGrid) chunkFrame(seq uint64, state []byte, chunk int, rle bool) []byte {
+	x, y, w, h := g.bounds(chunk)
+
+	colors := make([]uint8, 0, int(w)*int(h))
+	for row := uint16(0); row < h; row++ {
+		for col := uint16(0); col < w; col++ {
+			colors = append(colors, protocol.ColorAt(state, g.canvas, x+col, y+row))
+		}
+	}
+
+	msgType, cells := uint8(msgTypeChunk), packColors(colors)
+	if rle {
+		if runs := encodeRuns(colors); len(runs) < len(cells) {
+			msgType, cells = msgTypeChunk|msgFlagRLE, runs
+		}
+	}
+
+	frame := make([]byte, 0, 1+protocol.SeqSize+rectSize+len(cells))
+	frame = protocol.AppendSeq(append(frame, msgType), seq, nil)
+	for _, v := range []uint16{x, y, w, h} {
+		frame = binary.BigEndian.AppendUint16(frame, v)
+	}
+
+	return append(frame, cells...)
+}
+
+// packColors packs colors as u4, the even cell in the upper nibble.
+func packColors(colors []uint8) []byte {
+	packed := make([]byte, (len(colors)+1)/2)
+	for i, color := range colors {
+		if i%2 == 0 {
+			packed[i/2] |= color << 4
+		} else {
+			packed[i/2] |= color
+		}
+	}
+
+	return packed
+}
+
+// unpackColors reverses packColors for count cells.
+func unpackColors(packed []byte, count int) []uint8 {
+	colors := make([]uint8, 0, count)
+	for i := 0; i < count && i/2 < len(packed); i++ {
+		if i%2 == 0 {
+			colors = append(colors, packed[i/2]>>4)
+		} else {
+			colors = append(colors, packed[i/2]&0x0F)
+		}
+	}
+
+	return colors
+}
+
+// expandRuns reverses encodeRuns, refusing runs that cover more than count
+// cells.
+func expandRuns(runs []byte, count int) ([]uint8, error) {
+	colors := make([]uint8, 0, count)
+	for len(runs) > 0 {
+		v, n := binary.Uvarint(runs)
+		if n <= 0 || uint64(count-len(colors)) < v>>4 {
+			return nil, errMalformedRuns
+		}
+		for range v >> 4 {
+			colors = append(colors, uint8(v&0x0F))
+		}
+		runs = runs[n:]
+	}
+
+	return colors, nil
+}
+
+// encodeRuns writes each run of equal colors as uvarint(length<<4 | color), so
+// runs shorter than 8 cells take one byte.
+func encodeRuns(colors []uint8) []byte {
+	runs := make([]byte, 0, 16)
+	for start := 0; start < len(colors); {
+		end := start + 1
+		for end < len(colors) && colors[end] == colors[start] {
+			end++
+		}
+
+		runs = binary.AppendUvarint(runs, uint64(end-start)<<4|uint64(colors[start]&0x0F))
+		start = end
+	}
+
+	return runs
+}
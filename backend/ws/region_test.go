@@ -0,0 +1,224 @@
+package ws
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"backend/internal/protocol"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkGridBounds(t *testing.T) {
+	g := newChunkGrid(100, 32)
+
+	assert.Equal(t, 16, g.count())
+	assert.Equal(t, 0, g.chunkOf(0, 0))
+	assert.Equal(t, 5, g.chunkOf(40, 40))
+	assert.Equal(t, 15, g.chunkOf(99, 99))
+
+	x, y, w, h := g.bounds(15)
+	assert.Equal(t, [4]uint16{96, 96, 4, 4}, [4]uint16{x, y, w, h}, "edge chunks are clipped")
+}
+
+func TestChunkGridDefaultsToOneChunk(t *testing.T) {
+	assert.Equal(t, 1, newChunkGrid(100, 0).count())
+	assert.Equal(t, 1, newChunkGrid(100, 500).count())
+}
+
+func TestRegionCoversOverlappedChunks(t *testing.T) {
+	g := newChunkGrid(100, 32)
+
+	r := g.region([]rect{
+		{X: 30, Y: 0, W: 4, H: 1},      // straddles chunks 0 and 1
+		{X: 96, Y: 96, W: 500, H: 500}, // clipped to chunk 15
+		{X: 200, Y: 0, W: 10, H: 10},   // off the canvas
+		{X: 50, Y: 50, W: 0, H: 10},    // empty
+	})
+
+	assert.Equal(t, []int{0, 1, 15}, r.chunks())
+	assert.True(t, r.has(1))
+	assert.False(t, r.has(2))
+
+	var whole *region
+	assert.True(t, whole.has(2), "no region is the whole canvas")
+	assert.Equal(t, []int{0, 15}, r.chunksNotIn(&region{2}))
+}
+
+func TestParseSubscribe(t *testing.T) {
+	body := []byte{2}
+	for _, v := range []uint16{1, 2, 3, 4, 5, 6, 7, 8} {
+		body = binary.BigEndian.AppendUint16(body, v)
+	}
+
+	rects, err := parseSubscribe(body)
+	assert.NoError(t, err)
+	assert.Equal(t, []rect{{X: 1, Y: 2, W: 3, H: 4}, {X: 5, Y: 6, W: 7, H: 8}}, rects)
+
+	rects, err = parseSubscribe([]byte{0})
+	assert.NoError(t, err)
+	assert.Empty(t, rects)
+
+	_, err = parseSubscribe(body[:len(body)-1])
+	assert.ErrorIs(t, err, ErrMalformedSubscribe)
+	_, err = parseSubscribe(nil)
+	assert.ErrorIs(t, err, ErrMalformedSubscribe)
+}
+
+// stalledRedis holds every canvas read until it is released.
+type stalledRedis struct {
+	redis.UniversalClient
+	release chan struct{}
+}
+
+func (r *stalledRedis) TxPipelined(ctx context.Context, _ func(redis.Pipeliner) error) ([]redis.Cmder, error) {
+	select {
+	case <-r.release:
+	case <-ctx.Done():
+	}
+	return nil, errors.New("unavailable")
+}
+
+func TestSubscribeSendsChunksOffTheReadPump(t *testing.T) {
+	stalled := &stalledRedis{release: make(chan struct{})}
+	redisClient = stalled
+	t.Cleanup(func() { redisClient = nil })
+
+	c := newClients(1, 16, policyDisconnect)
+	defer c.Close()
+	client := c.register(newFakeConn(), peer{})
+	client.region.Store(&region{})
+
+	msg := []byte{msgTypeSubscribe, 1}
+	for _, v := range []uint16{0, 0, protocol.CanvasSize, protocol.CanvasSize} {
+		msg = binary.BigEndian.AppendUint16(msg, v)
+	}
+
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		handleClientFrame(client, msg)
+		handleClientFrame(client, msg)
+	}()
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("the read pump waited for the canvas")
+	}
+	assert.Len(t, client.region.Load().chunks(), chunks.count())
+
+	close(stalled.release)
+	assert.Eventually(t, func() bool {
+		client.subscribeMu.Lock()
+		defer client.subscribeMu.Unlock()
+		return !client.sendingChunks
+	}, time.Second, time.Millisecond)
+}
+
+func TestChunkFrame(t *testing.T) {
+	g := newChunkGrid(4, 3)
+	// 4x4 canvas with cell x, y colored y*4+x
+	state := []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xAB, 0xCD, 0xEF}
+
+	frame := g.chunkFrame(7, state, 1, false)
+	assert.Equal(t, uint8(msgTypeChunk), frame[0])
+	assert.Equal(t, uint64(7), binary.BigEndian.Uint64(frame[1:]))
+
+	header := frame[1+protocol.SeqSize:]
+	assert.Equal(t, []uint16{3, 0, 1, 3}, []uint16{
+		binary.BigEndian.Uint16(header),
+		binary.BigEndian.Uint16(header[2:]),
+		binary.BigEndian.Uint16(header[4:]),
+		binary.BigEndian.Uint16(header[6:]),
+	})
+	// column x=3 holds 3, 7 and 11
+	assert.Equal(t, []byte{0x37, 0xB0}, header[rectSize:])
+}
+
+func TestViewportsFrom(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/ws?viewport=1,2,3,4&viewport=bad&viewport=5,6,7,8", nil)
+
+	rects, ok := viewportsFrom(c)
+	assert.True(t, ok)
+	assert.Equal(t, []rect{{X: 1, Y: 2, W: 3, H: 4}, {X: 5, Y: 6, W: 7, H: 8}}, rects)
+
+	c, _ = gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/ws", nil)
+	_, ok = viewportsFrom(c)
+	assert.False(t, ok)
+}
+
+func TestClientInRegion(t *testing.T) {
+	updates := []protocol.Update{
+		{Seq: 1, Cell: protocol.Cell{X: 1, Y: 1}},
+		{Seq: 2, Cell: protocol.Cell{X: 99, Y: 99}},
+	}
+
+	client := &Client{}
+	assert.Equal(t, updates, client.inRegion(updates))
+	assert.Len(t, client.stateChunks(), chunks.count())
+
+	r := chunks.region([]rect{{X: 0, Y: 0, W: 2, H: 2}})
+	client.region.Store(&r)
+	assert.Equal(t, updates[:1], client.inRegion(updates))
+	assert.Equal(t, []int{0}, client.stateChunks())
+}
+
+func decodeRuns(t *testing.T, runs []byte) []uint8 {
+	colors := make([]uint8, 0)
+	for len(runs) > 0 {
+		v, n := binary.Uvarint(runs)
+		assert.Positive(t, n)
+		for range v >> 4 {
+			colors = append(colors, uint8(v&0x0F))
+		}
+		runs = runs[n:]
+	}
+
+	return colors
+}
+
+func TestChunkFrameRLE(t *testing.T) {
+	g := newChunkGrid(64, 32)
+	state := make([]byte, 64*64/2)
+	for i := range state[:64/2*32] {
+		state[i] = 0x33 // the top row of chunks is color 3
+	}
+
+	frame := g.chunkFrame(1, state, 0, true)
+	assert.Equal(t, msgTypeChunk|msgFlagRLE, frame[0])
+	cells := frame[1+protocol.SeqSize+rectSize:]
+	assert.Len(t, cells, 3)
+	assert.Equal(t, slices.Repeat([]uint8{3}, 32*32), decodeRuns(t, cells))
+
+	// alternating colors don't compress, so the packed form is kept
+	for i := range state {
+		state[i] = 0x12
+	}
+	frame = g.chunkFrame(1, state, 3, true)
+	assert.Equal(t, uint8(msgTypeChunk), frame[0])
+	assert.Len(t, frame[1+protocol.SeqSize+rectSize:], 32*32/2)
+}
+
+func TestFrameName(t *testing.T) {
+	assert.Equal(t, "update", frameName(msgTypeUpdate))
+	assert.Equal(t, "chunk_rle", frameName(msgTypeChunk|msgFlagRLE))
+	assert.Equal(t, "unknown", frameName(0))
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/ws?encodings=zstd,rle", nil)
+	assert.True(t, acceptsEncoding(c, encodingRLE))
+
+	c, _ = gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/ws?encodings=zstd", nil)
+	assert.False(t, acceptsEncoding(c, encodingRLE))
+}
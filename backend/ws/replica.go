@@ -0,0 +1,207 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"backend/internal/config"
+	"backend/internal/protocol"
+	"backend/logging"
+)
+
+const (
+	defaultReplicaVerifyInterval = time.Minute
+	// replicaSyncTimeout bounds one read of the canvas from Redis
+	replicaSyncTimeout = 5 * time.Second
+	// replicaGapInterval spaces out resyncs when updates keep going missing
+	replicaGapInterval = time.Second
+)
+
+// replica is this pod's copy of the canvas, so new clients get their snapshot
+// from memory rather than each reading the whole canvas from Redis. It is
+// seeded from Redis, kept current by applying every update the pod receives,
+// and checked against Redis periodically. An update arriving past a hole in
+// the sequence means one was missed; the replica stops serving until it is
+// resynced.
+type replica struct {
+	mu     sync.RWMutex
+	state  []byte
+	seq    uint64
+	seeded bool
+
+	// read fetches the canvas and its sequence number from Redis
+	read     func(context.Context) (string, uint64, error)
+	interval time.Duration
+	gaps     chan struct{}
+}
+
+func newReplica() *replica {
+	return &replica{
+		state:    make([]byte, (int(protocol.CanvasSize)*int(protocol.CanvasSize)+1)/2),
+		read:     latestState,
+		interval: config.Duration("WS_REPLICA_VERIFY_INTERVAL", defaultReplicaVerifyInterval),
+		gaps:     make(chan struct{}, 1),
+	}
+}
+
+// snapshot returns a copy of the canvas and the sequence number of the last
+// update applied to it. It reports false while the replica can't be trusted.
+func (r *replica) snapshot() ([]byte, uint64, bool) {
+	if r == nil {
+		return nil, 0, false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if !r.seeded {
+		return nil, 0, false
+	}
+
+	return bytes.Clone(r.state), r.seq, true
+}
+
+// apply writes an update into the replica. Updates it already holds are
+// skipped.
+func (r *replica) apply(update protocol.Update) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.seeded || update.Seq != 0 && update.Seq <= r.seq {
+		return
+	}
+	if update.Seq > r.seq+1 {
+		logging.Warnf("canvas replica missed updates %d to %d, resyncing", r.seq+1, update.Seq-1)
+		r.invalidate()
+		return
+	}
+
+	r.set(update)
+}
+
+// invalidate stops the replica serving until it is resynced. Callers hold mu.
+func (r *replica) invalidate() {
+	r.seeded = false
+	replicaChecks.WithLabelValues(replicaGap).Inc()
+	select {
+	case r.gaps <- struct{}{}:
+	default:
+	}
+}
+
+// resync syncs the replica right away, as clients are about to be sent
+// snapshots of it. If that fails it stops serving until it is resynced.
+func (r *replica) resync(ctx context.Context) {
+	if r == nil {
+		return
+	}
+
+	if err := r.sync(ctx); err != nil {
+		logging.Errorf("failed to sync canvas replica: %v", err)
+		r.mu.Lock()
+		r.invalidate()
+		r.mu.Unlock()
+	}
+}
+
+func (r *replica) set(update protocol.Update) {
+	protocol.SetColorAt(r.state, protocol.CanvasSize, update.Cell.X, update.Cell.Y, update.Cell.Color)
+	if update.Seq != 0 {
+		r.seq = update.Seq
+	}
+}
+
+// Run seeds the replica, then verifies it every interval and resyncs it
+// whenever it falls behind, until ctx is done.
+func (r *replica) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	r.syncLogged(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.gaps:
+		}
+
+		r.syncLogged(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(replicaGapInterval):
+		}
+	}
+}
+
+func (r *replica) syncLogged(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, replicaSyncTimeout)
+	defer cancel()
+
+	if err := r.sync(ctx); err != nil {
+		logging.Errorf("failed to sync canvas replica: %v", err)
+	}
+}
+
+// sync replaces the replica with the canvas read from Redis, rolled forward
+// with the updates cached since. When the replica had reached the same update
+// the two are compared, which is how drift is caught.
+func (r *replica) sync(ctx context.Context) error {
+	current, seq, err := r.read(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	wasSeeded, previous, previousSeq := r.seeded, r.state, r.seq
+	r.state = make([]byte, len(previous))
+	copy(r.state, current)
+	r.seq = seq
+	// updates this pod received after the read are cached before they are
+	// applied, so the replica doesn't miss those it skipped while unseeded
+	if newer, ok := localCache.After(seq); ok {
+		for _, update := range newer {
+			r.set(update)
+		}
+	}
+	r.seeded = true
+
+	switch {
+	case !wasSeeded:
+		replicaChecks.WithLabelValues(replicaSeeded).Inc()
+	case previousSeq != r.seq:
+		// updates in flight one way or the other; nothing to compare
+		replicaChecks.WithLabelValues(replicaReplaced).Inc()
+	case bytes.Equal(previous, r.state):
+		replicaChecks.WithLabelValues(replicaMatched).Inc()
+	default:
+		logging.Warnf("canvas replica diverged from Redis at update %d, replaced", r.seq)
+		replicaChecks.WithLabelValues(replicaDiverged).Inc()
+	}
+
+	return nil
+}
+
+// canvasState returns the canvas and its sequence number, from the replica
+// when it is seeded and from Redis otherwise.
+func canvasState(ctx context.Context) ([]byte, uint64, error) {
+	if state, seq, ok := canvas.snapshot(); ok {
+		stateReads.WithLabelValues(stateFromReplica).Inc()
+		return state, seq, nil
+	}
+
+	state, seq, err := latestState(ctx)
+	stateReads.WithLabelValues(stateFromRedis).Inc()
+
+	return []byte(state), seq, err
+}
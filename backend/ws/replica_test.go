@@ -0,0 +1,87 @@
+package ws
+
+import (
+	"context"
+	"testing"
+
+	"backend/internal/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+// seededReplica returns a replica read from a canvas whose first cell has
+// color 1, at sequence number seq.
+func seededReplica(t *testing.T, seq uint64) *replica {
+	r := newReplica()
+	r.read = func(context.Context) (string, uint64, error) {
+		return "\x10", seq, nil
+	}
+	assert.NoError(t, r.sync(context.Background()))
+
+	return r
+}
+
+func TestReplicaAppliesUpdates(t *testing.T) {
+	localCache = NewCache(defaultCacheBytes)
+	defer func() { localCache = nil }()
+
+	r := newReplica()
+	_, _, ok := r.snapshot()
+	assert.False(t, ok, "not seeded yet")
+
+	r = seededReplica(t, 5)
+	r.apply(protocol.Update{Seq: 6, Cell: protocol.Cell{X: 1, Y: 0, Color: 2}})
+	r.apply(protocol.Update{Seq: 7, Cell: protocol.Cell{X: 2, Y: 3, Color: 4}})
+	r.apply(protocol.Update{Seq: 6, Cell: protocol.Cell{X: 1, Y: 0, Color: 9}})
+
+	state, seq, ok := r.snapshot()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(7), seq)
+	assert.Equal(t, uint8(1), protocol.ColorAt(state, protocol.CanvasSize, 0, 0))
+	assert.Equal(t, uint8(2), protocol.ColorAt(state, protocol.CanvasSize, 1, 0), "update 6 was applied once")
+	assert.Equal(t, uint8(4), protocol.ColorAt(state, protocol.CanvasSize, 2, 3))
+	assert.Len(t, state, protocol.CanvasSize*protocol.CanvasSize/2)
+
+	state[0] = 0xFF
+	again, _, _ := r.snapshot()
+	assert.Equal(t, uint8(1), protocol.ColorAt(again, protocol.CanvasSize, 0, 0), "snapshots are copies")
+}
+
+func TestReplicaStopsServingOnGap(t *testing.T) {
+	localCache = NewCache(defaultCacheBytes)
+	defer func() { localCache = nil }()
+
+	r := seededReplica(t, 5)
+	r.apply(protocol.Update{Seq: 7, Cell: protocol.Cell{X: 1, Y: 0, Color: 2}})
+
+	_, _, ok := r.snapshot()
+	assert.False(t, ok)
+	assert.Len(t, r.gaps, 1, "a resync is due")
+
+	// both updates reach the cache before the replica, so a resync from an
+	// older read rolls forward through them
+	localCache.Add(protocol.Update{Seq: 6, Cell: protocol.Cell{X: 3, Y: 0, Color: 5}})
+	localCache.Add(protocol.Update{Seq: 7, Cell: protocol.Cell{X: 1, Y: 0, Color: 2}})
+	assert.NoError(t, r.sync(context.Background()))
+
+	state, seq, ok := r.snapshot()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(7), seq)
+	assert.Equal(t, uint8(5), protocol.ColorAt(state, protocol.CanvasSize, 3, 0))
+	assert.Equal(t, uint8(2), protocol.ColorAt(state, protocol.CanvasSize, 1, 0))
+}
+
+func TestReplicaSyncReplacesDivergedState(t *testing.T) {
+	localCache = NewCache(defaultCacheBytes)
+	defer func() { localCache = nil }()
+
+	r := seededReplica(t, 5)
+	r.mu.Lock()
+	protocol.SetColorAt(r.state, protocol.CanvasSize, 0, 0, 3)
+	r.mu.Unlock()
+
+	assert.NoError(t, r.sync(context.Background()))
+
+	state, seq, _ := r.snapshot()
+	assert.Equal(t, uint64(5), seq)
+	assert.Equal(t, uint8(1), protocol.ColorAt(state, protocol.CanvasSize, 0, 0))
+}
@@ -0,0 +1,117 @@
+package ws
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"backend/internal/config"
+	"backend/internal/protocol"
+	"backend/logging"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	resumeQueryParam = "since"
+	// lastEventIDHeader is sent by an EventSource reconnecting to the events
+	// endpoint, with the id of the last event it got
+	lastEventIDHeader = "Last-Event-ID"
+
+	defaultResumeWindow     = 5 * time.Minute
+	defaultResumeMaxUpdates = 50_000
+)
+
+var (
+	resumeWindow     = config.Duration("WS_RESUME_WINDOW", defaultResumeWindow)
+	resumeMaxUpdates = uint64(config.Int("WS_RESUME_MAX_UPDATES", defaultResumeMaxUpdates))
+)
+
+// resumeFrom reads the sequence number of the last update a reconnecting
+// client saw, from Last-Event-ID or ?since=. An EventSource reconnects to the
+// URL it started with, so the header is the more recent of the two.
+func resumeFrom(c *gin.Context) (uint64, bool) {
+	raw := c.GetHeader(lastEventIDHeader)
+	if raw == "" {
+		raw = c.Query(resumeQueryParam)
+	}
+	if raw == "" {
+		return 0, false
+	}
+
+	since, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return since, true
+}
+
+// resumeSession sends a reconnecting client only the updates it missed since
+// seq, ahead of the broadcasts held back while they were read. It reports
+// false, leaving the client untouched, when the gap can't be filled from
+// history and a full state has to be sent instead.
+func resumeSession(ctx context.Context, client *Client, since uint64) bool {
+	current, err := redisClient.Get(ctx, protocol.SeqKey(gridKey)).Uint64()
+	if err != nil && err != redis.Nil {
+		logging.Errorf("Failed to read sequence for resume: %v", err)
+		return false
+	}
+
+	if since > current {
+		// the client is ahead of us, e.g. the canvas was reset
+		sessionResumes.WithLabelValues(resumeFullState).Inc()
+		return false
+	}
+	if current-since > resumeMaxUpdates {
+		sessionResumes.WithLabelValues(resumeFullState).Inc()
+		return false
+	}
+
+	missed, ok := missedUpdates(ctx, since, current, time.Now().UnixMilli())
+	if !ok {
+		sessionResumes.WithLabelValues(resumeFullState).Inc()
+		return false
+	}
+
+	client.hub.startBroadcasts(client, batchFrames(client.inRegion(missed)))
+
+	sessionResumes.WithLabelValues(resumeResumed).Inc()
+	logging.Debugf("resumed client %d from %d with %d updates", client.ID, since, len(missed))
+
+	return true
+}
+
+// missedUpdates collects the updates after since up to at least current,
+// preferring the local cache and falling back to Redis. It reports false if
+// neither the cache nor history within the resume window covers the whole gap.
+func missedUpdates(ctx context.Context, since, current uint64, now int64) ([]protocol.Update, bool) {
+	if since == current {
+		return nil, true
+	}
+
+	if missed, ok := localCache.After(since); ok && coversGap(missed, since, current) {
+		return missed, true
+	}
+
+	missed := updatesAfter(storedUpdates(ctx, now-resumeWindow.Milliseconds(), now, 0), since)
+	if coversGap(missed, since, current) {
+		return missed, true
+	}
+
+	return nil, false
+}
+
+// coversGap reports whether updates, sorted by sequence number, run without
+// holes from since+1 through at least current.
+func coversGap(updates []protocol.Update, since, current uint64) bool {
+	next := since + 1
+	for _, update := range updates {
+		if update.Seq != next {
+			break
+		}
+		next++
+	}
+
+	return next > current
+}
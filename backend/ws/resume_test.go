@@ -0,0 +1,163 @@
+package ws
+
+import (
+	"cmp"
+	"context"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"backend/internal/protocol"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+type bucketRedis struct {
+	redis.UniversalClient
+	buckets map[string][]string
+	// seq is the canvas sequence number
+	seq uint64
+	// from is the lower bound of the last read
+	from int64
+}
+
+func (r *bucketRedis) Get(ctx context.Context, _ string) *redis.StringCmd {
+	cmd := redis.NewStringCmd(ctx)
+	cmd.SetVal(strconv.FormatUint(r.seq, 10))
+
+	return cmd
+}
+
+func (r *bucketRedis) add(key string, updates ...protocol.Update) {
+	for _, update := range updates {
+		r.buckets[key] = append(r.buckets[key], string(update.Encode()))
+	}
+}
+
+// ZRangeByScore scores members by their time, as the grid service does.
+func (r *bucketRedis) ZRangeByScore(ctx context.Context, key string, opt *redis.ZRangeBy) *redis.StringSliceCmd {
+	from, _ := strconv.ParseInt(opt.Min, 10, 64)
+	to, _ := strconv.ParseInt(opt.Max, 10, 64)
+	r.from = from
+	var updates []protocol.Update
+	for _, member := range r.buckets[key] {
+		if update, err := decodeUpdate([]byte(member)); err == nil && update.Cell.Time >= from && update.Cell.Time <= to {
+			updates = append(updates, *update)
+		}
+	}
+	slices.SortStableFunc(updates, func(a, b protocol.Update) int {
+		return cmp.Compare(a.Cell.Time, b.Cell.Time)
+	})
+	if opt.Count > 0 && int64(len(updates)) > opt.Count {
+		updates = updates[:opt.Count]
+	}
+
+	members := make([]string, 0, len(updates))
+	for _, update := range updates {
+		members = append(members, string(update.Encode()))
+	}
+	cmd := redis.NewStringSliceCmd(ctx)
+	cmd.SetVal(members)
+
+	return cmd
+}
+
+func TestResumeFrom(t *testing.T) {
+	for query, expected := range map[string]struct {
+		since uint64
+		ok    bool
+	}{
+		"":            {},
+		"?since=42":   {since: 42, ok: true},
+		"?since=-1":   {},
+		"?since=nope": {},
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/ws"+query, nil)
+
+		since, ok := resumeFrom(c)
+		assert.Equal(t, expected.since, since, query)
+		assert.Equal(t, expected.ok, ok, query)
+	}
+}
+
+func TestCoversGap(t *testing.T) {
+	updates := []protocol.Update{{Seq: 5}, {Seq: 6}, {Seq: 7}}
+
+	assert.True(t, coversGap(updates, 4, 7))
+	assert.True(t, coversGap(updates, 4, 6), "updates past current are fine")
+	assert.False(t, coversGap(updates, 3, 7), "missing the first update")
+	assert.False(t, coversGap(updates, 4, 8), "missing the latest update")
+	assert.False(t, coversGap([]protocol.Update{{Seq: 5}, {Seq: 7}}, 4, 7), "hole in the middle")
+	assert.True(t, coversGap(nil, 7, 7))
+}
+
+func TestMissedUpdatesFallsBackToRedis(t *testing.T) {
+	localCache = NewCache(defaultCacheBytes)
+	defer func() { localCache = nil }()
+
+	now := epochs.Start(epochs.Current()) + 1_000
+	bucket := protocol.UpdatesKey(gridKey, epochs.Of(now))
+	updates := []protocol.Update{
+		{Seq: 11, Cell: protocol.Cell{X: 1, Y: 1, Color: 1, Time: now - 300}},
+		{Seq: 12, Cell: protocol.Cell{X: 2, Y: 2, Color: 2, Time: now - 200}},
+		{Seq: 13, Cell: protocol.Cell{X: 3, Y: 3, Color: 3, Time: now - 100}},
+	}
+
+	// this pod missed update 12, so its cache can't fill the gap
+	localCache.Add(updates[0])
+	localCache.Add(updates[2])
+
+	stored := &bucketRedis{buckets: map[string][]string{}}
+	stored.add(bucket, updates...)
+	redisClient = stored
+	defer func() { redisClient = nil }()
+
+	missed, ok := missedUpdates(context.Background(), 10, 13, now)
+	assert.True(t, ok)
+	assert.Equal(t, updates, missed)
+
+	_, ok = missedUpdates(context.Background(), 9, 13, now)
+	assert.False(t, ok, "update 10 is outside history")
+}
+
+func TestResumeGoesAheadOfRacingBroadcasts(t *testing.T) {
+	localCache = NewCache(defaultCacheBytes)
+	redisClient = &bucketRedis{buckets: map[string][]string{}, seq: 5}
+	t.Cleanup(func() { localCache, redisClient = nil, nil })
+	for seq := uint64(1); seq <= 5; seq++ {
+		localCache.Add(protocol.Update{Seq: seq, Cell: protocol.Cell{X: uint16(seq), Y: 1, Color: 1, Time: 1760788800000}})
+	}
+
+	c := newClients(1, 16, policyDisconnect)
+	defer c.Close()
+	conn, rec := newTestSSEConn()
+	client := c.Add(conn, peer{})
+
+	// broadcast after the client connected, before its missed updates are read
+	broadcastUpdate(c, 6, 6, 1)
+	waitDrained(t, c)
+	assert.Empty(t, conn.events(rec), "held back until the session starts")
+
+	assert.True(t, resumeSession(context.Background(), client, 2))
+	waitDrained(t, c)
+
+	events := conn.events(rec)
+	missed, racing := strings.Index(events, "id: 5\n"), strings.Index(events, "id: 6\n")
+	assert.NotEqual(t, -1, missed)
+	assert.NotEqual(t, -1, racing)
+	assert.Less(t, missed, racing, "missed updates 3 to 5 come before update 6")
+}
+
+func TestResumeFromLastEventID(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", eventsRoute+"?since=7", nil)
+	c.Request.Header.Set(lastEventIDHeader, "42")
+
+	since, ok := resumeFrom(c)
+	assert.True(t, ok)
+	assert.EqualValues(t, 42, since)
+}
@@ -0,0 +1,264 @@
+package ws
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+
+	"backend/internal/protocol"
+	"backend/logging"
+)
+
+// slowConsumerPolicy decides what happens to a client whose write queue is
+// full when an update is broadcast.
+type slowConsumerPolicy string
+
+const (
+	// policyDisconnect closes the client; it reconnects and resumes.
+	policyDisconnect slowConsumerPolicy = "disconnect"
+	// policyResync drops updates until the client's queue drains and then
+	// sends it a fresh snapshot.
+	policyResync slowConsumerPolicy = "resync"
+	// policyCoalesce keeps only the latest pending update per cell and sends
+	// them once the client's queue drains.
+	policyCoalesce slowConsumerPolicy = "coalesce"
+
+	defaultSlowConsumerPolicy = policyDisconnect
+)
+
+const (
+	outcomeDisconnected    = "disconnected"
+	outcomeResyncScheduled = "resync_scheduled"
+	outcomeResynced        = "resynced"
+	outcomeCoalesced       = "coalesced"
+	outcomeSuperseded      = "superseded"
+	outcomeDropped         = "dropped"
+)
+
+func parseSlowConsumerPolicy(name string) slowConsumerPolicy {
+	switch policy := slowConsumerPolicy(name); policy {
+	case policyDisconnect, policyResync, policyCoalesce:
+		return policy
+	default:
+		logging.Warnf("unknown slow consumer policy %q, using %s", name, defaultSlowConsumerPolicy)
+		return defaultSlowConsumerPolicy
+	}
+}
+
+// slowState is what a client holds back while it is behind.
+type slowState struct {
+	resyncPending bool
+	resyncing     bool
+	// coalesced holds the latest held back update per cell, nil unless the
+	// client is coalescing
+	coalesced map[uint32]protocol.Update
+	// holding is set from when a client connects until its session starts;
+	// held keeps the broadcasts meanwhile, in order, so none overtakes what
+	// the client is owed first
+	holding bool
+	held    []outFrame
+}
+
+// deliver queues a broadcast frame to one client, applying the slow consumer
+// policy if the client can't keep up. It never blocks and reports whether the
+// frame was queued.
+func (c *Clients) deliver(cli *Client, frame outFrame) bool {
+	if frame.ephemeral {
+		// superseded soon anyway; not worth acting on a slow client for
+		err := cli.enqueue(frame)
+		if errors.Is(err, errQueueFull) {
+			slowConsumerEvents.WithLabelValues(outcomeDropped).Inc()
+		}
+		return err == nil
+	}
+
+	update := frame.update
+
+	cli.slowMu.Lock()
+	defer cli.slowMu.Unlock()
+
+	switch {
+	case update != nil && cli.slow.resyncPending:
+		slowConsumerEvents.WithLabelValues(outcomeDropped).Inc()
+		return false
+	case cli.slow.holding:
+		if len(cli.slow.held) >= writePipeSize && !cli.slow.resyncPending {
+			// too far behind to catch up from its own queue; the resync
+			// covers the updates, the rest is still owed
+			slowConsumerEvents.WithLabelValues(outcomeResyncScheduled).Inc()
+			cli.slow.held = slices.DeleteFunc(cli.slow.held, func(held outFrame) bool {
+				return held.update != nil
+			})
+			cli.slow.resyncPending = true
+		}
+		if update != nil && cli.slow.resyncPending || len(cli.slow.held) >= writePipeSize {
+			slowConsumerEvents.WithLabelValues(outcomeDropped).Inc()
+			return false
+		}
+		cli.slow.held = append(cli.slow.held, frame)
+		return false
+	case update == nil && (cli.slow.resyncPending || cli.slow.coalesced != nil):
+		// only updates are coalesced or left to the resync; anything else
+		// still goes out in order, or is lost if there's no room
+		err := cli.enqueue(frame)
+		if errors.Is(err, errQueueFull) {
+			slowConsumerEvents.WithLabelValues(outcomeDropped).Inc()
+		}
+		return err == nil
+	case cli.slow.coalesced != nil:
+		// keep order: nothing may overtake the updates already held back
+		cli.holdBack(update)
+		return false
+	}
+
+	err := cli.enqueue(frame)
+	if !errors.Is(err, errQueueFull) {
+		return err == nil
+	}
+
+	switch c.policy {
+	case policyResync:
+		logging.Debugf("client %d is full, resyncing it once it drains", cli.ID)
+		slowConsumerEvents.WithLabelValues(outcomeResyncScheduled).Inc()
+		cli.slow.resyncPending = true
+	case policyCoalesce:
+		cli.slow.coalesced = make(map[uint32]protocol.Update)
+		cli.holdBack(update)
+	default:
+		logging.Debugf("client %d is full, closing it", cli.ID)
+		slowConsumerEvents.WithLabelValues(outcomeDisconnected).Inc()
+		c.remove(cli)
+	}
+
+	return false
+}
+
+// startBroadcasts ends holding: first, what the client is owed, is queued
+// ahead of the broadcasts held back since it connected, and later broadcasts
+// follow them. A client they don't fit is resynced instead of sent the
+// updates.
+func (c *Clients) startBroadcasts(cli *Client, first [][]byte) {
+	cli.slowMu.Lock()
+	defer cli.slowMu.Unlock()
+
+	held := cli.slow.held
+	cli.slow.holding, cli.slow.held = false, nil
+	defer c.startWriter(cli)
+	if cli.slow.resyncPending {
+		// the resync covers what it is owed; held has no updates left
+		first = nil
+	}
+
+	queue := func(frame outFrame) bool {
+		err := cli.enqueue(frame)
+		if errors.Is(err, errQueueFull) {
+			slowConsumerEvents.WithLabelValues(outcomeResyncScheduled).Inc()
+			cli.slow.resyncPending = true
+		}
+		return err == nil
+	}
+	for _, message := range first {
+		frame, err := prepareFrame(message)
+		if err != nil {
+			logging.Errorf("failed to prepare frame for client %d: %v", cli.ID, err)
+			continue
+		}
+		if !queue(frame) {
+			return
+		}
+		frameBytes.WithLabelValues(frameName(message[0])).Add(float64(len(message)))
+	}
+	for _, frame := range held {
+		if !queue(frame) {
+			return
+		}
+	}
+}
+
+// holdBack adds an update to the coalesced set, replacing an older one for the
+// same cell. Callers hold slowMu.
+func (c *Client) holdBack(update *protocol.Update) {
+	if update == nil {
+		slowConsumerEvents.WithLabelValues(outcomeDropped).Inc()
+		return
+	}
+
+	key := uint32(update.Cell.Y)<<16 | uint32(update.Cell.X)
+	if _, ok := c.slow.coalesced[key]; ok {
+		slowConsumerEvents.WithLabelValues(outcomeSuperseded).Inc()
+	} else {
+		slowConsumerEvents.WithLabelValues(outcomeCoalesced).Inc()
+	}
+	c.slow.coalesced[key] = *update
+}
+
+// takeHeldBack returns the coalesced updates in sequence order, packed into
+// batch frames, and ends coalescing.
+func (c *Client) takeHeldBack() [][]byte {
+	c.slowMu.Lock()
+	coalesced := c.slow.coalesced
+	c.slow.coalesced = nil
+	c.slowMu.Unlock()
+
+	if len(coalesced) == 0 {
+		return nil
+	}
+
+	updates := make([]protocol.Update, 0, len(coalesced))
+	for _, update := range coalesced {
+		updates = append(updates, update)
+	}
+	slices.SortFunc(updates, func(a, b protocol.Update) int {
+		return cmp.Compare(a.Seq, b.Seq)
+	})
+
+	return batchFrames(updates)
+}
+
+// startResync reports whether a resync is due and not already running, and
+// marks it running. Updates flow again from here on; the snapshot read
+// afterwards covers everything dropped before.
+func (c *Client) startResync() bool {
+	c.slowMu.Lock()
+	defer c.slowMu.Unlock()
+
+	if !c.slow.resyncPending || c.slow.resyncing {
+		return false
+	}
+	c.slow.resyncPending = false
+	c.slow.resyncing = true
+
+	return true
+}
+
+func (c *Client) finishResync() {
+	c.slowMu.Lock()
+	c.slow.resyncing = false
+	c.slowMu.Unlock()
+}
+
+// catchUp runs on the write pump once a client's queue has drained: it
+// writes the coalesced updates, or starts the resync it is owed. It reports
+// false if the client was closed.
+func (c *Clients) catchUp(client *Client) bool {
+	for _, message := range client.takeHeldBack() {
+		frame, err := prepareFrame(message)
+		if err != nil {
+			logging.Errorf("failed to create perp msg %v", err)
+			continue
+		}
+		if !c.write(client, frame) {
+			return false
+		}
+	}
+
+	if client.startResync() {
+		go func() {
+			defer client.finishResync()
+			sendLatestStateAndUpdates(client)
+			slowConsumerEvents.WithLabelValues(outcomeResynced).Inc()
+		}()
+	}
+
+	return true
+}
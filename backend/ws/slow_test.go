@@ -0,0 +1,95 @@
+package ws
+
+import (
+	"testing"
+
+	"backend/internal/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func slowTestFrame(t *testing.T, update protocol.Update) outFrame {
+	frame, err := prepareFrame(updateFrame(update))
+	assert.NoError(t, err)
+	frame.update = &update
+
+	return frame
+}
+
+func TestParseSlowConsumerPolicy(t *testing.T) {
+	assert.Equal(t, policyCoalesce, parseSlowConsumerPolicy("coalesce"))
+	assert.Equal(t, policyResync, parseSlowConsumerPolicy("resync"))
+	assert.Equal(t, defaultSlowConsumerPolicy, parseSlowConsumerPolicy("nope"))
+}
+
+func TestDeliverCoalescesPerCell(t *testing.T) {
+	c := &Clients{policy: policyCoalesce}
+	client := newTestClient()
+
+	first := protocol.Update{Seq: 1, Cell: protocol.Cell{X: 1, Y: 1, Color: 1}}
+	assert.True(t, c.deliver(client, slowTestFrame(t, first)))
+
+	held := []protocol.Update{
+		{Seq: 2, Cell: protocol.Cell{X: 5, Y: 5, Color: 2}},
+		{Seq: 3, Cell: protocol.Cell{X: 6, Y: 6, Color: 3}},
+		{Seq: 4, Cell: protocol.Cell{X: 5, Y: 5, Color: 4}}, // replaces seq 2
+	}
+	for i, update := range held {
+		assert.False(t, c.deliver(client, slowTestFrame(t, update)))
+		if i == 0 {
+			<-client.writePipe // room again, but nothing may overtake what is held
+		}
+	}
+	assert.Empty(t, client.writePipe)
+
+	frames := client.takeHeldBack()
+	assert.Len(t, frames, 1)
+	assert.Equal(t, uint8(msgTypeBatch), frames[0][0])
+	assert.Equal(t, byte(3), frames[0][protocol.SeqSize])
+	cells, err := protocol.DecodeBatch(frames[0][1+protocol.SeqSize:])
+	assert.NoError(t, err)
+	assert.Equal(t, []protocol.Cell{held[1].Cell, held[2].Cell}, cells)
+
+	assert.Nil(t, client.takeHeldBack())
+	assert.True(t, c.deliver(client, slowTestFrame(t, first)), "delivery resumes once flushed")
+}
+
+func TestDeliverResyncDropsUntilDrained(t *testing.T) {
+	c := &Clients{policy: policyResync}
+	client := newTestClient()
+	update := protocol.Update{Seq: 1, Cell: protocol.Cell{X: 1, Y: 1, Color: 1}}
+
+	assert.True(t, c.deliver(client, slowTestFrame(t, update)))
+	assert.False(t, c.deliver(client, slowTestFrame(t, update)))
+
+	<-client.writePipe
+	assert.False(t, c.deliver(client, slowTestFrame(t, update)), "dropped until the resync")
+
+	assert.True(t, client.startResync())
+	assert.False(t, client.startResync(), "one resync at a time")
+	assert.True(t, c.deliver(client, slowTestFrame(t, update)), "updates flow once the resync starts")
+
+	client.finishResync()
+	assert.False(t, client.startResync())
+}
+
+func TestDeliverQueuesOtherFramesWhileBehind(t *testing.T) {
+	for _, policy := range []slowConsumerPolicy{policyCoalesce, policyResync} {
+		t.Run(string(policy), func(t *testing.T) {
+			c := &Clients{policy: policy}
+			client := newTestClient()
+			update := protocol.Update{Seq: 1, Cell: protocol.Cell{X: 1, Y: 1, Color: 1}}
+
+			assert.True(t, c.deliver(client, slowTestFrame(t, update)))
+			assert.False(t, c.deliver(client, slowTestFrame(t, update)), "the client falls behind")
+			<-client.writePipe
+
+			chatMessage, err := prepareFrame(chatDeletedFrame(7))
+			assert.NoError(t, err)
+			assert.True(t, c.deliver(client, chatMessage), "only updates are held back")
+			assert.False(t, c.deliver(client, chatMessage), "dropped while the queue is full")
+			assert.False(t, c.deliver(client, slowTestFrame(t, update)))
+
+			assert.Equal(t, chatDeletedFrame(7), (<-client.writePipe).data)
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package ws
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"backend/internal/protocol"
+	"backend/logging"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// eventsRoute streams the same frames as /ws for clients whose websockets are
+// broken, typically by a proxy.
+const eventsRoute = "/api/events"
+
+var errNotWebsocket = errors.New("event streams take frames, not websocket messages")
+
+// sseConn stands in for the websocket of a client on the events endpoint, so
+// the client shares the hub, its writer and the slow consumer policy with
+// websocket clients. Each frame is one event whose data is the frame base64
+// encoded. Update and batch frames carry the last sequence number they cover
+// as the event id, so a reconnecting EventSource resumes through
+// Last-Event-ID. The stream is one way: frames a websocket client sends, such
+// as subscribe or chat, have no equivalent here; a viewport can still be set
+// with ?viewport= when connecting.
+type sseConn struct {
+	w   http.ResponseWriter
+	rc  *http.ResponseController
+	ctx context.Context
+
+	// mu serializes writes. The handler takes it once done is closed, so it
+	// doesn't return while a write is still using w.
+	mu        sync.Mutex
+	pong      func(string) error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newSSEConn starts the event stream of a request. The server's write timeout
+// is lifted; each event gets a deadline of its own instead.
+func newSSEConn(c *gin.Context) (*sseConn, error) {
+	s := &sseConn{
+		w:    c.Writer,
+		rc:   http.NewResponseController(c.Writer),
+		ctx:  c.Request.Context(),
+		done: make(chan struct{}),
+	}
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	// keeps nginx from buffering the stream
+	header.Set("X-Accel-Buffering", "no")
+	c.Writer.WriteHeader(http.StatusOK)
+
+	if err := s.rc.SetWriteDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	if err := s.rc.Flush(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// ReadMessage blocks until the stream ends, as the client never sends.
+func (s *sseConn) ReadMessage() (int, []byte, error) {
+	select {
+	case <-s.done:
+	case <-s.ctx.Done():
+	}
+
+	return 0, nil, io.EOF
+}
+
+func (s *sseConn) SetReadLimit(int64)               {}
+func (s *sseConn) SetReadDeadline(time.Time) error  { return nil }
+func (s *sseConn) EnableWriteCompression(bool)      {}
+func (s *sseConn) SetWriteDeadline(time.Time) error { return nil }
+func (s *sseConn) Subprotocol() string              { return "" }
+func (s *sseConn) WritePreparedMessage(*websocket.PreparedMessage) error {
+	return errNotWebsocket
+}
+
+// SetPongHandler sets what is called after each ping. An event stream has no
+// pongs; a ping that went through stands in for one.
+func (s *sseConn) SetPongHandler(h func(string) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pong = h
+}
+
+// WriteControl writes a ping as a comment, and a close as a close event with
+// the code and reason before ending the stream. EventSource reconnects on its
+// own whenever a stream ends, so the event is how a client learns not to, say
+// when its token expired.
+func (s *sseConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	switch messageType {
+	case websocket.PingMessage:
+		if err := s.write(deadline, []byte(": ping\n\n")); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		pong := s.pong
+		s.mu.Unlock()
+		if pong != nil {
+			return pong("")
+		}
+	case websocket.CloseMessage:
+		defer s.Close()
+
+		code := websocket.CloseNoStatusReceived
+		if len(data) >= 2 {
+			code = int(binary.BigEndian.Uint16(data))
+			data = data[2:]
+		}
+		return s.write(deadline, fmt.Appendf(nil, "event: close\ndata: %d %s\n\n", code, data))
+	}
+
+	return nil
+}
+
+func (s *sseConn) writeFrame(frame []byte) error {
+	var event []byte
+	if id, ok := eventID(frame); ok {
+		event = fmt.Appendf(event, "id: %d\n", id)
+	}
+	event = append(event, "data: "...)
+	event = base64.StdEncoding.AppendEncode(event, frame)
+	event = append(event, "\n\n"...)
+
+	return s.write(time.Now().Add(writeTimeout), event)
+}
+
+func (s *sseConn) write(deadline time.Time, event []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return errClientClosed
+	default:
+	}
+
+	_ = s.rc.SetWriteDeadline(deadline)
+	if _, err := s.w.Write(event); err != nil {
+		return err
+	}
+
+	return s.rc.Flush()
+}
+
+func (s *sseConn) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+
+	return nil
+}
+
+// wait returns once the stream has ended and nothing writes to it anymore.
+func (s *sseConn) wait() {
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+}
+
+// eventID is the last sequence number an update or batch frame covers.
+// Snapshot chunks get none, so a stream cut off halfway through a snapshot
+// isn't resumed as if it had all of it.
+func eventID(frame []byte) (uint64, bool) {
+	if len(frame) < 1+protocol.SeqSize {
+		return 0, false
+	}
+
+	switch frame[0] {
+	case msgTypeUpdate:
+		update, err := decodeUpdate(frame[1:])
+		if err != nil || update.Seq == 0 {
+			return 0, false
+		}
+		return update.Seq, true
+	case msgTypeBatch:
+		first := binary.BigEndian.Uint64(frame[1:])
+		// a batch starts [version][flags][uvarint count]
+		batch := frame[1+protocol.SeqSize:]
+		if len(batch) < 3 {
+			return 0, false
+		}
+		count, n := binary.Uvarint(batch[2:])
+		if n <= 0 || count == 0 {
+			return 0, false
+		}
+		return first + count - 1, true
+	}
+
+	return 0, false
+}
+
+// handleEvents serves the events endpoint. It takes the same options as /ws,
+// with the token in ?token= since EventSource can't set headers, and holds
+// the request open for as long as the client stays connected.
+func handleEvents(c *gin.Context) {
+	claims, ok := admitToken(c)
+	if !ok {
+		return
+	}
+
+	conn, err := newSSEConn(c)
+	if err != nil {
+		logging.Errorf("Event stream error: %v", err)
+		clients.limits.release(c.ClientIP())
+		return
+	}
+
+	client := clients.Add(conn, peerOf(c, claims))
+	sseConnections.Inc()
+	startSession(c, client, claims)
+
+	conn.wait()
+}
@@ -0,0 +1,90 @@
+package ws
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"backend/internal/protocol"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSSEConn() (*sseConn, *httptest.ResponseRecorder) {
+	rec := httptest.NewRecorder()
+
+	return &sseConn{
+		w:    rec,
+		rc:   http.NewResponseController(rec),
+		ctx:  context.Background(),
+		done: make(chan struct{}),
+	}, rec
+}
+
+// events reads what was streamed so far, without racing the writer.
+func (s *sseConn) events(rec *httptest.ResponseRecorder) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return rec.Body.String()
+}
+
+func TestEventIDIsLastSeqCovered(t *testing.T) {
+	cell := protocol.Cell{X: 1, Y: 1, Color: 1, Time: 1760788800000}
+
+	id, ok := eventID(updateFrame(protocol.Update{Seq: 7, Cell: cell}))
+	assert.True(t, ok)
+	assert.EqualValues(t, 7, id)
+
+	batch := batchFrames([]protocol.Update{{Seq: 10, Cell: cell}, {Seq: 11, Cell: cell}, {Seq: 12, Cell: cell}})
+	id, ok = eventID(batch[0])
+	assert.True(t, ok)
+	assert.EqualValues(t, 12, id)
+
+	_, ok = eventID(chunks.chunkFrame(5, make([]byte, protocol.CanvasSize*protocol.CanvasSize/2), 0, false))
+	assert.False(t, ok, "snapshot chunks aren't resumed from")
+	_, ok = eventID(presenceFrame(1, 1))
+	assert.False(t, ok)
+}
+
+func TestEventStreamSharesTheHub(t *testing.T) {
+	c := newClients(1, 16, policyDisconnect)
+	defer c.Close()
+
+	conn, rec := newTestSSEConn()
+	c.register(conn, peer{})
+
+	broadcastUpdate(c, 7, 1, 1)
+	waitDrained(t, c)
+
+	update := protocol.Update{Seq: 7, Cell: protocol.Cell{X: 1, Y: 1, Color: 1, Time: 1760788800000}}
+	expected := fmt.Sprintf("id: 7\ndata: %s\n\n", base64.StdEncoding.EncodeToString(updateFrame(update)))
+	assert.Equal(t, expected, conn.events(rec))
+}
+
+func TestEventStreamPingsAndCloses(t *testing.T) {
+	conn, rec := newTestSSEConn()
+	ponged := false
+	conn.SetPongHandler(func(string) error {
+		ponged = true
+		return nil
+	})
+
+	assert.NoError(t, conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)))
+	assert.True(t, ponged, "a ping that went through stands in for a pong")
+
+	message := websocket.FormatCloseMessage(closeTokenExpired, "token expired")
+	assert.NoError(t, conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second)))
+	conn.wait()
+
+	assert.True(t, strings.HasSuffix(conn.events(rec), "event: close\ndata: 4001 token expired\n\n"))
+	assert.ErrorIs(t, conn.writeFrame(presenceFrame(1, 1)), errClientClosed)
+
+	_, _, err := conn.ReadMessage()
+	assert.Error(t, err, "the reader ends with the stream")
+}
@@ -0,0 +1,213 @@
+package ws
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/internal/config"
+	"backend/internal/protocol"
+	"backend/logging"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// allChunks broadcasts to every client regardless of its region.
+	allChunks = -1
+
+	viewportQueryParam = "viewport"
+	encodingQueryParam = "encodings"
+
+	// encodingRLE lets the server send run-length encoded chunk frames
+	encodingRLE = "rle"
+)
+
+var chunks = newChunkGrid(protocol.CanvasSize, config.Int("WS_CHUNK_SIZE", defaultChunkSize))
+
+// handleClientFrame dispatches a frame read from a client. Unknown and
+// malformed frames are ignored.
+func handleClientFrame(client *Client, msg []byte) {
+	if len(msg) == 0 {
+		return
+	}
+
+	switch msg[0] {
+	case msgTypeSubscribe:
+		rects, err := parseSubscribe(msg[1:])
+		if err != nil {
+			logging.Debugf("client %d: %v", client.ID, err)
+			return
+		}
+		subscribe(client, chunks.region(rects))
+	case msgTypeCursor:
+		if err := cursors.move(client, msg[1:], time.Now()); err != nil {
+			logging.Debugf("client %d: %v", client.ID, err)
+		}
+	case msgTypeChatSend:
+		ctx, cancel := context.WithTimeout(context.Background(), chatTimeout)
+		defer cancel()
+		if err := chat.send(ctx, client, msg[1:], time.Now()); err != nil {
+			logging.Debugf("client %d: chat message refused: %v", client.ID, err)
+		}
+	case msgTypeChatDelete:
+		ctx, cancel := context.WithTimeout(context.Background(), chatTimeout)
+		defer cancel()
+		if err := chat.remove(ctx, client, msg[1:]); err != nil {
+			logging.Debugf("client %d: chat delete refused: %v", client.ID, err)
+		}
+	case msgTypeAuth:
+		if err := client.hub.refreshToken(client, msg[1:]); err != nil {
+			logging.Debugf("client %d: token refresh rejected: %v", client.ID, err)
+		}
+	default:
+		logging.Debugf("client %d sent unknown message type %d", client.ID, msg[0])
+	}
+}
+
+// subscribe moves a client to a new region and has the chunks it didn't have
+// yet sent to it. The region is swapped before the canvas is read, so any
+// update the client was filtered from is already in the chunks it gets. The
+// chunks are sent off the read pump, so a slow client doesn't hold up its
+// other frames; those subscribed to while a send is under way follow it.
+func subscribe(client *Client, next region) {
+	previous := client.region.Swap(&next)
+
+	added := next.chunksNotIn(previous)
+	subscriptionChanges.Inc()
+	if len(added) == 0 {
+		return
+	}
+
+	client.subscribeMu.Lock()
+	defer client.subscribeMu.Unlock()
+
+	for _, chunk := range added {
+		client.unsent.add(chunk)
+	}
+	if !client.sendingChunks {
+		client.sendingChunks = true
+		go sendSubscribed(client)
+	}
+}
+
+// sendSubscribed sends the chunks subscribed to until none are left unsent,
+// skipping those the client has moved away from since.
+func sendSubscribed(client *Client) {
+	for {
+		client.subscribeMu.Lock()
+		current := client.region.Load()
+		added := make([]int, 0)
+		for _, chunk := range client.unsent.chunks() {
+			if current.has(chunk) {
+				added = append(added, chunk)
+			}
+		}
+		client.unsent = nil
+		if len(added) == 0 {
+			client.sendingChunks = false
+			client.subscribeMu.Unlock()
+			return
+		}
+		client.subscribeMu.Unlock()
+
+		sendChunks(client, added)
+	}
+}
+
+func sendChunks(client *Client, added []int) {
+	ctx, cancel := context.WithTimeout(context.Background(), stateSendTimeout)
+	defer cancel()
+
+	state, seq, err := canvasState(ctx)
+	if err != nil {
+		logging.Errorf("Failed to get state for client %d subscription: %v", client.ID, err)
+		return
+	}
+
+	for _, chunk := range added {
+		if err = client.queueWait(ctx, chunks.chunkFrame(seq, state, chunk, client.rle.Load())); err != nil {
+			logging.Errorf("Failed sending chunks to client %d: %v", client.ID, err)
+			return
+		}
+	}
+}
+
+// viewportsFrom reads the viewports a client asks to start with, each given
+// as ?viewport=x,y,w,h. A client that gives none receives the whole canvas.
+func viewportsFrom(c *gin.Context) ([]rect, bool) {
+	values := c.QueryArray(viewportQueryParam)
+	if len(values) == 0 {
+		return nil, false
+	}
+
+	rects := make([]rect, 0, len(values))
+	for _, value := range values {
+		parts := strings.Split(value, ",")
+		if len(parts) != 4 {
+			continue
+		}
+
+		var dims [4]uint16
+		valid := true
+		for i, part := range parts {
+			v, err := strconv.ParseUint(part, 10, 16)
+			if err != nil {
+				valid = false
+				break
+			}
+			dims[i] = uint16(v)
+		}
+		if valid {
+			rects = append(rects, rect{X: dims[0], Y: dims[1], W: dims[2], H: dims[3]})
+		}
+	}
+
+	return rects, true
+}
+
+// acceptsEncoding reports whether a client listed encoding in
+// ?encodings=a,b.
+func acceptsEncoding(c *gin.Context, encoding string) bool {
+	for _, value := range c.QueryArray(encodingQueryParam) {
+		for _, accepted := range strings.Split(value, ",") {
+			if strings.TrimSpace(accepted) == encoding {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// stateChunks lists the chunks a client needs to rebuild its region of the
+// canvas.
+func (c *Client) stateChunks() []int {
+	if r := c.region.Load(); r != nil {
+		return r.chunks()
+	}
+
+	all := make([]int, chunks.count())
+	for i := range all {
+		all[i] = i
+	}
+
+	return all
+}
+
+// inRegion drops the updates outside the client's region.
+func (c *Client) inRegion(updates []protocol.Update) []protocol.Update {
+	r := c.region.Load()
+	if r == nil {
+		return updates
+	}
+
+	kept := make([]protocol.Update, 0, len(updates))
+	for _, update := range updates {
+		if r.has(chunks.chunkOf(update.Cell.X, update.Cell.Y)) {
+			kept = append(kept, update)
+		}
+	}
+
+	return kept
+}
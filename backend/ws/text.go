@@ -0,0 +1,314 @@
+package ws
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"backend/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// Clients pick the frame format by subprotocol when they connect. Clients
+// that offer none, or only the bearer token, get the binary frames described
+// in frames.go.
+//
+// The JSON subprotocol carries the same frames with the same meaning as text
+// messages, each an object whose "type" names the frame. Times are unix
+// milliseconds and colors are palette indices:
+//
+//	{"type":"update","seq":7,"x":1,"y":2,"color":3,"time":1760788800000}
+//	{"type":"batch","seq":8,"cells":[{"x":1,"y":2,"color":3,"time":1760788800000}, ...]}
+//	{"type":"chunk","seq":9,"x":0,"y":0,"w":32,"h":32,"colors":[0,0,3, ...]}
+//	{"type":"presence","viewers":120,"placers":14}
+//	{"type":"cursors","cursors":[{"id":3735928559,"x":1,"y":2}, ...]}
+//	{"type":"chat","id":42,"time":1760788800000,"handle":"anon-0a0b0c0d","text":"hi"}
+//	{"type":"chat_deleted","id":42}
+//	{"type":"chat_rejected","reason":"rate"}
+//	{"type":"drain","delay":12000}           (milliseconds)
+//
+// and clients send
+//
+//	{"type":"subscribe","viewports":[{"x":0,"y":0,"w":64,"h":64}]}
+//	{"type":"cursor","x":1,"y":2}          (without x and y to stop sharing)
+//	{"type":"auth","token":"..."}
+//	{"type":"chat_send","text":"hi"}
+//	{"type":"chat_delete","id":42}
+//
+// A batch's cells have consecutive sequence numbers starting at its seq. A
+// chunk's colors are row-major within it.
+const (
+	// binarySubprotocol asks for the binary frames explicitly
+	binarySubprotocol = "grid.binary.v1"
+	jsonSubprotocol   = "grid.json.v1"
+)
+
+var errUntranslatable = errors.New("frame has no JSON form")
+
+// chatRejectedNames names the reasons of a chat_rejected frame.
+var chatRejectedNames = map[uint8]string{
+	chatRejectedInvalid:     "invalid",
+	chatRejectedRate:        "rate",
+	chatRejectedBanned:      "banned",
+	chatRejectedForbidden:   "forbidden",
+	chatRejectedUnavailable: "unavailable",
+	chatRejectedAnonymous:   "anonymous",
+}
+
+type textCell struct {
+	X     uint16 `json:"x"`
+	Y     uint16 `json:"y"`
+	Color uint8  `json:"color"`
+	Time  int64  `json:"time"`
+}
+
+type textCursor struct {
+	ID uint32 `json:"id"`
+	X  uint16 `json:"x"`
+	Y  uint16 `json:"y"`
+}
+
+type textUpdate struct {
+	Type string `json:"type"`
+	Seq  uint64 `json:"seq"`
+	textCell
+}
+
+type textBatch struct {
+	Type  string     `json:"type"`
+	Seq   uint64     `json:"seq"`
+	Cells []textCell `json:"cells"`
+}
+
+type textChunk struct {
+	Type   string `json:"type"`
+	Seq    uint64 `json:"seq"`
+	X      uint16 `json:"x"`
+	Y      uint16 `json:"y"`
+	W      uint16 `json:"w"`
+	H      uint16 `json:"h"`
+	Colors []int  `json:"colors"`
+}
+
+type textPresence struct {
+	Type    string `json:"type"`
+	Viewers uint32 `json:"viewers"`
+	Placers uint32 `json:"placers"`
+}
+
+type textCursors struct {
+	Type    string       `json:"type"`
+	Cursors []textCursor `json:"cursors"`
+}
+
+type textChat struct {
+	Type   string `json:"type"`
+	ID     uint64 `json:"id"`
+	Time   int64  `json:"time,omitempty"`
+	Handle string `json:"handle,omitempty"`
+	Text   string `json:"text,omitempty"`
+}
+
+type textChatRejected struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+type textDrain struct {
+	Type  string `json:"type"`
+	Delay uint32 `json:"delay"`
+}
+
+// textRequest is any frame a client sends; which fields count depends on Type.
+type textRequest struct {
+	Type      string  `json:"type"`
+	Viewports []rect  `json:"viewports"`
+	X         *uint16 `json:"x"`
+	Y         *uint16 `json:"y"`
+	Token     string  `json:"token"`
+	Text      string  `json:"text"`
+	ID        uint64  `json:"id"`
+}
+
+// textFrame translates a binary frame into its JSON form.
+func textFrame(frame []byte) ([]byte, error) {
+	if len(frame) == 0 {
+		return nil, errUntranslatable
+	}
+
+	body := frame[1:]
+	switch msgType := frame[0]; msgType &^ msgFlagRLE {
+	case msgTypeUpdate:
+		update, err := decodeUpdate(body)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(textUpdate{Type: "update", Seq: update.Seq, textCell: textCellOf(update.Cell)})
+	case msgTypeBatch:
+		if len(body) < protocol.SeqSize {
+			return nil, protocol.ErrMalformedBatch
+		}
+		cells, err := protocol.DecodeBatch(body[protocol.SeqSize:])
+		if err != nil {
+			return nil, err
+		}
+		batch := textBatch{Type: "batch", Seq: binary.BigEndian.Uint64(body), Cells: make([]textCell, len(cells))}
+		for i, cell := range cells {
+			batch.Cells[i] = textCellOf(cell)
+		}
+		return json.Marshal(batch)
+	case msgTypeChunk:
+		return textChunkOf(body, msgType&msgFlagRLE != 0)
+	case msgTypePresence:
+		if len(body) != 8 {
+			return nil, errUntranslatable
+		}
+		return json.Marshal(textPresence{Type: "presence", Viewers: binary.BigEndian.Uint32(body), Placers: binary.BigEndian.Uint32(body[4:])})
+	case msgTypeCursors:
+		batch, err := decodeCursors(body)
+		if err != nil {
+			return nil, err
+		}
+		cursors := textCursors{Type: "cursors", Cursors: make([]textCursor, len(batch))}
+		for i, cur := range batch {
+			cursors.Cursors[i] = textCursor{ID: cur.id, X: cur.x, Y: cur.y}
+		}
+		return json.Marshal(cursors)
+	case msgTypeChat:
+		if len(body) < 17 || len(body) < 17+int(body[16]) {
+			return nil, ErrMalformedChat
+		}
+		handle := body[17 : 17+int(body[16])]
+		return json.Marshal(textChat{
+			Type:   "chat",
+			ID:     binary.BigEndian.Uint64(body),
+			Time:   int64(binary.BigEndian.Uint64(body[8:])),
+			Handle: string(handle),
+			Text:   string(body[17+len(handle):]),
+		})
+	case msgTypeChatDeleted:
+		if len(body) != 8 {
+			return nil, ErrMalformedChat
+		}
+		return json.Marshal(textChat{Type: "chat_deleted", ID: binary.BigEndian.Uint64(body)})
+	case msgTypeChatRejected:
+		if len(body) != 1 {
+			return nil, ErrMalformedChat
+		}
+		return json.Marshal(textChatRejected{Type: "chat_rejected", Reason: chatRejectedNames[body[0]]})
+	case msgTypeDrain:
+		if len(body) != 4 {
+			return nil, errUntranslatable
+		}
+		return json.Marshal(textDrain{Type: "drain", Delay: binary.BigEndian.Uint32(body)})
+	}
+
+	return nil, fmt.Errorf("%w: type %d", errUntranslatable, frame[0])
+}
+
+func textCellOf(cell protocol.Cell) textCell {
+	return textCell{X: cell.X, Y: cell.Y, Color: cell.Color, Time: cell.Time}
+}
+
+func textChunkOf(body []byte, rle bool) ([]byte, error) {
+	if len(body) < protocol.SeqSize+rectSize {
+		return nil, errUntranslatable
+	}
+
+	bounds := body[protocol.SeqSize:]
+	chunk := textChunk{
+		Type: "chunk",
+		Seq:  binary.BigEndian.Uint64(body),
+		X:    binary.BigEndian.Uint16(bounds),
+		Y:    binary.BigEndian.Uint16(bounds[2:]),
+		W:    binary.BigEndian.Uint16(bounds[4:]),
+		H:    binary.BigEndian.Uint16(bounds[6:]),
+	}
+
+	cells := bounds[rectSize:]
+	count := int(chunk.W) * int(chunk.H)
+	var colors []uint8
+	if rle {
+		var err error
+		if colors, err = expandRuns(cells, count); err != nil {
+			return nil, err
+		}
+	} else {
+		colors = unpackColors(cells, count)
+	}
+	if len(colors) != count {
+		return nil, errUntranslatable
+	}
+
+	chunk.Colors = make([]int, count)
+	for i, color := range colors {
+		chunk.Colors[i] = int(color)
+	}
+
+	return json.Marshal(chunk)
+}
+
+// binaryFrame translates a JSON frame from a client into its binary form.
+func binaryFrame(text []byte) ([]byte, error) {
+	var req textRequest
+	if err := json.Unmarshal(text, &req); err != nil {
+		return nil, err
+	}
+
+	switch req.Type {
+	case "subscribe":
+		if len(req.Viewports) > math.MaxUint8 {
+			return nil, fmt.Errorf("%w: %d viewports", ErrMalformedSubscribe, len(req.Viewports))
+		}
+		frame := []byte{msgTypeSubscribe, uint8(len(req.Viewports))}
+		for _, r := range req.Viewports {
+			for _, v := range []uint16{r.X, r.Y, r.W, r.H} {
+				frame = binary.BigEndian.AppendUint16(frame, v)
+			}
+		}
+		return frame, nil
+	case "cursor":
+		x, y := uint16(hiddenCursor), uint16(hiddenCursor)
+		if req.X != nil && req.Y != nil {
+			x, y = *req.X, *req.Y
+		}
+		return binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16([]byte{msgTypeCursor}, x), y), nil
+	case "auth":
+		return append([]byte{msgTypeAuth}, req.Token...), nil
+	case "chat_send":
+		return append([]byte{msgTypeChatSend}, req.Text...), nil
+	case "chat_delete":
+		return binary.BigEndian.AppendUint64([]byte{msgTypeChatDelete}, req.ID), nil
+	}
+
+	return nil, fmt.Errorf("%w: %q", errUntranslatable, req.Type)
+}
+
+// lazyText is the JSON form of a prepared frame, translated on first use and
+// shared by every client the frame is queued to.
+type lazyText struct {
+	once sync.Once
+	msg  *websocket.PreparedMessage
+	err  error
+}
+
+// textMessage returns the frame as a JSON text message.
+func (f outFrame) textMessage() (*websocket.PreparedMessage, error) {
+	translate := func() (*websocket.PreparedMessage, error) {
+		text, err := textFrame(f.data)
+		if err != nil {
+			return nil, err
+		}
+		return websocket.NewPreparedMessage(websocket.TextMessage, text)
+	}
+	if f.text == nil {
+		return translate()
+	}
+
+	f.text.once.Do(func() { f.text.msg, f.text.err = translate() })
+
+	return f.text.msg, f.text.err
+}
@@ -0,0 +1,136 @@
+package ws
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"backend/internal/protocol"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTextFrames(t *testing.T) {
+	cell := protocol.Cell{X: 1, Y: 2, Color: 3, Time: 1760788800000}
+	state := make([]byte, protocol.CanvasSize*protocol.CanvasSize/2)
+
+	for name, expected := range map[string]struct {
+		frame []byte
+		text  string
+	}{
+		"update": {
+			frame: updateFrame(protocol.Update{Seq: 7, Cell: cell}),
+			text:  `{"type":"update","seq":7,"x":1,"y":2,"color":3,"time":1760788800000}`,
+		},
+		"batch": {
+			frame: batchFrames([]protocol.Update{{Seq: 8, Cell: cell}, {Seq: 9, Cell: cell}})[0],
+			text:  `{"type":"batch","seq":8,"cells":[{"x":1,"y":2,"color":3,"time":1760788800000},{"x":1,"y":2,"color":3,"time":1760788800000}]}`,
+		},
+		"presence": {
+			frame: presenceFrame(120, 14),
+			text:  `{"type":"presence","viewers":120,"placers":14}`,
+		},
+		"cursors": {
+			frame: addMsgType(msgTypeCursors, encodeCursors([]cursor{{id: 5, x: 1, y: 2}})),
+			text:  `{"type":"cursors","cursors":[{"id":5,"x":1,"y":2}]}`,
+		},
+		"chat": {
+			frame: chatFrame(42, time.UnixMilli(1760788800000), "anon-0a0b0c0d", "hi"),
+			text:  `{"type":"chat","id":42,"time":1760788800000,"handle":"anon-0a0b0c0d","text":"hi"}`,
+		},
+		"chat deleted": {
+			frame: chatDeletedFrame(42),
+			text:  `{"type":"chat_deleted","id":42}`,
+		},
+		"chat rejected": {
+			frame: []byte{msgTypeChatRejected, chatRejectedRate},
+			text:  `{"type":"chat_rejected","reason":"rate"}`,
+		},
+		"chat rejected for an anonymous sender": {
+			frame: []byte{msgTypeChatRejected, chatRejectedAnonymous},
+			text:  `{"type":"chat_rejected","reason":"anonymous"}`,
+		},
+	} {
+		text, err := textFrame(expected.frame)
+		assert.NoError(t, err, name)
+		assert.JSONEq(t, expected.text, string(text), name)
+	}
+
+	for _, rle := range []bool{false, true} {
+		text, err := textFrame(chunks.chunkFrame(9, state, 0, rle))
+		assert.NoError(t, err)
+
+		var chunk textChunk
+		assert.NoError(t, json.Unmarshal(text, &chunk))
+		assert.Equal(t, textChunk{Type: "chunk", Seq: 9, W: chunks.size, H: chunks.size}, textChunk{Type: chunk.Type, Seq: chunk.Seq, W: chunk.W, H: chunk.H})
+		assert.Len(t, chunk.Colors, int(chunks.size)*int(chunks.size), "every cell is listed")
+	}
+
+	_, err := textFrame([]byte{msgTypeState})
+	assert.ErrorIs(t, err, errUntranslatable)
+}
+
+func TestBinaryFrames(t *testing.T) {
+	for text, expected := range map[string][]byte{
+		`{"type":"subscribe","viewports":[{"x":1,"y":2,"w":3,"h":4}]}`: {msgTypeSubscribe, 1, 0, 1, 0, 2, 0, 3, 0, 4},
+		`{"type":"cursor","x":1,"y":2}`:                                {msgTypeCursor, 0, 1, 0, 2},
+		`{"type":"cursor"}`:                                            {msgTypeCursor, 0xFF, 0xFF, 0xFF, 0xFF},
+		`{"type":"auth","token":"abc"}`:                                {msgTypeAuth, 'a', 'b', 'c'},
+		`{"type":"chat_send","text":"hi"}`:                             {msgTypeChatSend, 'h', 'i'},
+		`{"type":"chat_delete","id":42}`:                               {msgTypeChatDelete, 0, 0, 0, 0, 0, 0, 0, 42},
+	} {
+		frame, err := binaryFrame([]byte(text))
+		assert.NoError(t, err, text)
+		assert.Equal(t, expected, frame, text)
+	}
+
+	_, err := binaryFrame([]byte(`{"type":"update"}`))
+	assert.ErrorIs(t, err, errUntranslatable, "clients don't send updates")
+	_, err = binaryFrame([]byte(`not json`))
+	assert.Error(t, err)
+}
+
+func TestSubprotocolPicksFrameFormat(t *testing.T) {
+	c := newClients(1, 16, policyDisconnect)
+	defer c.Close()
+
+	registered := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		c.register(conn, peer{})
+		registered <- struct{}{}
+	}))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	for _, test := range []struct {
+		offered     []string
+		messageType int
+	}{
+		{offered: nil, messageType: websocket.BinaryMessage},
+		{offered: []string{bearerSubprotocol, "token"}, messageType: websocket.BinaryMessage},
+		{offered: []string{jsonSubprotocol, bearerSubprotocol, "token"}, messageType: websocket.TextMessage},
+	} {
+		conn, _, err := (&websocket.Dialer{Subprotocols: test.offered}).Dial(url, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		<-registered
+
+		c.Broadcast(presenceFrame(120, 14), nil)
+		messageType, msg, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, test.messageType, messageType, test.offered)
+		if messageType == websocket.TextMessage {
+			assert.JSONEq(t, `{"type":"presence","viewers":120,"placers":14}`, string(msg))
+		}
+		conn.Close()
+		waitDrained(t, c)
+	}
+}
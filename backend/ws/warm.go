@@ -0,0 +1,121 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"backend/logging"
+)
+
+const (
+	// cacheFillTimeout bounds one read of the recent buckets
+	cacheFillTimeout = 10 * time.Second
+	// cacheGapInterval spaces out backfills when updates keep going missing,
+	// e.g. while the subscription is lagging
+	cacheGapInterval = time.Second
+	// cacheGapMaxUpdates bounds one backfill; a longer gap is filled over
+	// several, oldest updates first
+	cacheGapMaxUpdates = 10_000
+)
+
+var errCacheCold = errors.New("update cache is still warming up")
+
+// cacheFiller loads history from Redis into the local cache: all of the
+// resume window once when the pod starts, so clients that connect right after
+// a rollout are caught up from memory, and again whenever an update arrives
+// past a hole in the sequence, which means this pod missed a broadcast.
+type cacheFiller struct {
+	warm atomic.Bool
+	gaps chan struct{}
+	// since is when the last update cached before the oldest unfilled gap
+	// was placed, zero if unknown
+	since atomic.Int64
+}
+
+func newCacheFiller() *cacheFiller {
+	return &cacheFiller{gaps: make(chan struct{}, 1)}
+}
+
+// ready reports an error until the cache has been warmed, holding the pod out
+// of rotation.
+func (f *cacheFiller) ready(context.Context) error {
+	if !f.warm.Load() {
+		return errCacheCold
+	}
+
+	return nil
+}
+
+// observe checks an update about to be cached for a gap before it.
+func (f *cacheFiller) observe(seq uint64) {
+	if f == nil {
+		return
+	}
+
+	latest := localCache.Latest()
+	if latest == 0 || seq <= latest+1 {
+		return
+	}
+
+	logging.Debugf("updates %d to %d missing from the cache", latest+1, seq-1)
+	placed := localCache.LatestTime()
+	for {
+		since := f.since.Load()
+		if (since != 0 && since <= placed) || f.since.CompareAndSwap(since, placed) {
+			break
+		}
+	}
+	select {
+	case f.gaps <- struct{}{}:
+	default:
+		// a backfill is already due and will cover this gap too
+	}
+}
+
+// Run warms the cache, then backfills it on every gap reported until ctx is
+// done. A failed warm-up still marks the pod ready: clients fall back to
+// Redis, and the Redis health check keeps the pod out while Redis is down.
+func (f *cacheFiller) Run(ctx context.Context) {
+	now := time.Now().UnixMilli()
+	n := f.fill(ctx, cacheFillWarmup, now-resumeWindow.Milliseconds(), 0)
+	f.warm.Store(true)
+	logging.Infof("warmed update cache with %d updates up to %d", n, localCache.Latest())
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-f.gaps:
+		}
+
+		f.fillGap(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cacheGapInterval):
+		}
+	}
+}
+
+// fillGap caches the updates placed since the last one cached before the
+// gap, less applyDelayMargin, or within the resume window if that is unknown
+// or older.
+func (f *cacheFiller) fillGap(ctx context.Context) {
+	oldest := time.Now().UnixMilli() - resumeWindow.Milliseconds()
+	f.fill(ctx, cacheFillGap, max(f.since.Swap(0)-applyDelayMargin.Milliseconds(), oldest), cacheGapMaxUpdates)
+}
+
+// fill caches up to limit updates stored since from, all of them if limit
+// is 0.
+func (f *cacheFiller) fill(ctx context.Context, reason string, from int64, limit int64) int {
+	ctx, cancel := context.WithTimeout(ctx, cacheFillTimeout)
+	defer cancel()
+
+	n := localCache.Backfill(updatesAfter(storedUpdates(ctx, from, time.Now().UnixMilli(), limit), 0))
+	cacheBackfilled.WithLabelValues(reason).Add(float64(n))
+
+	return n
+}
@@ -0,0 +1,76 @@
+package ws
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"backend/internal/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+// runFiller runs a cache filler until the test ends, and waits for it to stop
+// before the globals it reads are reset.
+func runFiller(t *testing.T, filler *cacheFiller) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		filler.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestCacheFillerWarmsBeforeReady(t *testing.T) {
+	localCache = NewCache(defaultCacheBytes)
+	stored := &bucketRedis{buckets: map[string][]string{}}
+	redisClient = stored
+	t.Cleanup(func() { localCache, redisClient = nil, nil })
+
+	now := time.Now().UnixMilli()
+	var updates []protocol.Update
+	for seq := uint64(1); seq <= 3; seq++ {
+		updates = append(updates, protocol.Update{Seq: seq, Cell: protocol.Cell{X: uint16(seq), Y: 1, Color: 2, Time: now - 100 + int64(seq)}})
+	}
+	stored.add(protocol.UpdatesKey(gridKey, epochs.Of(now)), updates[2], updates[0], updates[1])
+
+	filler := newCacheFiller()
+	assert.ErrorIs(t, filler.ready(context.Background()), errCacheCold)
+
+	runFiller(t, filler)
+
+	assert.Eventually(t, func() bool { return filler.ready(context.Background()) == nil }, time.Second, time.Millisecond)
+	cached, ok := localCache.After(0)
+	assert.True(t, ok)
+	assert.Equal(t, updates, cached)
+}
+
+func TestCacheFillerBackfillsGaps(t *testing.T) {
+	localCache = NewCache(defaultCacheBytes)
+	stored := &bucketRedis{buckets: map[string][]string{}}
+	redisClient = stored
+	t.Cleanup(func() { localCache, redisClient = nil, nil })
+
+	filler := newCacheFiller()
+	runFiller(t, filler)
+	assert.Eventually(t, func() bool { return filler.ready(context.Background()) == nil }, time.Second, time.Millisecond)
+
+	now := time.Now().UnixMilli()
+	missed := protocol.Update{Seq: 2, Cell: protocol.Cell{X: 2, Y: 1, Color: 2, Time: now - 500}}
+	stored.add(protocol.UpdatesKey(gridKey, epochs.Of(now)), missed)
+
+	for _, seq := range []uint64{1, 3} {
+		update := protocol.Update{Seq: seq, Cell: protocol.Cell{X: uint16(seq), Y: 1, Color: 2, Time: now - 1500 + 500*int64(seq)}}
+		filler.observe(seq)
+		localCache.Add(update)
+	}
+
+	assert.Eventually(t, func() bool {
+		cached, ok := localCache.After(0)
+		return ok && len(cached) == 3
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, now-1000-applyDelayMargin.Milliseconds(), stored.from, "only the time since the last cached update is read")
+}
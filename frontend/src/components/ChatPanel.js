@@ -0,0 +1,106 @@
+import React, {useEffect, useRef, useState} from 'react';
+import PropTypes from 'prop-types';
+import styled from 'styled-components';
+
+// MAX_CHAT_TEXT mirrors the server's limit, in bytes of UTF-8.
+const MAX_CHAT_TEXT = 280;
+
+const Panel = styled.div`
+    width: 100%;
+    max-width: 600px;
+    margin-top: 20px;
+    background: white;
+    border-radius: 5px;
+    box-shadow: 0 2px 4px rgba(0, 0, 0, 0.06);
+    display: flex;
+    flex-direction: column;
+`;
+
+const Messages = styled.ul`
+    list-style: none;
+    margin: 0;
+    padding: 8px 12px;
+    height: 200px;
+    overflow-y: auto;
+    font-size: 14px;
+`;
+
+const Handle = styled.span`
+    font-weight: bold;
+    margin-right: 6px;
+`;
+
+const Form = styled.form`
+    display: flex;
+    border-top: 1px solid #eee;
+
+    input {
+        flex: 1;
+        border: none;
+        padding: 8px 12px;
+    }
+`;
+
+const ChatPanel = ({messages, onSend, onDelete, notice}) => {
+    const [draft, setDraft] = useState('');
+    const listRef = useRef(null);
+
+    useEffect(() => {
+        const list = listRef.current;
+        if (list) {
+            list.scrollTop = list.scrollHeight;
+        }
+    }, [messages]);
+
+    const handleSubmit = (event) => {
+        event.preventDefault();
+        const text = draft.trim();
+        if (text === '' || new TextEncoder().encode(text).length > MAX_CHAT_TEXT) {
+            return;
+        }
+        onSend(text);
+        setDraft('');
+    };
+
+    return (
+        <Panel>
+            <Messages ref={listRef}>
+                {messages.map(({id, time, handle, text}) => (
+                    <li key={id} title={new Date(time).toLocaleString()}>
+                        <Handle>{handle}</Handle>
+                        {text}
+                        {onDelete && (
+                            <button type="button" className="btn btn-link btn-sm" onClick={() => onDelete(id)}>
+                                delete
+                            </button>
+                        )}
+                    </li>
+                ))}
+            </Messages>
+            {notice && <div className="text-danger small px-3">{notice}</div>}
+            <Form onSubmit={handleSubmit}>
+                <input
+                    value={draft}
+                    onChange={(e) => setDraft(e.target.value)}
+                    placeholder="Say something about the canvas"
+                    maxLength={MAX_CHAT_TEXT}
+                />
+                <button type="submit" className="btn btn-primary btn-sm">Send</button>
+            </Form>
+        </Panel>
+    );
+};
+
+ChatPanel.propTypes = {
+    messages: PropTypes.arrayOf(PropTypes.shape({
+        id: PropTypes.number.isRequired,
+        time: PropTypes.number.isRequired,
+        handle: PropTypes.string.isRequired,
+        text: PropTypes.string.isRequired,
+    })).isRequired,
+    onSend: PropTypes.func.isRequired,
+    onDelete: PropTypes.func,
+    notice: PropTypes.string,
+};
+
+export default ChatPanel;
@@ -5,7 +5,10 @@ const INITIAL_ZOOM = 1;
 const MAX_ZOOM = 40;
 const MIN_ZOOM = 1;
 
-const PixelGrid = React.memo(({ grid, onPixelClick, size, colors, connectedClients }) => {
+// cursorColor gives each shared cursor a stable hue from its id.
+const cursorColor = (id) => `hsl(${id % 360}, 80%, 45%)`;
+
+const PixelGrid = React.memo(({ grid, onPixelClick, size, colors, connectedClients, activePlacers, cursors, onHover }) => {
     const canvasRef = useRef(null);
     const [zoom, setZoom] = useState(INITIAL_ZOOM);
     const [offset, setOffset] = useState({ x: 0, y: 0 });
@@ -54,6 +57,18 @@ const PixelGrid = React.memo(({ grid, onPixelClick, size, colors, connectedClien
 
         ctx.restore();
 
+        // Outline the pixels others point at
+        (cursors || []).forEach(({ id, x, y }) => {
+            ctx.strokeStyle = cursorColor(id);
+            ctx.lineWidth = 2;
+            ctx.strokeRect(
+                (x - offset.x) * scaleFactor * zoom,
+                (y - offset.y) * scaleFactor * zoom,
+                scaleFactor * zoom,
+                scaleFactor * zoom
+            );
+        });
+
         // Highlight hovered pixel
         if (hoveredPixel) {
             const { x, y } = hoveredPixel;
@@ -66,12 +81,16 @@ const PixelGrid = React.memo(({ grid, onPixelClick, size, colors, connectedClien
                 scaleFactor * zoom
             );
         }
-    }, [grid, size, colors, zoom, offset, hoveredPixel, connectedClients]);
+    }, [grid, size, colors, zoom, offset, hoveredPixel, connectedClients, cursors]);
 
     useEffect(() => {
         drawGrid();
     }, [drawGrid]);
 
+    useEffect(() => {
+        onHover?.(hoveredPixel);
+    }, [hoveredPixel, onHover]);
+
     useEffect(() => {
         const canvas = canvasRef.current;
         if (!canvas) return;
@@ -212,6 +231,21 @@ const PixelGrid = React.memo(({ grid, onPixelClick, size, colors, connectedClien
                     touchAction: 'none'
                 }}
             />
+            {connectedClients > 0 && (
+                <div style={{
+                    position: 'absolute',
+                    top: 8,
+                    right: 8,
+                    padding: '2px 8px',
+                    borderRadius: 4,
+                    background: 'rgba(0, 0, 0, 0.6)',
+                    color: 'white',
+                    fontSize: 12,
+                    pointerEvents: 'none'
+                }}>
+                    {connectedClients} online · {activePlacers} placing
+                </div>
+            )}
         </div>
     );
 });
@@ -222,6 +256,13 @@ PixelGrid.propTypes = {
     size: PropTypes.number.isRequired,
     colors: PropTypes.arrayOf(PropTypes.string).isRequired,
     connectedClients: PropTypes.number.isRequired,
+    activePlacers: PropTypes.number,
+    cursors: PropTypes.arrayOf(PropTypes.shape({
+        id: PropTypes.number.isRequired,
+        x: PropTypes.number.isRequired,
+        y: PropTypes.number.isRequired,
+    })),
+    onHover: PropTypes.func,
 };
 
 export default PixelGrid;
\ No newline at end of file
@@ -4,9 +4,44 @@ import {GoogleLogin, googleLogout} from '@react-oauth/google';
 import useGrid from '../hooks/useGrid';
 import PixelGrid from './PixelGrid';
 import ColorPicker from './ColorPicker';
-import {debounce} from 'lodash';
+import ChatPanel from './ChatPanel';
+import {debounce, throttle} from 'lodash';
 import styled from 'styled-components';
 import {GRID_SIZE, INACTIVITY_TIMEOUT, MAX_RECONNECT_ATTEMPTS, COLORS} from '../utils/constants';
+import {
+    CHAT_REJECTED,
+    CLOSE_SERVICE_RESTART,
+    CLOSE_TOKEN_EXPIRED,
+    decodeBatch,
+    decodeCell,
+    decodeChat,
+    decodeChunk,
+    decodeCursors,
+    decodeDrain,
+    decodeEvent,
+    decodePresence,
+    decodeSeq,
+    encodeAuth,
+    encodeChatDelete,
+    encodeChatSend,
+    encodeCursor,
+    HIDDEN_CURSOR,
+    MSG_FLAG_RLE,
+    SEQ_SIZE
+} from '../utils/protocol';
+
+// RECENT_UPDATES bounds the applied updates kept to replay over a snapshot.
+const RECENT_UPDATES = 512;
+// CURSOR_INTERVAL throttles the cursor this client shares; the server drops
+// cursors sent faster than every 50ms.
+const CURSOR_INTERVAL = 100;
+// CURSOR_TTL forgets others' cursors that stopped moving.
+const CURSOR_TTL = 10000;
+// CHAT_MESSAGES bounds the chat messages kept on screen.
+const CHAT_MESSAGES = 200;
+// WS_FALLBACK_AFTER is how many websockets may fail to open in a row before
+// falling back to the events endpoint, for proxies that break websockets.
+const WS_FALLBACK_AFTER = 2;
 
 const AppContainer = styled.div`
     background: linear-gradient(to bottom right, #f0f0f0, #e0e0e0);
@@ -53,7 +88,7 @@ const GridContainer = styled.div`
 
 
 const RPlaceClone = ({authEnabled}) => {
-    const [grid, setGrid, updateGrid] = useGrid();
+    const [grid, setGrid, updateGrid, setChunk] = useGrid();
     const [selectedColor, setSelectedColor] = useState(0);
     const [error, setError] = useState(null);
     const [token, setToken] = useState(() => localStorage.getItem('token'));
@@ -62,10 +97,27 @@ const RPlaceClone = ({authEnabled}) => {
     const [reconnectDelay, setReconnectDelay] = useState(1000);
     const [initialFetchDone, setInitialFetchDone] = useState(false);
     const [connectedClients, setConnectedClients] = useState(0);
+    const [activePlacers, setActivePlacers] = useState(0);
+    const [shareCursor, setShareCursor] = useState(false);
+    const [cursors, setCursors] = useState([]);
+    const cursorsRef = React.useRef(new Map());
+    const [chatMessages, setChatMessages] = useState([]);
+    const [chatNotice, setChatNotice] = useState(null);
     const [isSignedOut, setIsSignedOut] = useState(false);
 
     const reconnectAttemptsRef = React.useRef(0);
     const wsRef = React.useRef(null);
+    // eventsRef holds the EventSource once websockets are given up on; it only
+    // receives, so cursors, chat and token refreshes need a websocket
+    const eventsRef = React.useRef(null);
+    const failedOpensRef = React.useRef(0);
+    // last applied sequence number, kept across reconnects so the server
+    // only has to send what was missed
+    const lastSeqRef = React.useRef(null);
+    // regionRef holds the viewports this client subscribed to, null for the
+    // whole canvas. Updates outside them are filtered out, so their sequence
+    // numbers have gaps that aren't missed updates.
+    const regionRef = React.useRef(null);
     const lastUpdateRef = React.useRef(null);
 
     const debouncedUpdateGrid = useCallback(
@@ -106,64 +158,222 @@ const RPlaceClone = ({authEnabled}) => {
             console.log('WebSocket already connected. Skipping connection.');
             return
         }
+        if (eventsRef.current && eventsRef.current.readyState !== EventSource.CLOSED) {
+            console.log('Event stream already connected. Skipping connection.');
+            return
+        }
 
-        const ws = new WebSocket(`${window.location.origin.replace(/^http/, 'ws')}/ws?token=${token}`);
+        const since = lastSeqRef.current === null ? '' : `&since=${lastSeqRef.current}`;
+
+        // the snapshot streams in as chunk frames sharing one seq. Updates can
+        // arrive before it; hold them until the first chunk does and then
+        // apply only those newer than the snapshot. Until every chunk is in,
+        // remember applied updates so a chunk painted later doesn't hide them.
+        // A resumed session already has its state and may not get a snapshot.
+        // A slow client can be sent a fresh snapshot at any time; the latest
+        // applied updates are kept so it doesn't hide those newer than itself.
+        let lastSeq = lastSeqRef.current;
+        // moveOff closes this connection for a new one, set once it is open;
+        // moved keeps its close from also scheduling a reconnect
+        let moveOff = () => {};
+        let moved = false;
+        let pending = [];
+        let loading = null;
+        let applied = [];
+        const applyUpdate = (seq, cell) => {
+            if (lastSeq === null) {
+                pending.push([seq, cell]);
+                return;
+            }
+            if (seq <= lastSeq) {
+                return;
+            }
+            if (seq > lastSeq + 1 && regionRef.current === null) {
+                console.warn(`Missed updates ${lastSeq + 1}..${seq - 1}`);
+            }
+            lastSeq = seq;
+            lastSeqRef.current = seq;
+            loading?.recent.push(cell);
+            applied.push([seq, cell]);
+            if (applied.length > RECENT_UPDATES) {
+                applied = applied.slice(-RECENT_UPDATES / 2);
+            }
+            handlePixel(cell);
+        };
+        const applyChunk = (seq, chunk) => {
+            if (loading === null || loading.seq !== seq) {
+                const newer = applied.filter(([appliedSeq]) => appliedSeq > seq).map(([, cell]) => cell);
+                loading = {seq, remaining: GRID_SIZE * GRID_SIZE, recent: newer};
+                lastSeq = Math.max(seq, lastSeq ?? seq);
+                lastSeqRef.current = lastSeq;
+                const buffered = pending;
+                pending = [];
+                buffered.forEach(([bufferedSeq, cell]) => applyUpdate(bufferedSeq, cell));
+            }
+            setChunk(chunk);
+            loading.recent
+                .filter(({x, y}) => x >= chunk.x && x < chunk.x + chunk.w && y >= chunk.y && y < chunk.y + chunk.h)
+                .forEach(({x, y, color}) => updateGrid(x, y, color));
+            loading.remaining -= chunk.w * chunk.h;
+            if (loading.remaining <= 0) {
+                loading = null;
+                setInitialFetchDone(true);
+            }
+        };
+
+        const handleFrame = (view) => {
+            const msgType = view.getUint8(0);
+            switch (msgType & ~MSG_FLAG_RLE) {
+                case 4: {
+                    // pixel update
+                    applyUpdate(decodeSeq(view), decodeCell(view, 1 + SEQ_SIZE))
+                    break
+                }
+                case 8: {
+                    // batch of consecutive updates
+                    const first = decodeSeq(view);
+                    decodeBatch(view, 1 + SEQ_SIZE).forEach((cell, i) => applyUpdate(first + i, cell))
+                    break
+                }
+                case 16: {
+                    // one chunk of the snapshot
+                    applyChunk(decodeSeq(view), decodeChunk(view, (msgType & MSG_FLAG_RLE) !== 0))
+                    break
+                }
+                case 3: {
+                    // viewers and active placers across the service
+                    const {viewers, placers} = decodePresence(view);
+                    setConnectedClients(viewers);
+                    setActivePlacers(placers);
+                    break
+                }
+                case 6: {
+                    // cursors of other clients
+                    const now = Date.now();
+                    const known = cursorsRef.current;
+                    decodeCursors(view).forEach(({id, x, y}) => {
+                        if (x === HIDDEN_CURSOR && y === HIDDEN_CURSOR) {
+                            known.delete(id);
+                        } else {
+                            known.set(id, {id, x, y, seen: now});
+                        }
+                    });
+                    known.forEach(({id, seen}) => seen < now - CURSOR_TTL && known.delete(id));
+                    setCursors(Array.from(known.values()));
+                    break
+                }
+                case 9: {
+                    // a chat message; the history sent on connect repeats
+                    // what a reconnecting client already has
+                    const message = decodeChat(view);
+                    setChatMessages((prev) => prev.some(({id}) => id === message.id)
+                        ? prev
+                        : [...prev, message].sort((a, b) => a.id - b.id).slice(-CHAT_MESSAGES));
+                    break
+                }
+                case 11: {
+                    // a chat message deleted by a moderator
+                    const id = decodeSeq(view);
+                    setChatMessages((prev) => prev.filter((message) => message.id !== id));
+                    break
+                }
+                case 12: {
+                    // our chat send or delete was refused
+                    setChatNotice(CHAT_REJECTED[view.getUint8(1)] ?? 'Chat message refused.');
+                    break
+                }
+                case 13: {
+                    // the pod is shutting down; resume on another before it
+                    // closes this connection
+                    setTimeout(() => moveOff(), decodeDrain(view));
+                    break
+                }
+                default:
+                    console.warn('Received unknown message type:', msgType);
+            }
+        };
+
+        if (failedOpensRef.current >= WS_FALLBACK_AFTER) {
+            // the same frames, base64 encoded; EventSource can't set headers,
+            // and resumes by itself with Last-Event-ID when the stream drops
+            const events = new EventSource(`${window.location.origin}/api/events?encodings=rle&chat=1&token=${encodeURIComponent(token)}${since}`);
+            events.onopen = () => {
+                console.log('Event stream connected');
+            };
+            events.onmessage = (event) => handleFrame(decodeEvent(event.data));
+            // the server ends a session with a close event carrying its code
+            events.addEventListener('close', (event) => {
+                events.close();
+                eventsRef.current = null;
+                const code = parseInt(event.data, 10);
+                if (code === CLOSE_TOKEN_EXPIRED) {
+                    setError('Your session expired. Please sign in again.');
+                    setIsSignedOut(true);
+                    return;
+                }
+                if (code === CLOSE_SERVICE_RESTART) {
+                    moveOff();
+                    return;
+                }
+                reconnectWebSocket();
+            });
+            moveOff = () => {
+                if (moved) {
+                    return;
+                }
+                moved = true;
+                events.close();
+                if (eventsRef.current === events) {
+                    eventsRef.current = null;
+                }
+                connectWebSocket();
+            };
+            eventsRef.current = events;
+            return;
+        }
+
+        // browsers can't set headers on a websocket; the token rides along as
+        // the subprotocol after "bearer"
+        const ws = new WebSocket(`${window.location.origin.replace(/^http/, 'ws')}/ws?encodings=rle&cursors=1&chat=1${since}`, ['bearer', token]);
+        let opened = false;
 
         ws.onopen = () => {
             console.log('WebSocket connected');
+            opened = true;
+            failedOpensRef.current = 0;
         };
         ws.binaryType = 'arraybuffer';
+
         ws.onmessage = async (event) => {
             if (event.data instanceof ArrayBuffer) {
-                const view = new DataView(event.data);
-                let msgType = view.getUint8(0);
-                switch (msgType) {
-                    case 2: {
-                        //state
-                        setGrid(new Uint8Array(event.data).slice(1).buffer);
-                        setInitialFetchDone(true)
-                        break
-                    }
-                    case 4: {
-                        // pixel update
-                        handlePixel(decodePixel(view))
-                        break
-                    }
-                    default:
-                        console.warn('Received unknown message type:', msgType);
-                }
+                handleFrame(new DataView(event.data));
             } else {
                 console.warn('Received unknown message format:', event.data);
             }
         }
 
-        function decodePixel(encoded) {
-            const view = new DataView(encoded.buffer);
-
-            const combinedX = view.getUint16(1, false);
-            const x = combinedX & 0x3FFF;
-            let color = (combinedX >> 12) & 0b1100;
-
-            const combinedY = view.getUint16(3, false);
-            const y = combinedY & 0x3FFF;
-            color |= (combinedY >> 14) & 0b0011;
-
-            const millisDiff = view.getUint32(5, false);
-            const time = 1704067200000 + millisDiff;
-
-            return {
-                x: x,
-                y: y,
-                color: color,
-                time: time
-            };
-        }
-
         ws.onerror = (error) => {
             console.error('WebSocket error:', error);
         };
 
-        ws.onclose = () => {
+        ws.onclose = (event) => {
+            if (moved) {
+                return;
+            }
+            if (event.code === CLOSE_SERVICE_RESTART) {
+                moveOff();
+                return;
+            }
+            if (event.code === CLOSE_TOKEN_EXPIRED) {
+                setError('Your session expired. Please sign in again.');
+                setIsSignedOut(true);
+                wsRef.current = null;
+                return;
+            }
+            if (!opened) {
+                failedOpensRef.current++;
+            }
+            // jittered so clients refused after a deploy don't all retry at once
             setTimeout(() => {
                 if (reconnectAttemptsRef.current < MAX_RECONNECT_ATTEMPTS) {
                     reconnectAttemptsRef.current++;
@@ -173,11 +383,19 @@ const RPlaceClone = ({authEnabled}) => {
                     setIsSignedOut(true)
                     wsRef.current = null;
                 }
-            }, 1000 * Math.pow(2, reconnectAttemptsRef.current));
+            }, 1000 * Math.pow(2, reconnectAttemptsRef.current) * (0.5 + Math.random()));
         };
 
+        moveOff = () => {
+            if (moved) {
+                return;
+            }
+            moved = true;
+            ws.close();
+            connectWebSocket();
+        };
         wsRef.current = ws;
-    }, [token, updateGrid, isSignedOut, handlePixel]);
+    }, [token, updateGrid, setChunk, isSignedOut, handlePixel]);
 
     const reconnectWebSocket = useCallback(() => {
         if (isSignedOut) {
@@ -210,6 +428,8 @@ const RPlaceClone = ({authEnabled}) => {
             if (wsRef.current) {
                 wsRef.current.close();
             }
+            eventsRef.current?.close();
+            eventsRef.current = null;
             setInitialFetchDone(false);
         }
     }, [token, connectWebSocket, initialFetchDone, setGrid, isSignedOut]);
@@ -247,15 +467,15 @@ const RPlaceClone = ({authEnabled}) => {
 
     useEffect(() => {
         const checkTokenExpiration = () => {
-            if (token) {
-                // const tokenData = JSON.parse(atob(token.split('.')[1]));
-                // const expirationTime = tokenData.exp * 1000; // Convert to milliseconds
-                // const currentTime = Date.now();
-                // const timeUntilExpiration = expirationTime - currentTime;
-                //
-                // if (timeUntilExpiration < 300000) { // 5 minutes before expiration
-                //     renewToken();
-                // }
+            if (authEnabled && token) {
+                const tokenData = JSON.parse(atob(token.split('.')[1]));
+                const expirationTime = tokenData.exp * 1000; // Convert to milliseconds
+                const currentTime = Date.now();
+                const timeUntilExpiration = expirationTime - currentTime;
+
+                if (timeUntilExpiration < 300000) { // 5 minutes before expiration
+                    renewToken();
+                }
             }
         };
 
@@ -264,6 +484,20 @@ const RPlaceClone = ({authEnabled}) => {
         return () => clearInterval(intervalId);
     }, [token]);
 
+    useEffect(() => {
+        // hand a renewed token to the open session so it isn't closed when
+        // the one it connected with expires
+        if (authEnabled && token && wsRef.current?.readyState === WebSocket.OPEN) {
+            wsRef.current.send(encodeAuth(token));
+        }
+        // an event stream can't be told; reconnect it with the new token
+        if (authEnabled && token && eventsRef.current) {
+            eventsRef.current.close();
+            eventsRef.current = null;
+            connectWebSocket();
+        }
+    }, [token]);
+
     const handlePixelUpdate = useCallback(async (x, y) => {
         if (!token) {
             setError('Please sign in to update pixels');
@@ -291,11 +525,54 @@ const RPlaceClone = ({authEnabled}) => {
         }
     }, [token, selectedColor, updateGrid]);
 
+    const sendCursor = useMemo(() => throttle((pixel) => {
+        if (wsRef.current?.readyState === WebSocket.OPEN) {
+            wsRef.current.send(pixel ? encodeCursor(pixel.x, pixel.y) : encodeCursor(HIDDEN_CURSOR, HIDDEN_CURSOR));
+        }
+    }, CURSOR_INTERVAL), []);
+
+    const handleHover = useCallback((pixel) => {
+        if (shareCursor) {
+            sendCursor(pixel);
+        }
+    }, [shareCursor, sendCursor]);
+
+    useEffect(() => {
+        if (!shareCursor) {
+            sendCursor(null);
+        }
+    }, [shareCursor, sendCursor]);
+
+    const sendChat = useCallback((text) => {
+        if (wsRef.current?.readyState === WebSocket.OPEN) {
+            setChatNotice(null);
+            wsRef.current.send(encodeChatSend(text));
+        } else if (eventsRef.current) {
+            setChatNotice('Chat is read-only while your network blocks WebSockets.');
+        }
+    }, []);
+
+    // the server only honours deletes from moderators and says so otherwise
+    const deleteChat = useCallback((id) => {
+        if (wsRef.current?.readyState === WebSocket.OPEN) {
+            wsRef.current.send(encodeChatDelete(id));
+        }
+    }, []);
+
+    const cursorToggle = (
+        <label style={{marginLeft: 12}}>
+            <input type="checkbox" checked={shareCursor} onChange={(e) => setShareCursor(e.target.checked)}/>
+            {' '}Share my cursor
+        </label>
+    );
+
     const handleSignOut = useCallback(() => {
         googleLogout();
         setToken(null);
         setGrid(new Uint8Array(GRID_SIZE * GRID_SIZE));
         if (wsRef.current) wsRef.current.close();
+        eventsRef.current?.close();
+        eventsRef.current = null;
         setIsSignedOut(true);
         localStorage.removeItem('token');
     }, [setGrid]);
@@ -336,6 +613,7 @@ const RPlaceClone = ({authEnabled}) => {
                         <ColorPickerContainer>
                             <ColorPicker selectedColor={selectedColor} onColorSelect={setSelectedColor}
                                          colors={COLORS}/>
+                            {cursorToggle}
                         </ColorPickerContainer>
                         <GridContainer>
                             <PixelGrid
@@ -344,8 +622,13 @@ const RPlaceClone = ({authEnabled}) => {
                                 size={GRID_SIZE}
                                 colors={COLORS}
                                 connectedClients={connectedClients}
+                                activePlacers={activePlacers}
+                                cursors={cursors}
+                                onHover={handleHover}
                             />
                         </GridContainer>
+                        <ChatPanel messages={chatMessages} onSend={sendChat} onDelete={deleteChat}
+                                   notice={chatNotice}/>
                     </>
                 ) : (
                     <GoogleLogin
@@ -357,6 +640,7 @@ const RPlaceClone = ({authEnabled}) => {
                 <>
                     <ColorPickerContainer>
                         <ColorPicker selectedColor={selectedColor} onColorSelect={setSelectedColor} colors={COLORS}/>
+                        {cursorToggle}
                     </ColorPickerContainer>
                     <GridContainer>
                         <PixelGrid
@@ -365,8 +649,12 @@ const RPlaceClone = ({authEnabled}) => {
                             size={GRID_SIZE}
                             colors={COLORS}
                             connectedClients={connectedClients}
+                            activePlacers={activePlacers}
+                            cursors={cursors}
+                            onHover={handleHover}
                         />
                     </GridContainer>
+                    <ChatPanel messages={chatMessages} onSend={sendChat} notice={chatNotice}/>
                 </>
             )}
 
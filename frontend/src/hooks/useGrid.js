@@ -33,6 +33,13 @@ const gridReducer = (state, action) => {
                 }
             }
             return unpackedGrid;
+        case 'SET_CHUNK': {
+            const chunkGrid = state.slice();
+            action.chunk.cells.forEach(({x, y, color}) => {
+                chunkGrid[y * GRID_SIZE + x] = color;
+            });
+            return chunkGrid;
+        }
         default:
             return state;
     }
@@ -49,7 +56,11 @@ const useGrid = () => {
         dispatch({ type: 'SET_GRID', grid: newGrid });
     }, []);
 
-    return [grid, setGrid, updateGrid];
+    const setChunk = useCallback((chunk) => {
+        dispatch({ type: 'SET_CHUNK', chunk });
+    }, []);
+
+    return [grid, setGrid, updateGrid, setChunk];
 };
 
 export default useGrid;
\ No newline at end of file
@@ -0,0 +1,245 @@
+// Decoders for the binary ws protocol, mirroring backend/internal/protocol.
+
+const REFERENCE_TIME = 1704067200000;
+const CELL_VERSION_1 = 1;
+const BATCH_VERSION_1 = 1;
+const BATCH_FLAG_RUN_LENGTH = 1;
+
+// decodeCell reads one cell starting at offset; legacy cells are 8 bytes with
+// no version byte, version 1 cells are 12 bytes.
+export function decodeCell(view, offset = 0) {
+    const size = view.byteLength - offset;
+    if (size === 12 && view.getUint8(offset) === CELL_VERSION_1) {
+        const millisDiff = view.getUint16(offset + 6, false) * 2 ** 32 + view.getUint32(offset + 8, false);
+        return {
+            x: view.getUint16(offset + 1, false),
+            y: view.getUint16(offset + 3, false),
+            color: view.getUint8(offset + 5),
+            time: REFERENCE_TIME + millisDiff
+        };
+    }
+
+    const combinedX = view.getUint16(offset, false);
+    const combinedY = view.getUint16(offset + 2, false);
+    return {
+        x: combinedX & 0x3FFF,
+        y: combinedY & 0x3FFF,
+        color: ((combinedX >> 12) & 0b1100) | ((combinedY >> 14) & 0b0011),
+        time: REFERENCE_TIME + view.getUint32(offset + 4, false)
+    };
+}
+
+function reader(view, offset) {
+    let pos = offset;
+    const uvarint = () => {
+        let result = 0;
+        let scale = 1;
+        for (;;) {
+            const b = view.getUint8(pos++);
+            result += (b & 0x7F) * scale;
+            if (b < 0x80) {
+                return result;
+            }
+            scale *= 128;
+        }
+    };
+    const varint = () => {
+        const u = uvarint();
+        return u % 2 === 0 ? u / 2 : -(u + 1) / 2;
+    };
+    const byte = () => view.getUint8(pos++);
+    return {uvarint, varint, byte};
+}
+
+// decodeBatch reverses protocol.BatchEncoder.Encode.
+export function decodeBatch(view, offset = 0) {
+    if (view.getUint8(offset) !== BATCH_VERSION_1) {
+        throw new Error(`unknown batch version ${view.getUint8(offset)}`);
+    }
+    const runLength = (view.getUint8(offset + 1) & BATCH_FLAG_RUN_LENGTH) !== 0;
+    const r = reader(view, offset + 2);
+
+    const count = r.uvarint();
+    let prev = {x: 0, y: 0, color: 0, time: REFERENCE_TIME + r.varint()};
+    const cells = [];
+    while (cells.length < count) {
+        const run = runLength ? r.uvarint() : 1;
+        const x = prev.x + r.varint();
+        const y = prev.y + r.varint();
+        const color = r.byte();
+        const time = prev.time + r.varint();
+        for (let i = 0; i < run; i++) {
+            cells.push({x: x + i, y, color, time});
+        }
+        prev = cells[cells.length - 1];
+    }
+    return cells;
+}
+
+export const SEQ_SIZE = 8;
+
+// decodeSeq reads the big-endian sequence number frames carry after their type.
+export function decodeSeq(view, offset = 1) {
+    return Number(view.getBigUint64(offset, false));
+}
+
+const MSG_TYPE_SUBSCRIBE = 32;
+const MSG_TYPE_AUTH = 64;
+const MSG_TYPE_CURSOR = 5;
+const MSG_TYPE_CHAT_SEND = 7;
+const MSG_TYPE_CHAT_DELETE = 10;
+
+// HIDDEN_CURSOR as both coordinates withdraws a shared cursor.
+export const HIDDEN_CURSOR = 0xFFFF;
+
+// CLOSE_TOKEN_EXPIRED is the close code of sessions whose token ran out.
+export const CLOSE_TOKEN_EXPIRED = 4001;
+
+// CLOSE_SERVICE_RESTART is the close code of sessions on a pod shutting down;
+// reconnecting lands on another one.
+export const CLOSE_SERVICE_RESTART = 1012;
+
+// MSG_FLAG_RLE is set on the type of chunk frames whose cells are run-length
+// encoded; clients opt in with ?encodings=rle.
+export const MSG_FLAG_RLE = 0x80;
+
+// decodeChunk reads a chunk frame body: the chunk's origin and size followed
+// by its cells, either packed as u4, row-major, the even cell in the upper
+// nibble, or with rle set as runs of uvarint(length << 4 | color).
+export function decodeChunk(view, rle = false, offset = 1 + SEQ_SIZE) {
+    const x = view.getUint16(offset, false);
+    const y = view.getUint16(offset + 2, false);
+    const w = view.getUint16(offset + 4, false);
+    const h = view.getUint16(offset + 6, false);
+    const colors = [];
+    if (rle) {
+        const r = reader(view, offset + 8);
+        while (colors.length < w * h) {
+            const run = r.uvarint();
+            const color = run % 16;
+            for (let i = 0; i < Math.floor(run / 16); i++) {
+                colors.push(color);
+            }
+        }
+    } else {
+        for (let i = 0; i < w * h; i++) {
+            const b = view.getUint8(offset + 8 + (i >> 1));
+            colors.push(i % 2 === 0 ? b >> 4 : b & 0x0F);
+        }
+    }
+    const cells = colors.map((color, i) => ({x: x + (i % w), y: y + Math.floor(i / w), color}));
+    return {x, y, w, h, cells};
+}
+
+// decodePresence reads a presence frame: the viewers connected across the
+// service and the people who placed within the last minute.
+export function decodePresence(view) {
+    return {viewers: view.getUint32(1, false), placers: view.getUint32(5, false)};
+}
+
+// decodeDrain reads a drain frame: how many milliseconds this client has to
+// reconnect before the pod it is on closes the connection.
+export function decodeDrain(view) {
+    return view.getUint32(1, false);
+}
+
+// encodeCursor builds a cursor frame sharing where this client points; pass
+// HIDDEN_CURSOR for both coordinates to stop sharing.
+export function encodeCursor(x, y) {
+    const view = new DataView(new ArrayBuffer(5));
+    view.setUint8(0, MSG_TYPE_CURSOR);
+    view.setUint16(1, x, false);
+    view.setUint16(3, y, false);
+    return view.buffer;
+}
+
+// decodeCursors reads a cursors frame: other clients' cursors, each with a
+// random id that lasts for their connection.
+export function decodeCursors(view) {
+    const count = view.getUint16(1, false);
+    const cursors = [];
+    for (let i = 0; i < count; i++) {
+        const offset = 3 + i * 8;
+        cursors.push({
+            id: view.getUint32(offset, false),
+            x: view.getUint16(offset + 4, false),
+            y: view.getUint16(offset + 6, false)
+        });
+    }
+    return cursors;
+}
+
+// encodeAuth builds an auth frame handing the server a renewed token, so the
+// session outlives the token it connected with.
+export function encodeAuth(token) {
+    const encoded = new TextEncoder().encode(token);
+    const frame = new Uint8Array(1 + encoded.length);
+    frame[0] = MSG_TYPE_AUTH;
+    frame.set(encoded, 1);
+    return frame.buffer;
+}
+
+// encodeSubscribe builds a subscribe frame asking for the chunks overlapping
+// the given viewports, each {x, y, w, h} in cells.
+export function encodeSubscribe(viewports) {
+    const view = new DataView(new ArrayBuffer(2 + viewports.length * 8));
+    view.setUint8(0, MSG_TYPE_SUBSCRIBE);
+    view.setUint8(1, viewports.length);
+    viewports.forEach(({x, y, w, h}, i) => {
+        [x, y, w, h].forEach((v, j) => view.setUint16(2 + i * 8 + j * 2, v, false));
+    });
+    return view.buffer;
+}
+
+// CHAT_REJECTED explains why the server refused a chat send or delete.
+export const CHAT_REJECTED = {
+    1: 'That message is empty or too long.',
+    2: 'You are sending messages too fast.',
+    3: 'You are banned from chat.',
+    4: 'Only moderators can delete messages.',
+    5: 'Chat is unavailable right now.',
+    6: 'Sign in to chat.'
+};
+
+// encodeChatSend builds a chat send frame carrying the message text.
+export function encodeChatSend(text) {
+    const encoded = new TextEncoder().encode(text);
+    const frame = new Uint8Array(1 + encoded.length);
+    frame[0] = MSG_TYPE_CHAT_SEND;
+    frame.set(encoded, 1);
+    return frame.buffer;
+}
+
+// encodeChatDelete builds a frame asking to delete a chat message for
+// everyone; the server only honours it from moderators.
+export function encodeChatDelete(id) {
+    const view = new DataView(new ArrayBuffer(9));
+    view.setUint8(0, MSG_TYPE_CHAT_DELETE);
+    view.setBigUint64(1, BigInt(id), false);
+    return view.buffer;
+}
+
+// decodeChat reads a chat frame: the message id, when it was sent, the
+// author's handle and the text.
+export function decodeChat(view) {
+    const decoder = new TextDecoder();
+    const handleLength = view.getUint8(17);
+    const bytes = new Uint8Array(view.buffer, view.byteOffset, view.byteLength);
+    return {
+        id: decodeSeq(view),
+        time: Number(view.getBigUint64(9, false)),
+        handle: decoder.decode(bytes.subarray(18, 18 + handleLength)),
+        text: decoder.decode(bytes.subarray(18 + handleLength))
+    };
+}
+
+// decodeEvent turns an event from the events endpoint, a base64 encoded frame,
+// into the same view a websocket message gives.
+export function decodeEvent(data) {
+    const binary = atob(data);
+    const bytes = new Uint8Array(binary.length);
+    for (let i = 0; i < binary.length; i++) {
+        bytes[i] = binary.charCodeAt(i);
+    }
+    return new DataView(bytes.buffer);
+}